@@ -0,0 +1,438 @@
+package libpiper
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+)
+
+// reasons why a connection failed to establish a pipe
+const (
+	FailureTimeout          = "timeout"
+	FailureRefused          = "refused"
+	FailureChallenge        = "challenge_failure"
+	FailureUpstreamNotFound = "upstream_not_found"
+	FailureUpstream         = "upstream_handshake_failure"
+	FailureUpstreamHostKey  = "upstream_host_key_mismatch"
+	FailureAuth             = "auth_failure"
+	FailureAuditor          = "auditor_failure"
+	FailureOther            = "other"
+)
+
+// SSH_DISCONNECT_BY_APPLICATION, RFC 4253 Section 11.1
+const disconnectByApplication = 11
+
+type disconnectMsg struct {
+	Reason   uint32 `sshtype:"1"`
+	Message  string
+	Language string
+}
+
+// ConnInfo describes a connection with established pipe
+type ConnInfo struct {
+	ID             string    `json:"id"`
+	User           string    `json:"user"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Upstream       string    `json:"upstream"`
+	UpstreamUser   string    `json:"upstream_user"`
+	Challenger     string    `json:"challenger,omitempty"`
+	ChallengedUser string    `json:"challenged_user,omitempty"`
+	Start          time.Time `json:"start"`
+	BytesUp        uint64    `json:"bytes_up"`
+	BytesDown      uint64    `json:"bytes_down"`
+}
+
+// Conn is a downstream connection accepted by Server
+type Conn struct {
+	// ID is unique for each connection, also logged as conn_id
+	ID string
+
+	start time.Time
+
+	mu      sync.Mutex
+	netConn net.Conn
+	logger  logging.Logger
+
+	// downstream conn meta bound to conn_id for logger.WithConn in drivers
+	bound ssh.ConnMetadata
+
+	user         string
+	reason       string
+	challengeCtx ssh.AdditionalChallengeContext
+	dial         time.Duration
+	pipe         *ssh.PiperConn
+
+	checkUserOnce sync.Once
+	checkUserErr  error
+
+	// bytes of msgs from downstream and from upstream
+	bytesUp   uint64
+	bytesDown uint64
+
+	disconnect []byte
+	sent       bool
+}
+
+func newConn(id string, c net.Conn, logger logging.Logger) *Conn {
+	return &Conn{
+		ID:      id,
+		start:   time.Now(),
+		netConn: c,
+		logger: logger.With(logging.Fields{
+			"conn_id":     id,
+			"remote_addr": c.RemoteAddr().String(),
+		}),
+	}
+}
+
+// NetConn returns the underlying downstream conn
+func (c *Conn) NetConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.netConn
+}
+
+// SetNetConn replaces the underlying conn, only takes effect in Hooks.Accept
+func (c *Conn) SetNetConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.netConn = conn
+	c.logger = c.logger.With(logging.Fields{"remote_addr": conn.RemoteAddr().String()})
+}
+
+// RemoteAddr returns the address of downstream
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.NetConn().RemoteAddr()
+}
+
+// Logger returns the logger with fields of the connection
+func (c *Conn) Logger() logging.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.logger
+}
+
+// AddLogFields adds fields to logs of the connection
+func (c *Conn) AddLogFields(fields logging.Fields) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logger = c.logger.With(fields)
+}
+
+// User returns the username downstream tried, empty if handshake failed before auth
+func (c *Conn) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.user
+}
+
+// FailureReason returns why the pipe failed to establish, one of Failure* constants
+func (c *Conn) FailureReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == "" {
+		return FailureOther
+	}
+
+	return c.reason
+}
+
+func (c *Conn) setFailureReason(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reason = reason
+}
+
+// ChallengeContext returns the context passed to upstream, nil if no challenger
+func (c *Conn) ChallengeContext() ssh.AdditionalChallengeContext {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.challengeCtx
+}
+
+// UpstreamDialDuration returns time spent by upstream provider to find and dial upstream
+func (c *Conn) UpstreamDialDuration() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.dial
+}
+
+// Pipe returns the established pipe, nil before established
+func (c *Conn) Pipe() *ssh.PiperConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.pipe
+}
+
+func (c *Conn) setPipe(p *ssh.PiperConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pipe = p
+	c.logger = c.logger.WithConn(p.DownstreamConnMeta())
+}
+
+// Close closes the pipe if established, otherwise the underlying conn
+func (c *Conn) Close() error {
+	if p := c.Pipe(); p != nil {
+		p.Close()
+		return nil
+	}
+
+	return c.NetConn().Close()
+}
+
+// Info returns info of the connection with current byte counters
+func (c *Conn) Info() ConnInfo {
+	info := ConnInfo{
+		ID:         c.ID,
+		User:       c.User(),
+		RemoteAddr: c.RemoteAddr().String(),
+		Start:      c.start,
+		BytesUp:    atomic.LoadUint64(&c.bytesUp),
+		BytesDown:  atomic.LoadUint64(&c.bytesDown),
+	}
+
+	if p := c.Pipe(); p != nil {
+		if up := p.UpstreamConnMeta(); up != nil {
+			info.UpstreamUser = up.User()
+
+			if addr := up.RemoteAddr(); addr != nil {
+				info.Upstream = addr.String()
+			}
+		}
+	}
+
+	if ctx := c.ChallengeContext(); ctx != nil {
+		info.Challenger = ctx.ChallengerName()
+		info.ChallengedUser = ctx.ChallengedUsername()
+	}
+
+	return info
+}
+
+// checkUser runs Hooks.CheckUser once, the result is kept for the rest callbacks
+func (c *Conn) checkUser(check func(*Conn, string) error, conn ssh.ConnMetadata) error {
+	c.checkUserOnce.Do(func() {
+		c.bind(conn)
+
+		c.mu.Lock()
+		c.user = conn.User()
+		c.mu.Unlock()
+
+		if check != nil {
+			c.checkUserErr = check(c, conn.User())
+		}
+	})
+
+	if c.checkUserErr != nil {
+		c.setFailureReason(FailureRefused)
+	}
+
+	return c.checkUserErr
+}
+
+// bind binds fields of the connection to conn meta, so drivers can log them via logger.WithConn
+func (c *Conn) bind(conn ssh.ConnMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.bound != nil {
+		return
+	}
+
+	c.bound = conn
+	logging.BindConn(conn, logging.Fields{"conn_id": c.ID})
+}
+
+func (c *Conn) unbindLogger() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.bound != nil {
+		logging.UnbindConn(c.bound)
+		c.bound = nil
+	}
+}
+
+// piperConfig creates the ssh.PiperConfig for the connection from config
+func (c *Conn) piperConfig(config *serverConfig) *ssh.PiperConfig {
+	piper := &ssh.PiperConfig{}
+
+	for _, k := range config.HostKeys {
+		piper.AddHostKey(k)
+	}
+
+	if banner := config.Banner; banner != nil {
+		piper.BannerCallback = func(conn ssh.ConnMetadata) string {
+			c.bind(conn)
+			return banner(conn)
+		}
+	}
+
+	if challenge := config.challenge; challenge != nil {
+		piper.AdditionalChallenge = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (ssh.AdditionalChallengeContext, error) {
+			if err := c.checkUser(config.Hooks.CheckUser, conn); err != nil {
+				return nil, err
+			}
+
+			ctx, err := challenge(conn, client)
+			if err != nil {
+				c.setFailureReason(FailureChallenge)
+			}
+
+			return ctx, err
+		}
+	}
+
+	findUpstream := config.findUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+		if err := c.checkUser(config.Hooks.CheckUser, conn); err != nil {
+			return nil, nil, err
+		}
+
+		c.mu.Lock()
+		c.challengeCtx = challengeCtx
+		c.mu.Unlock()
+
+		start := time.Now()
+		upconn, pipe, err := findUpstream(conn, challengeCtx)
+
+		if err != nil {
+			c.setFailureReason(FailureUpstreamNotFound)
+			return upconn, pipe, err
+		}
+
+		c.mu.Lock()
+		c.dial = time.Since(start)
+		c.mu.Unlock()
+
+		// upstream found, handshake with upstream is next
+		c.setFailureReason(FailureUpstream)
+		return upconn, c.watchAuth(pipe), err
+	}
+
+	return piper
+}
+
+// watchAuth returns a copy of pipe with callbacks wrapped to tell the step the pipe failed at
+// FailureAuth is set only after downstream tried password or publickey, a publickey passed
+// through without PublicKeyCallback is not seen, so is a keyboard-interactive
+func (c *Conn) watchAuth(pipe *ssh.AuthPipe) *ssh.AuthPipe {
+	if pipe == nil {
+		return nil
+	}
+
+	p := *pipe
+
+	if hostKey := p.UpstreamHostKeyCallback; hostKey != nil {
+		p.UpstreamHostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := hostKey(hostname, remote, key); err != nil {
+				c.setFailureReason(FailureUpstreamHostKey)
+				return err
+			}
+
+			// downstream may leave before auth
+			c.setFailureReason(FailureOther)
+			return nil
+		}
+	}
+
+	// nil callback passes through, same as returning AuthPipeTypePassThrough
+	password := p.PasswordCallback
+	p.PasswordCallback = func(conn ssh.ConnMetadata, pw []byte) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+		c.setFailureReason(FailureAuth)
+
+		if password == nil {
+			return ssh.AuthPipeTypePassThrough, nil, nil
+		}
+
+		return password(conn, pw)
+	}
+
+	// unlike password, a nil PublicKeyCallback lets queries go to upstream, keep it nil
+	if publicKey := p.PublicKeyCallback; publicKey != nil {
+		p.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			c.setFailureReason(FailureAuth)
+			return publicKey(conn, key)
+		}
+	}
+
+	return &p
+}
+
+// installHooks wraps hooks of the pipe to count bytes, and so that a disconnect
+// message can be sent to downstream when the server is shutting down
+func (c *Conn) installHooks() {
+	p := c.Pipe()
+
+	up := p.HookUpstreamMsg
+	down := p.HookDownstreamMsg
+
+	p.HookDownstreamMsg = func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		atomic.AddUint64(&c.bytesUp, uint64(len(msg)))
+
+		if down != nil {
+			return down(conn, msg)
+		}
+
+		return msg, nil
+	}
+
+	p.HookUpstreamMsg = func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		atomic.AddUint64(&c.bytesDown, uint64(len(msg)))
+
+		c.mu.Lock()
+		disconnect, sent := c.disconnect, c.sent
+		if disconnect != nil {
+			c.sent = true
+		}
+		c.mu.Unlock()
+
+		if sent {
+			return nil, fmt.Errorf("disconnected by sshpiper")
+		}
+
+		if disconnect != nil {
+			return disconnect, nil
+		}
+
+		if up != nil {
+			return up(conn, msg)
+		}
+
+		return msg, nil
+	}
+}
+
+// sendDisconnect replaces next msg from upstream with a disconnect msg
+// the downstream will see the message and close the connection itself
+func (c *Conn) sendDisconnect(message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disconnect != nil {
+		return
+	}
+
+	c.disconnect = ssh.Marshal(disconnectMsg{
+		Reason:  disconnectByApplication,
+		Message: message,
+	})
+}
@@ -1 +1,15 @@
-package sshpiper
+// Package libpiper is the embeddable core of sshpiperd
+//
+// A Server accepts downstream ssh connections, finds upstream by upstream.Provider
+// and pipes them together. sshpiperd is a command line wrapper of it.
+//
+//	srv, err := libpiper.NewServer(libpiper.Options{
+//		HostKeys:       []ssh.Signer{hostKey},
+//		Upstream:       provider,
+//		LoginGraceTime: 30 * time.Second,
+//	})
+//
+//	go srv.Serve(listener)
+//	...
+//	srv.Shutdown(ctx)
+package libpiper
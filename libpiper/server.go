@@ -0,0 +1,445 @@
+package libpiper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/auditor"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("libpiper: server closed")
+
+// time to wait for pipes after disconnect message sent or closed in Shutdown
+const shutdownWaitAfterClose = time.Second
+
+// Hooks are optional callbacks of connection lifecycle
+type Hooks struct {
+	// Accept is called before ssh handshake, returns error to refuse the connection
+	// Conn.SetNetConn can be used here to replace the underlying conn, e.g. after reading PROXY protocol header
+	Accept func(conn *Conn) error
+
+	// CheckUser is called once with the downstream username before challenger and upstream,
+	// returns error to refuse the user
+	CheckUser func(conn *Conn, user string) error
+
+	// HandshakeFailed is called when the pipe failed to establish, see Conn.FailureReason for why
+	HandshakeFailed func(conn *Conn, err error)
+
+	// PipeEstablished is called before piping starts, hooks of Conn.Pipe can be wrapped here
+	PipeEstablished func(conn *Conn)
+
+	// Closed is called after an accepted connection closed, including refused and failed ones
+	Closed func(conn *Conn)
+}
+
+// Options to create a Server, providers must be initialized by caller
+type Options struct {
+	// HostKeys of the piper, at least one is required for ssh handshake
+	HostKeys []ssh.Signer
+
+	// Upstream finds upstream for downstream, required
+	Upstream upstream.Provider
+
+	// Challenger adds additional challenge before finding upstream, optional
+	Challenger challenger.Provider
+
+	// Auditor audits messages of pipes, optional
+	Auditor auditor.Provider
+
+	// Banner returns the banner shown before authentication, optional
+	Banner func(conn ssh.ConnMetadata) string
+
+	// LoginGraceTime disconnects connections which have not established pipes within it, 0 for no limit
+	LoginGraceTime time.Duration
+
+	// DisconnectMessage is sent to downstream when its pipe is closed by Shutdown, empty for no message
+	DisconnectMessage string
+
+	// Logger of the server, nil for no logs
+	Logger logging.Logger
+
+	// Hooks of connection lifecycle
+	Hooks Hooks
+}
+
+// serverConfig is Options with handlers resolved
+type serverConfig struct {
+	Options
+
+	findUpstream upstream.Handler
+	challenge    challenger.Handler
+}
+
+func newServerConfig(opts Options) (*serverConfig, error) {
+	if opts.Upstream == nil {
+		return nil, fmt.Errorf("must provide upstream provider")
+	}
+
+	config := &serverConfig{Options: opts}
+
+	config.findUpstream = opts.Upstream.GetHandler()
+	if config.findUpstream == nil {
+		return nil, fmt.Errorf("upstream provider returns nil handler")
+	}
+
+	if opts.Challenger != nil {
+		config.challenge = opts.Challenger.GetHandler()
+		if config.challenge == nil {
+			return nil, fmt.Errorf("challenger provider returns nil handler")
+		}
+	}
+
+	if config.Logger == nil {
+		config.Logger = logging.Discard()
+	}
+
+	return config, nil
+}
+
+// Server pipes downstream connections to upstream
+type Server struct {
+	mu        sync.RWMutex
+	config    *serverConfig
+	listeners map[net.Listener]struct{}
+	pipes     map[*Conn]struct{}
+
+	// all accepted connections
+	conns sync.WaitGroup
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer creates a Server with opts
+func NewServer(opts Options) (*Server, error) {
+	config, err := newServerConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		config:    config,
+		listeners: make(map[net.Listener]struct{}),
+		pipes:     make(map[*Conn]struct{}),
+		closing:   make(chan struct{}),
+	}, nil
+}
+
+// Update replaces options of the server, new connections use the new options
+// while accepted connections keep using the ones when they were accepted
+func (s *Server) Update(opts Options) error {
+	config, err := newServerConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config = config
+
+	return nil
+}
+
+// Options returns current options of the server
+func (s *Server) Options() Options {
+	return s.currentConfig().Options
+}
+
+func (s *Server) currentConfig() *serverConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.config
+}
+
+func (s *Server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Serve accepts connections on l until Shutdown, l is closed when Serve returns
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.currentConfig().Logger.Errorf("failed to accept connection: %v", err)
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		// Add must not race with Wait in Shutdown
+		s.mu.Lock()
+		if s.isClosing() {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns.Add(1)
+		s.mu.Unlock()
+
+		config := s.currentConfig()
+		conn := newConn(uuid.New().String(), c, config.Logger)
+
+		conn.logger.With(logging.Fields{"event": "conn_accepted"}).Infof("connection accepted: %v", c.RemoteAddr())
+
+		go s.handle(conn, config)
+	}
+}
+
+// Shutdown stops accepting new connections and waits for pipes to finish until ctx is done,
+// then sends DisconnectMessage to and closes the remaining pipes
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		close(s.closing)
+
+		for l := range s.listeners {
+			l.Close()
+		}
+	})
+
+	if s.wait(ctx.Done(), 0) {
+		return nil
+	}
+
+	config := s.currentConfig()
+	config.Logger.Warnf("shutdown timeout, closing %v active pipes", s.ActivePipes())
+
+	if config.DisconnectMessage != "" {
+		// message is delivered with next packet to downstream
+		for _, c := range s.Conns() {
+			c.sendDisconnect(config.DisconnectMessage)
+		}
+
+		if s.wait(nil, shutdownWaitAfterClose) {
+			return ctx.Err()
+		}
+	}
+
+	for _, c := range s.Conns() {
+		c.Close()
+	}
+
+	s.wait(nil, shutdownWaitAfterClose)
+
+	return ctx.Err()
+}
+
+// wait blocks until all connections are closed, or done/timeout happens
+// returns false if there are still connections alive
+func (s *Server) wait(done <-chan struct{}, timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(finished)
+	}()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case <-finished:
+		return true
+	case <-done:
+	case <-timer:
+	}
+
+	return false
+}
+
+// ActivePipes returns the number of established pipes
+func (s *Server) ActivePipes() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.pipes)
+}
+
+// Conns returns connections with established pipes, sorted by start time
+func (s *Server) Conns() []*Conn {
+	s.mu.RLock()
+	conns := make([]*Conn, 0, len(s.pipes))
+	for c := range s.pipes {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].start.Before(conns[j].start)
+	})
+
+	return conns
+}
+
+// Conn returns the connection with established pipe by id, nil if not found
+func (s *Server) Conn(id string) *Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for c := range s.pipes {
+		if c.ID == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) handle(c *Conn, config *serverConfig) {
+	defer s.conns.Done()
+
+	hooks := config.Hooks
+
+	defer func() {
+		c.unbindLogger()
+		c.NetConn().Close()
+
+		if hooks.Closed != nil {
+			hooks.Closed(c)
+		}
+	}()
+
+	if hooks.Accept != nil {
+		if err := hooks.Accept(c); err != nil {
+			c.setFailureReason(FailureRefused)
+			c.Logger().Debugf("connection from %v refused: %v", c.RemoteAddr(), err)
+			return
+		}
+	}
+
+	failed := func(err error) {
+		c.Logger().With(logging.Fields{"event": "handshake_failed", "reason": c.FailureReason()}).Errorf("connection from %v establishing failed reason: %v", c.RemoteAddr(), err)
+
+		if hooks.HandshakeFailed != nil {
+			hooks.HandshakeFailed(c, err)
+		}
+	}
+
+	pipec := make(chan *ssh.PiperConn, 1)
+	errorc := make(chan error, 1)
+
+	go func() {
+		p, err := ssh.NewSSHPiperConn(c.NetConn(), c.piperConfig(config))
+
+		if err != nil {
+			errorc <- err
+			return
+		}
+
+		pipec <- p
+	}()
+
+	var timeout <-chan time.Time
+	if config.LoginGraceTime > 0 {
+		timer := time.NewTimer(config.LoginGraceTime)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var p *ssh.PiperConn
+
+	select {
+	case p = <-pipec:
+	case err := <-errorc:
+		failed(err)
+		return
+	case <-timeout:
+		c.setFailureReason(FailureTimeout)
+		failed(fmt.Errorf("pipe establishing timeout after %v", config.LoginGraceTime))
+
+		// the handshake goroutine quits after conn closed
+		c.NetConn().Close()
+		go func() {
+			select {
+			case p := <-pipec:
+				p.Close()
+			case <-errorc:
+			}
+		}()
+		return
+	}
+
+	defer p.Close()
+
+	if config.Auditor != nil {
+		a, err := config.Auditor.Create(p.DownstreamConnMeta())
+		if err != nil {
+			c.setFailureReason(FailureAuditor)
+			failed(fmt.Errorf("failed to create auditor: %v", err))
+			return
+		}
+		defer a.Close()
+
+		p.HookUpstreamMsg = a.GetUpstreamHook()
+		p.HookDownstreamMsg = a.GetDownstreamHook()
+	}
+
+	c.setPipe(p)
+
+	if hooks.PipeEstablished != nil {
+		hooks.PipeEstablished(c)
+	}
+
+	c.installHooks()
+
+	s.mu.Lock()
+	s.pipes[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pipes, c)
+		s.mu.Unlock()
+	}()
+
+	c.Logger().With(logging.Fields{"event": "pipe_established"}).Infof("pipe established for connection from %v", c.RemoteAddr())
+
+	err := p.Wait()
+	c.Logger().With(logging.Fields{"event": "pipe_closed", "reason": err}).Infof("connection from %v closed reason: %v", c.RemoteAddr(), err)
+}
@@ -0,0 +1,523 @@
+package libpiper
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type testprovider struct {
+	h upstream.Handler
+}
+
+func (p *testprovider) GetName() string {
+	return "test"
+}
+
+func (p *testprovider) GetOpts() interface{} {
+	return nil
+}
+
+func (p *testprovider) Init(logger logging.Logger) error {
+	return nil
+}
+
+func (p *testprovider) ListPipe() ([]upstream.Pipe, error) {
+	return nil, nil
+}
+
+func (p *testprovider) CreatePipe(opt upstream.CreatePipeOption) error {
+	return nil
+}
+
+func (p *testprovider) RemovePipe(name string) error {
+	return nil
+}
+
+func (p *testprovider) GetHandler() upstream.Handler {
+	return p.h
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// startUpstream starts an sshd accepting user bob with password secret, exec echoes stdin
+func startUpstream(t *testing.T) net.Listener {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "bob" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %v", conn.User())
+		},
+	}
+	config.AddHostKey(newSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newChannel := range chans {
+					ch, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "exec", nil)
+
+							if req.Type == "exec" {
+								io.Copy(ch, ch)
+								ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+								ch.Close()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestNewServer(t *testing.T) {
+	if _, err := NewServer(Options{}); err == nil {
+		t.Errorf("should fail without upstream")
+	}
+
+	if _, err := NewServer(Options{Upstream: &testprovider{}}); err == nil {
+		t.Errorf("should fail with nil upstream handler")
+	}
+
+	s, err := NewServer(Options{Upstream: &testprovider{h: func(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+		return nil, nil, nil
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Update(Options{}); err == nil {
+		t.Errorf("update should fail without upstream")
+	}
+
+	if s.Options().Upstream == nil {
+		t.Errorf("should keep options when update failed")
+	}
+}
+
+func TestServerPipe(t *testing.T) {
+	up := startUpstream(t)
+	defer up.Close()
+
+	var (
+		mu       sync.Mutex
+		accepted int
+		checked  []string
+		failures []string
+		piped    int
+		closed   int
+	)
+
+	srv, err := NewServer(Options{
+		HostKeys: []ssh.Signer{newSigner(t)},
+		Upstream: &testprovider{h: func(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+			if conn.User() != "alice" {
+				return nil, nil, fmt.Errorf("no upstream for %v", conn.User())
+			}
+
+			c, err := net.Dial("tcp", up.Addr().String())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return c, &ssh.AuthPipe{
+				User:                    "bob",
+				UpstreamHostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}, nil
+		}},
+		LoginGraceTime:    5 * time.Second,
+		DisconnectMessage: "bye",
+		Hooks: Hooks{
+			Accept: func(conn *Conn) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				accepted++
+				return nil
+			},
+			CheckUser: func(conn *Conn, user string) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				checked = append(checked, user)
+				if user == "mallory" {
+					return fmt.Errorf("%v is not welcome", user)
+				}
+				return nil
+			},
+			HandshakeFailed: func(conn *Conn, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				failures = append(failures, conn.FailureReason())
+			},
+			PipeEstablished: func(conn *Conn) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				piped++
+			},
+			Closed: func(conn *Conn) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				closed++
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	dial := func(user string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	for _, user := range []string{"eve", "mallory"} {
+		if _, err := dial(user); err == nil {
+			t.Errorf("%v should fail", user)
+		}
+	}
+
+	client, err := dial("alice")
+	if err != nil {
+		t.Fatalf("dial failed %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+
+	if err := session.Start("echo"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintln(stdin, "ping")
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo %q %v", line, err)
+	}
+
+	conns := srv.Conns()
+	if len(conns) != 1 || srv.ActivePipes() != 1 {
+		t.Fatalf("should have 1 pipe, got %v", len(conns))
+	}
+
+	info := conns[0].Info()
+	if info.User != "alice" || info.UpstreamUser != "bob" || info.Upstream != up.Addr().String() || info.BytesUp == 0 || info.BytesDown == 0 {
+		t.Errorf("unexpected info %v", info)
+	}
+
+	if srv.Conn(info.ID) != conns[0] || srv.Conn("unknown") != nil {
+		t.Errorf("conn not found by id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown should time out with active pipe, got %v", err)
+	}
+
+	if err := session.Wait(); err == nil {
+		t.Errorf("session should be closed by shutdown")
+	}
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("serve should return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve should return after shutdown")
+	}
+
+	if err := srv.Serve(l); err != ErrServerClosed {
+		t.Errorf("serve after shutdown should return ErrServerClosed, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if accepted != 3 || closed != 3 || piped != 1 {
+		t.Errorf("unexpected hook calls accepted %v closed %v piped %v", accepted, closed, piped)
+	}
+
+	if len(checked) != 3 {
+		t.Errorf("check user should be called once per conn, got %v", checked)
+	}
+
+	if len(failures) != 2 || failures[0] != FailureUpstreamNotFound || failures[1] != FailureRefused {
+		t.Errorf("unexpected failures %v", failures)
+	}
+}
+
+func TestServerHandshakeFailureReason(t *testing.T) {
+	up := startUpstream(t)
+	defer up.Close()
+
+	// accepts and closes at once
+	refusing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refusing.Close()
+
+	go func() {
+		for {
+			c, err := refusing.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	failures := make(chan string, 1)
+
+	srv, err := NewServer(Options{
+		HostKeys: []ssh.Signer{newSigner(t)},
+		Upstream: &testprovider{h: func(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+			addr := up.Addr().String()
+			hostKey := ssh.InsecureIgnoreHostKey()
+
+			switch conn.User() {
+			case "refused":
+				addr = refusing.Addr().String()
+			case "mismatch":
+				hostKey = ssh.FixedHostKey(newSigner(t).PublicKey())
+			}
+
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return c, &ssh.AuthPipe{
+				User:                    "bob",
+				UpstreamHostKeyCallback: hostKey,
+			}, nil
+		}},
+		LoginGraceTime: 5 * time.Second,
+		Hooks: Hooks{
+			HandshakeFailed: func(conn *Conn, err error) {
+				failures <- conn.FailureReason()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+
+	for _, c := range []struct {
+		user     string
+		password string
+		reason   string
+	}{
+		{"refused", "secret", FailureUpstream},
+		{"mismatch", "secret", FailureUpstreamHostKey},
+		{"alice", "wrong", FailureAuth},
+	} {
+		_, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            c.user,
+			Auth:            []ssh.AuthMethod{ssh.Password(c.password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			t.Errorf("%v should fail", c.user)
+			continue
+		}
+
+		select {
+		case reason := <-failures:
+			if reason != c.reason {
+				t.Errorf("%v should fail with %v, got %v", c.user, c.reason, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v handshake failed hook not called", c.user)
+		}
+	}
+}
+
+func TestServerLoginGraceTime(t *testing.T) {
+	var failure string
+	failed := make(chan struct{})
+
+	goroutines := runtime.NumGoroutine()
+
+	srv, err := NewServer(Options{
+		HostKeys: []ssh.Signer{newSigner(t)},
+		Upstream: &testprovider{h: func(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+			return nil, nil, fmt.Errorf("should not be called")
+		}},
+		LoginGraceTime: 100 * time.Millisecond,
+		Hooks: Hooks{
+			HandshakeFailed: func(conn *Conn, err error) {
+				failure = conn.FailureReason()
+				close(failed)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handshake should time out")
+	}
+
+	if failure != FailureTimeout {
+		t.Errorf("unexpected failure %v", failure)
+	}
+
+	// handshake fails after timeout, nothing should be left waiting for it
+	c.Close()
+	srv.Shutdown(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked, %v before, %v after", goroutines, runtime.NumGoroutine())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnDisconnect(t *testing.T) {
+	p := &ssh.PiperConn{}
+
+	called := false
+	p.HookUpstreamMsg = func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		called = true
+		return msg, nil
+	}
+
+	c := &Conn{pipe: p}
+	c.installHooks()
+
+	msg, err := p.HookUpstreamMsg(nil, []byte{42})
+	if err != nil || len(msg) != 1 || msg[0] != 42 || !called {
+		t.Errorf("original hook should be called")
+	}
+
+	c.sendDisconnect("bye")
+
+	msg, err = p.HookUpstreamMsg(nil, []byte{42})
+	if err != nil {
+		t.Fatalf("disconnect msg should be sent %v", err)
+	}
+
+	var d disconnectMsg
+	if err := ssh.Unmarshal(msg, &d); err != nil {
+		t.Fatalf("bad disconnect msg %v", err)
+	}
+
+	if d.Message != "bye" || d.Reason != disconnectByApplication {
+		t.Errorf("unexpected disconnect msg %v", d)
+	}
+
+	if _, err := p.HookUpstreamMsg(nil, []byte{42}); err == nil {
+		t.Errorf("pipe should be closed after disconnect msg")
+	}
+
+	if c.bytesDown != 3 {
+		t.Errorf("bytes down not counted, got %v", c.bytesDown)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tg123/sshpiper/libpiper"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+)
+
+const adminUnixPrefix = "unix:"
+
+// adminNetwork converts admin listen option to network and address
+// unix:/path/to.sock or a path containing / is a unix socket, otherwise tcp host:port
+func adminNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, adminUnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, adminUnixPrefix)
+	}
+
+	if strings.Contains(addr, "/") {
+		return "unix", addr
+	}
+
+	return "tcp", addr
+}
+
+// adminListen listens on addr, stale unix socket file is removed
+// admin api has no authentication, tcp addr must be loopback and unix socket is only accessible by its owner
+func adminListen(addr string) (net.Listener, error) {
+	network, address := adminNetwork(addr)
+
+	if network == "tcp" {
+		if err := checkLoopback(address); err != nil {
+			return nil, err
+		}
+
+		return net.Listen(network, address)
+	}
+
+	if _, err := net.Dial(network, address); err == nil {
+		return nil, fmt.Errorf("admin socket %v is in use", address)
+	}
+
+	os.Remove(address)
+
+	return listenPrivateUnix(address)
+}
+
+// checkLoopback returns error if host of address is not a loopback ip or localhost
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("admin api has no authentication, listen on a loopback address or unix socket instead of %v", address)
+}
+
+// adminHandler serves admin api of piperd
+func (d *piperd) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, d.bans.list())
+		case http.MethodDelete:
+			key := r.URL.Query().Get("key")
+			if key == "" {
+				http.Error(w, "missing key", http.StatusBadRequest)
+				return
+			}
+
+			if !d.bans.unban(key) {
+				http.Error(w, fmt.Sprintf("%v is not banned", key), http.StatusNotFound)
+				return
+			}
+
+			d.logger.With(logging.Fields{"event": "unbanned", "key": key}).Infof("%v unbanned by admin", key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		cache := d.instance().cache
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, cacheStats{cache.Enabled(), cache.Len()})
+		case http.MethodDelete:
+			user := r.URL.Query().Get("user")
+
+			if user == "" {
+				cache.Purge()
+				d.logger.With(logging.Fields{"event": "cache_purged"}).Infof("upstream cache purged by admin")
+			} else {
+				cache.Invalidate(user)
+				d.logger.With(logging.Fields{"event": "cache_purged", "user": user}).Infof("upstream cache of [%v] purged by admin", user)
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		conns := d.srv.Conns()
+		infos := make([]libpiper.ConnInfo, 0, len(conns))
+
+		for _, c := range conns {
+			infos = append(infos, c.Info())
+		}
+
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+
+		c := d.srv.Conn(id)
+		if c == nil {
+			http.Error(w, fmt.Sprintf("session %v not found", id), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, c.Info())
+		case http.MethodDelete:
+			c.Close()
+
+			c.Logger().With(logging.Fields{"event": "session_killed"}).Infof("session %v of [%v] from %v killed by admin", id, c.User(), c.RemoteAddr())
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	return mux
+}
+
+// cacheStats is returned by GET /cache
+type cacheStats struct {
+	Enabled bool `json:"enabled"`
+	Size    int  `json:"size"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveAdmin serves admin api on the listener
+func (d *piperd) serveAdmin(l net.Listener) {
+	d.logger.Printf("serving admin api on %v", l.Addr())
+
+	err := http.Serve(l, d.adminHandler())
+	d.logger.Printf("admin listener closed reason: %v", err)
+}
+
+// adminClient calls admin api of a running sshpiperd
+type adminClient struct {
+	client *http.Client
+	base   string
+}
+
+func newAdminClient(addr string) (*adminClient, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("admin listen address of sshpiperd is not set")
+	}
+
+	network, address := adminNetwork(addr)
+
+	if network == "tcp" {
+		return &adminClient{
+			client: http.DefaultClient,
+			base:   "http://" + address,
+		}, nil
+	}
+
+	return &adminClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, address)
+				},
+			},
+		},
+		base: "http://sshpiperd",
+	}, nil
+}
+
+// call sends in as json body if not nil and decodes response to out if not nil
+func (c *adminClient) call(method, path string, query url.Values, in, out interface{}) error {
+	var body bytes.Buffer
+
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("admin api error: %v", strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/libpiper"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+func TestAdminNetwork(t *testing.T) {
+	for in, expected := range map[string][2]string{
+		"unix:/run/sshpiperd.sock": {"unix", "/run/sshpiperd.sock"},
+		"/run/sshpiperd.sock":      {"unix", "/run/sshpiperd.sock"},
+		"127.0.0.1:9091":           {"tcp", "127.0.0.1:9091"},
+	} {
+		network, address := adminNetwork(in)
+		if network != expected[0] || address != expected[1] {
+			t.Errorf("parse %v expect %v got %v %v", in, expected, network, address)
+		}
+	}
+}
+
+func TestAdminListenLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		l, err := adminListen(addr)
+		if err != nil {
+			t.Errorf("should listen on %v %v", addr, err)
+			continue
+		}
+		l.Close()
+	}
+
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "10.0.0.1:0", "example.com:0"} {
+		if l, err := adminListen(addr); err == nil {
+			l.Close()
+			t.Errorf("should refuse non loopback %v", addr)
+		}
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperd_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := "unix:" + path.Join(dir, "admin.sock")
+
+	l, err := adminListen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := adminListen(addr); err == nil {
+		t.Errorf("should fail when socket is in use")
+	}
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path.Join(dir, "admin.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm()&0077 != 0 {
+			t.Errorf("admin socket should only be accessible by owner, got %v", fi.Mode())
+		}
+	}
+
+	d := &piperd{
+		logger: logging.Discard(),
+		bans:   newBanList(),
+	}
+	d.bans.fail(net.ParseIP("10.0.0.1"), "", banPolicy{threshold: 1, window: time.Minute, duration: time.Hour})
+
+	go d.serveAdmin(l)
+
+	c, err := newAdminClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []banEntry
+	if err := c.call(http.MethodGet, "/bans", nil, nil, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "ip:10.0.0.1" {
+		t.Errorf("unexpected bans %v", entries)
+	}
+
+	if err := c.call(http.MethodDelete, "/bans", url.Values{"key": {"ip:10.0.0.1"}}, nil, nil); err != nil {
+		t.Errorf("unban failed %v", err)
+	}
+
+	if err := c.call(http.MethodDelete, "/bans", url.Values{"key": {"ip:10.0.0.1"}}, nil, nil); err == nil {
+		t.Errorf("unban twice should fail")
+	}
+
+	if len(d.bans.list()) != 0 {
+		t.Errorf("ban list should be empty")
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperd_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := "unix:" + path.Join(dir, "admin.sock")
+
+	l, err := adminListen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	up := startTestUpstream(t)
+	defer up.Close()
+
+	d := startTestPiperd(t, &piperdConfig{}, up)
+	defer d.shutdown()
+
+	client, err := dialTestPiperd(d, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	go d.serveAdmin(l)
+
+	c, err := newAdminClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []libpiper.ConnInfo
+	if err := c.call(http.MethodGet, "/sessions", nil, nil, &sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].ID == "" {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+
+	id := sessions[0].ID
+
+	var s libpiper.ConnInfo
+	if err := c.call(http.MethodGet, "/sessions/"+id, nil, nil, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.User != "alice" || s.UpstreamUser != "bob" || s.Upstream != up.Addr().String() {
+		t.Errorf("unexpected session %v", s)
+	}
+
+	if err := c.call(http.MethodGet, "/sessions/43", nil, nil, &s); err == nil {
+		t.Errorf("should fail with unknown session")
+	}
+
+	if err := c.call(http.MethodDelete, "/sessions/43", nil, nil, nil); err == nil {
+		t.Errorf("should fail to kill unknown session")
+	}
+
+	if err := c.call(http.MethodDelete, "/sessions/"+id, nil, nil, nil); err != nil {
+		t.Errorf("kill session failed %v", err)
+	}
+
+	if err := client.Wait(); err == nil {
+		t.Errorf("client should be disconnected")
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperd_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := "unix:" + path.Join(dir, "admin.sock")
+
+	l, err := adminListen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cache := upstream.NewCache(upstream.CacheOptions{TTL: time.Hour})
+	for _, user := range []string{"alice", "bob", "carol"} {
+		cache.Get(user, "", func() (interface{}, error) { return user, nil })
+	}
+
+	d := &piperd{
+		logger:  logging.Discard(),
+		current: &piperInstance{cache: cache},
+	}
+
+	go d.serveAdmin(l)
+
+	c, err := newAdminClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats cacheStats
+	if err := c.call(http.MethodGet, "/cache", nil, nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if !stats.Enabled || stats.Size != 3 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	if err := c.call(http.MethodDelete, "/cache", url.Values{"user": {"alice"}}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("alice should be purged")
+	}
+
+	if err := c.call(http.MethodDelete, "/cache", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Len() != 0 {
+		t.Errorf("cache should be empty")
+	}
+}
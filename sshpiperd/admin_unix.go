@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivateUnix creates the socket file under a restrictive umask, so it is never accessible by others
+func listenPrivateUnix(address string) (net.Listener, error) {
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"net"
+)
+
+// listenPrivateUnix listens on unix socket, file permissions are not supported on windows
+func listenPrivateUnix(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
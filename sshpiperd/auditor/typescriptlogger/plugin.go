@@ -1,13 +1,13 @@
 package typescriptlogger
 
 import (
-	"log"
 	"os"
 	"path"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/tg123/sshpiper/sshpiperd/auditor"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type plugin struct {
@@ -34,7 +34,7 @@ func (p *plugin) Create(conn ssh.ConnMetadata) (auditor.Auditor, error) {
 	return newFilePtyLogger(dir)
 }
 
-func (p *plugin) Init(logger *log.Logger) error {
+func (p *plugin) Init(logger logging.Logger) error {
 
 	return nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefixes of ban list keys
+const (
+	banKeyIPPrefix   = "ip:"
+	banKeyUserPrefix = "user:"
+)
+
+// interval to drop expired failures and bans
+const banListSweepInterval = time.Minute
+
+func banKeyIP(ip string) string {
+	return banKeyIPPrefix + ip
+}
+
+func banKeyUser(user string) string {
+	return banKeyUserPrefix + user
+}
+
+// parseBanKey accepts ip:1.2.3.4, user:name, or a bare ip or username
+func parseBanKey(s string) string {
+	if strings.HasPrefix(s, banKeyIPPrefix) || strings.HasPrefix(s, banKeyUserPrefix) {
+		return s
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		return banKeyIP(ip.String())
+	}
+
+	return banKeyUser(s)
+}
+
+// banPolicy controls when a source ip or username is banned, threshold 0 means disabled
+type banPolicy struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	allowlist []*net.IPNet
+}
+
+func (p banPolicy) enabled() bool {
+	return p.threshold > 0
+}
+
+// banEntry is a banned source ip or username
+type banEntry struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+// banList counts auth failures per source ip and username in a sliding window
+// and bans them for a while after too many failures
+// it lives across config reloads, policy is passed in on each call
+type banList struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	banned    map[string]time.Time
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string][]time.Time),
+		banned:   make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// isBanned returns whether key is banned and when the ban ends
+func (b *banList) isBanned(key string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.banned[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if !b.now().Before(until) {
+		delete(b.banned, key)
+		return time.Time{}, false
+	}
+
+	return until, true
+}
+
+// fail records an auth failure from ip with user, returns keys banned by this failure
+func (b *banList) fail(ip net.IP, user string, policy banPolicy) []string {
+	if !policy.enabled() {
+		return nil
+	}
+
+	for _, n := range policy.allowlist {
+		if ip != nil && n.Contains(ip) {
+			return nil
+		}
+	}
+
+	var keys []string
+
+	if ip != nil {
+		keys = append(keys, banKeyIP(ip.String()))
+	}
+
+	if user != "" {
+		keys = append(keys, banKeyUser(user))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.sweep(now, policy)
+
+	var newlyBanned []string
+
+	for _, key := range keys {
+		failures := append(recentFailures(b.failures[key], now, policy.window), now)
+
+		if len(failures) >= policy.threshold {
+			delete(b.failures, key)
+			b.banned[key] = now.Add(policy.duration)
+			newlyBanned = append(newlyBanned, key)
+			continue
+		}
+
+		b.failures[key] = failures
+	}
+
+	return newlyBanned
+}
+
+func recentFailures(failures []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) > window {
+		i++
+	}
+
+	return failures[i:]
+}
+
+func (b *banList) sweep(now time.Time, policy banPolicy) {
+	if now.Sub(b.lastSweep) < banListSweepInterval {
+		return
+	}
+
+	b.lastSweep = now
+
+	for key, failures := range b.failures {
+		if len(recentFailures(failures, now, policy.window)) == 0 {
+			delete(b.failures, key)
+		}
+	}
+
+	for key, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, key)
+		}
+	}
+}
+
+// list returns active bans sorted by key
+func (b *banList) list() []banEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	entries := make([]banEntry, 0, len(b.banned))
+
+	for key, until := range b.banned {
+		if now.Before(until) {
+			entries = append(entries, banEntry{Key: key, Until: until})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// unban removes the ban and failures of key, returns false if key was not banned
+func (b *banList) unban(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.failures, key)
+
+	until, ok := b.banned[key]
+	delete(b.banned, key)
+
+	return ok && b.now().Before(until)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBanKey(t *testing.T) {
+	for in, expected := range map[string]string{
+		"10.0.0.1":      "ip:10.0.0.1",
+		"::1":           "ip:::1",
+		"alice":         "user:alice",
+		"user:10.0.0.1": "user:10.0.0.1",
+		"ip:10.0.0.2":   "ip:10.0.0.2",
+	} {
+		if key := parseBanKey(in); key != expected {
+			t.Errorf("parse %v expect %v got %v", in, expected, key)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	b := newBanList()
+	b.now = func() time.Time { return now }
+
+	_, allowed, _ := net.ParseCIDR("192.168.0.0/16")
+
+	policy := banPolicy{
+		threshold: 3,
+		window:    time.Minute,
+		duration:  time.Hour,
+		allowlist: []*net.IPNet{allowed},
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+
+	// disabled
+	for i := 0; i < 10; i++ {
+		if banned := b.fail(ip, "alice", banPolicy{}); len(banned) > 0 {
+			t.Fatalf("should not ban when disabled")
+		}
+	}
+
+	// failures out of window are forgotten
+	b.fail(ip, "alice", policy)
+	b.fail(ip, "alice", policy)
+	now = now.Add(2 * time.Minute)
+
+	if banned := b.fail(ip, "alice", policy); len(banned) > 0 {
+		t.Errorf("should not ban with failures out of window, got %v", banned)
+	}
+
+	b.fail(ip, "bob", policy)
+	banned := b.fail(ip, "bob", policy)
+
+	if len(banned) != 1 || banned[0] != "ip:10.0.0.1" {
+		t.Errorf("expect ip banned got %v", banned)
+	}
+
+	if _, ok := b.isBanned("ip:10.0.0.1"); !ok {
+		t.Errorf("ip should be banned")
+	}
+
+	if _, ok := b.isBanned("user:bob"); ok {
+		t.Errorf("user should not be banned yet")
+	}
+
+	// allowlist
+	for i := 0; i < 10; i++ {
+		if banned := b.fail(net.ParseIP("192.168.1.1"), "carol", policy); len(banned) > 0 {
+			t.Fatalf("allowlisted ip should not be banned")
+		}
+	}
+
+	entries := b.list()
+	if len(entries) != 1 || entries[0].Key != "ip:10.0.0.1" || !entries[0].Until.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected ban list %v", entries)
+	}
+
+	if !b.unban("ip:10.0.0.1") {
+		t.Errorf("unban should succeed")
+	}
+
+	if b.unban("ip:10.0.0.1") {
+		t.Errorf("unban twice should fail")
+	}
+
+	// expired
+	b.fail(nil, "dave", policy)
+	b.fail(nil, "dave", policy)
+	b.fail(nil, "dave", policy)
+
+	if _, ok := b.isBanned("user:dave"); !ok {
+		t.Errorf("user should be banned")
+	}
+
+	now = now.Add(time.Hour)
+
+	if _, ok := b.isBanned("user:dave"); ok {
+		t.Errorf("ban should expire")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func createBanMgr(load func() (*adminClient, error)) interface{} {
+	// ban list management
+	banMgrCmd := struct {
+		List struct {
+			subCommand
+		} `command:"list" description:"list banned source ips and usernames"`
+		Unban struct {
+			subCommand
+		} `command:"unban" description:"unban entries, e.g. sshpiperd ban unban 10.0.0.1 user:alice"`
+	}{}
+
+	banMgrCmd.List.callback = func(args []string) error {
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		var entries []banEntry
+		if err := c.call(http.MethodGet, "/bans", nil, nil, &entries); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tUNTIL")
+
+		for _, e := range entries {
+			fmt.Fprintf(w, "%v\t%v\n", e.Key, e.Until.Local().Format(time.RFC3339))
+		}
+
+		return w.Flush()
+	}
+
+	banMgrCmd.Unban.callback = func(args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("no entry to unban")
+		}
+
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range args {
+			key := parseBanKey(arg)
+
+			if err := c.call(http.MethodDelete, "/bans", url.Values{"key": {key}}, nil, nil); err != nil {
+				return err
+			}
+
+			fmt.Printf("%v unbanned\n", key)
+		}
+
+		return nil
+	}
+
+	return &banMgrCmd
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+func createCacheMgr(load func() (*adminClient, error)) interface{} {
+	// upstream cache management
+	cacheMgrCmd := struct {
+		Stats struct {
+			subCommand
+		} `command:"stats" description:"show size of upstream lookup cache"`
+		Purge struct {
+			subCommand
+		} `command:"purge" description:"purge cached lookups of given users or all if none given, e.g. sshpiperd cache purge alice"`
+	}{}
+
+	cacheMgrCmd.Stats.callback = func(args []string) error {
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		var stats cacheStats
+		if err := c.call(http.MethodGet, "/cache", nil, nil, &stats); err != nil {
+			return err
+		}
+
+		fmt.Printf("enabled: %v\nsize: %v\n", stats.Enabled, stats.Size)
+
+		return nil
+	}
+
+	cacheMgrCmd.Purge.callback = func(args []string) error {
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			if err := c.call(http.MethodDelete, "/cache", nil, nil, nil); err != nil {
+				return err
+			}
+
+			fmt.Println("cache purged")
+			return nil
+		}
+
+		for _, user := range args {
+			if err := c.call(http.MethodDelete, "/cache", url.Values{"user": {user}}, nil, nil); err != nil {
+				return err
+			}
+
+			fmt.Printf("cache of %v purged\n", user)
+		}
+
+		return nil
+	}
+
+	return &cacheMgrCmd
+}
@@ -2,13 +2,14 @@ package authy
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/dcu/go-authy"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type authyClient struct {
@@ -19,10 +20,10 @@ type authyClient struct {
 	}
 
 	authyAPI *authy.Authy
-	logger   *log.Logger
+	logger   logging.Logger
 }
 
-func (a *authyClient) Init(logger *log.Logger) error {
+func (a *authyClient) Init(logger logging.Logger) error {
 	a.logger = logger
 	a.authyAPI = authy.NewAuthyAPI(a.Config.APIKey)
 
@@ -2,7 +2,6 @@ package azdevicecode
 
 import (
 	"context"
-	"log"
 	"net/http"
 
 	"golang.org/x/crypto/ssh"
@@ -11,6 +10,8 @@ import (
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type authClient struct {
@@ -22,11 +23,11 @@ type authClient struct {
 		NoReadGraph bool   `long:"challenger-azdevicecode-noreadgraph" description:"Disable query user info from user graph" env:"SSHPIPERD_CHALLENGER_AZDEVICECODE_NOREADGRAPH" ini-name:"challenger-azdevicecode-noreadgraph"`
 	}
 
-	logger      *log.Logger
+	logger      logging.Logger
 	oauthConfig adal.OAuthConfig
 }
 
-func (c *authClient) Init(logger *log.Logger) error {
+func (c *authClient) Init(logger logging.Logger) error {
 	c.logger = logger
 
 	env, err := azure.EnvironmentFromName(c.Config.Env)
@@ -1,12 +1,12 @@
 package challenger
 
 import (
-	"log"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type plugin struct {
 	name       string
-	init       func(logger *log.Logger) error
+	init       func(logger logging.Logger) error
 	opts       interface{}
 	gethandler func() Handler
 }
@@ -23,7 +23,7 @@ func (p *plugin) GetHandler() Handler {
 	return p.gethandler()
 }
 
-func (p *plugin) Init(logger *log.Logger) error {
+func (p *plugin) Init(logger logging.Logger) error {
 	logger.Printf("challenger: %v init", p.name)
 
 	if p.init != nil {
@@ -33,7 +33,7 @@ func (p *plugin) Init(logger *log.Logger) error {
 }
 
 // NewFromHandler creates a Challenger with given functions
-func NewFromHandler(name string, gethandler func() Handler, opts interface{}, init func(glogger *log.Logger) error) Provider {
+func NewFromHandler(name string, gethandler func() Handler, opts interface{}, init func(glogger logging.Logger) error) Provider {
 	return &plugin{
 		name:       name,
 		init:       init,
@@ -2,8 +2,8 @@ package pome
 
 import (
 	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
-	"log"
 )
 
 type plugin struct {
@@ -18,7 +18,7 @@ func (plugin) GetOpts() interface{} {
 	return nil
 }
 
-func (p *plugin) Init(logger *log.Logger) error {
+func (p *plugin) Init(logger logging.Logger) error {
 	p.logger = logger
 	return nil
 }
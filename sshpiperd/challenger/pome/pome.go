@@ -1,7 +1,7 @@
 package pome
 
 import (
-	"log"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type pipe struct {
@@ -29,7 +29,7 @@ func (p pipe) ChallengedUsername() string {
 }
 
 type pome struct {
-	logger *log.Logger
+	logger logging.Logger
 
 	Config struct {
 		LoginBaseURL string `long:"challenger-pome-loginurl" description:"Send this url/{id} to user for login" env:"SSHPIPERD_CHALLENGER_POME_LOGINURL" ini-name:"challenger-pome-loginurl"`
@@ -2,15 +2,16 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/tg123/sshkey"
 
 	"github.com/tg123/sshpiper/sshpiperd/auditor"
 	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/plugin"
 	"github.com/tg123/sshpiper/sshpiperd/registry"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 )
@@ -39,12 +40,13 @@ func addOpt(group *flags.Group, name string, data interface{}) {
 	}
 }
 
-func addPlugins(group *flags.Group, name string, pluginNames []string, getter func(n string) registry.Plugin) {
+// addPlugins adds option groups of plugins, opts returns the struct to parse into
+func addPlugins(group *flags.Group, name string, pluginNames []string, getter func(n string) registry.Plugin, opts func(p registry.Plugin) interface{}) {
 	for _, n := range pluginNames {
 
 		p := getter(n)
 
-		opt := p.GetOpts()
+		opt := opts(p)
 
 		if opt == nil {
 			continue
@@ -77,23 +79,85 @@ func populateFromConfig(ini *flags.IniParser, data interface{}, longopt string)
 	return nil
 }
 
+type configFileOpts struct {
+	ConfigFile flags.Filename `long:"config" description:"Config file path. Will be overwritten by arg options and environment variables" default:"/etc/sshpiperd.ini" env:"SSHPIPERD_CONFIG_FILE" no-ini:"true"`
+	Plugins    []string       `long:"plugin" description:"External plugin binary registered as a driver, kind.name=path e.g. upstream.mydriver=/usr/lib/sshpiperd/mydriver, can be repeated or comma separated" env:"SSHPIPERD_PLUGINS" env-delim:"," no-ini:"true"`
+
+	PluginTimeout time.Duration `long:"plugin-timeout" description:"Timeout of each call to external plugins, except challenge and audit streams, 0 for no timeout" default:"10s" env:"SSHPIPERD_PLUGIN_TIMEOUT" no-ini:"true"`
+}
+
+type daemonOpts struct {
+	piperdConfig
+	loggerConfig
+}
+
+// parseDaemonConfig parses args, env and config file into new daemon options and zeroed copies of
+// driver options, so that nothing is left from the previous parse, e.g. slices or options removed
+// from config file
+func parseDaemonConfig(args []string) (*piperdConfig, driverOpts, error) {
+	configFile := &configFileOpts{}
+	config := &daemonOpts{}
+	drivers := make(driverOpts)
+
+	parser := flags.NewNamedParser("sshpiperd", flags.IgnoreUnknown)
+	addOpt(parser.Group, "sshpiperd", configFile)
+
+	c := addSubCommand(parser.Command, "daemon", "", &struct{}{})
+	addOpt(c.Group, "sshpiperd", config)
+	addPlugins(c.Group, "upstream", upstream.All(), func(n string) registry.Plugin { return upstream.Get(n) }, drivers.zeroed)
+	addPlugins(c.Group, "challenger", challenger.All(), func(n string) registry.Plugin { return challenger.Get(n) }, drivers.zeroed)
+	addPlugins(c.Group, "auditor", auditor.All(), func(n string) registry.Plugin { return auditor.Get(n) }, drivers.zeroed)
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, nil, err
+	}
+
+	daemon := flags.NewNamedParser("sshpiperd", flags.IgnoreUnknown)
+	daemon.Command = c
+	ini := flags.NewIniParser(daemon)
+	ini.ParseAsDefaults = true
+
+	if err := ini.ParseFile(string(configFile.ConfigFile)); err != nil {
+		// set by user
+		if !parser.FindOptionByLongName("config").IsSetDefault() {
+			return nil, nil, err
+		}
+	}
+
+	return &config.piperdConfig, drivers, nil
+}
+
 func main() {
 
 	parser := flags.NewNamedParser("sshpiperd", flags.Default)
 	parser.LongDescription = "SSH Piper works as a proxy-like ware, and route connections by username, src ip , etc. Please see <https://github.com/tg123/sshpiper> for more information"
 
 	// public config
-	configFile := &struct {
-		ConfigFile flags.Filename `long:"config" description:"Config file path. Will be overwritten by arg options and environment variables" default:"/etc/sshpiperd.ini" env:"SSHPIPERD_CONFIG_FILE" no-ini:"true"`
-	}{}
+	configFile := &configFileOpts{}
 	addOpt(parser.Group, "sshpiperd", configFile)
 
-	loadFromConfigFile := func(c *flags.Command) {
+	// external plugins must be in registry before drivers' options are added
+	{
+		flags.NewParser(configFile, flags.IgnoreUnknown).Parse()
+
+		for _, spec := range configFile.Plugins {
+			if err := plugin.Register(spec, configFile.PluginTimeout); err != nil {
+				fmt.Println(fmt.Sprintf("load plugin failed %v", err))
+				os.Exit(1)
+			}
+		}
+	}
+
+	loadConfigFile := func(c *flags.Command) error {
 		parser := flags.NewNamedParser("sshpiperd", flags.IgnoreUnknown)
 		parser.Command = c
 		ini := flags.NewIniParser(parser)
 		ini.ParseAsDefaults = true
-		err := populateFromConfig(ini, configFile, "config")
+		return populateFromConfig(ini, configFile, "config")
+	}
+
+	loadFromConfigFile := func(c *flags.Command) {
+		err := loadConfigFile(c)
 		if err != nil {
 			fmt.Println(fmt.Sprintf("load config file failed %v", err))
 			os.Exit(1)
@@ -176,7 +240,7 @@ func main() {
 			}
 
 			provider := upstream.Get(config.UpstreamDriver).(upstream.Provider)
-			err := provider.Init(log.New(ioutil.Discard, "", 0))
+			err := provider.Init(logging.Discard())
 			if err != nil {
 				return nil, err
 			}
@@ -185,16 +249,38 @@ func main() {
 		}))
 
 		addOpt(c.Group, "sshpiperd", config)
-		addPlugins(c.Group, "upstream", upstream.All(), func(n string) registry.Plugin { return upstream.Get(n) })
+		addPlugins(c.Group, "upstream", upstream.All(), func(n string) registry.Plugin { return upstream.Get(n) }, registry.Plugin.GetOpts)
 	}
 
-	// daemon command
-	{
+	// management of running sshpiperd via admin api
+	for _, mgr := range []struct {
+		name   string
+		desc   string
+		create func(load func() (*adminClient, error)) interface{}
+	}{
+		{"ban", "manage ban list of running sshpiperd via admin api", createBanMgr},
+		{"session", "manage active pipes of running sshpiperd via admin api", createSessionMgr},
+		{"cache", "manage upstream lookup cache of running sshpiperd via admin api", createCacheMgr},
+	} {
 		config := &struct {
-			piperdConfig
-			loggerConfig
+			AdminListen string `long:"admin-listen" description:"Admin api address of running sshpiperd, unix:/path/to.sock or host:port" env:"SSHPIPERD_ADMIN_LISTEN" ini-name:"admin-listen"`
 		}{}
 
+		var c *flags.Command
+		c = addSubCommand(parser.Command, mgr.name, mgr.desc, mgr.create(func() (*adminClient, error) {
+
+			loadFromConfigFile(c)
+
+			return newAdminClient(config.AdminListen)
+		}))
+
+		addOpt(c.Group, "sshpiperd", config)
+	}
+
+	// daemon command
+	{
+		config := &daemonOpts{}
+
 		var c *flags.Command
 		c = addSubCommand(parser.Command, "daemon", "run in daemon mode, serving traffic", &subCommand{func(args []string) error {
 			// populate by config
@@ -221,14 +307,25 @@ func main() {
 				}
 			}
 
-			return startPiper(&config.piperdConfig, config.createLogger())
+			piperConfig := config.piperdConfig
+
+			logger, logFile := config.createLogger()
+			if logFile != nil {
+				defer logFile.Close()
+				defer reopenOnSignal(logFile, logger)()
+			}
+
+			return startPiper(&piperConfig, logger, func() (*piperdConfig, driverOpts, error) {
+				// args and env are parsed again, the rest are refreshed from config file
+				return parseDaemonConfig(os.Args[1:])
+			})
 		}})
 		c.SubcommandsOptional = true
 
 		addOpt(c.Group, "sshpiperd", config)
-		addPlugins(c.Group, "upstream", upstream.All(), func(n string) registry.Plugin { return upstream.Get(n) })
-		addPlugins(c.Group, "challenger", challenger.All(), func(n string) registry.Plugin { return challenger.Get(n) })
-		addPlugins(c.Group, "auditor", auditor.All(), func(n string) registry.Plugin { return auditor.Get(n) })
+		addPlugins(c.Group, "upstream", upstream.All(), func(n string) registry.Plugin { return upstream.Get(n) }, registry.Plugin.GetOpts)
+		addPlugins(c.Group, "challenger", challenger.All(), func(n string) registry.Plugin { return challenger.Get(n) }, registry.Plugin.GetOpts)
+		addPlugins(c.Group, "auditor", auditor.All(), func(n string) registry.Plugin { return auditor.Get(n) }, registry.Plugin.GetOpts)
 
 		// dumpini for daemon
 		addSubCommand(c, "dumpconfig", "dump current config for daemon ini to stdout", &subCommand{func(args []string) error {
@@ -261,6 +358,8 @@ func main() {
 	}
 
 	_, err := parser.Parse()
+	plugin.Cleanup()
+
 	if err != nil {
 		os.Exit(1)
 	}
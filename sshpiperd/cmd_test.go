@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+func Test_parseDaemonConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "sshpiperd_ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	write := func(s string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{"--config", f.Name(), "daemon", "--port", "2200"}
+	target := upstream.Get("target")
+
+	write(`
+[sshpiperd]
+listen-address = 127.0.0.1
+ban-allowlist = 10.0.0.0/8
+ban-allowlist = 192.168.0.0/16
+listen-port = 2222
+
+[upstream.target]
+upstream-target-allow = *.internal
+`)
+
+	for i := 0; i < 2; i++ {
+		config, drivers, err := parseDaemonConfig(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(config.ListenAddr, []string{"127.0.0.1"}) {
+			t.Errorf("listen address should be replaced by config file, got %v", config.ListenAddr)
+		}
+
+		if !reflect.DeepEqual(config.BanAllowlist, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+			t.Errorf("ban allowlist should not grow on reload, got %v", config.BanAllowlist)
+		}
+
+		if config.Port != 2200 {
+			t.Errorf("port set by args should be kept, got %v", config.Port)
+		}
+
+		opts := reflect.ValueOf(drivers[target]).Elem().FieldByName("Allow").Interface()
+		if !reflect.DeepEqual(opts, []string{"*.internal"}) {
+			t.Errorf("driver options should not grow on reload, got %v", opts)
+		}
+
+		if reflect.ValueOf(target.GetOpts()).Elem().FieldByName("Allow").Len() != 0 {
+			t.Errorf("driver options should not be touched before applied")
+		}
+	}
+
+	// removed from config file
+	write(`
+[sshpiperd]
+ban-allowlist = 10.0.0.0/8
+`)
+
+	config, drivers, err := parseDaemonConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.ListenAddr) != 0 {
+		t.Errorf("removed listen address should not be kept, got %v", config.ListenAddr)
+	}
+
+	if !reflect.DeepEqual(config.BanAllowlist, []string{"10.0.0.0/8"}) {
+		t.Errorf("unexpected ban allowlist %v", config.BanAllowlist)
+	}
+
+	restore := drivers.apply()
+	if reflect.ValueOf(target.GetOpts()).Elem().FieldByName("Separator").String() != "+@" {
+		t.Errorf("driver options should be applied with defaults")
+	}
+
+	restore()
+	if reflect.ValueOf(target.GetOpts()).Elem().FieldByName("Separator").String() != "" {
+		t.Errorf("driver options should be restored")
+	}
+
+	// missing config file set by user
+	if _, _, err := parseDaemonConfig([]string{"--config", f.Name() + ".notexists", "daemon"}); err == nil {
+		t.Errorf("should fail when config file not found")
+	}
+}
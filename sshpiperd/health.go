@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// healthCheckTimeout limits a driver health check, a hanging driver is reported not ready
+var healthCheckTimeout = 5 * time.Second
+
+// healthCheck is the result of one check in /readyz
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// readiness runs all checks, returns true if all passed
+func (d *piperd) readiness() ([]healthCheck, bool) {
+	inst := d.instance()
+
+	var checks []healthCheck
+	ready := true
+
+	add := func(name string, err error) {
+		c := healthCheck{Name: name, OK: err == nil}
+
+		if err != nil {
+			c.Error = err.Error()
+			ready = false
+		}
+
+		checks = append(checks, c)
+	}
+
+	if d.isClosing() {
+		add("accepting", fmt.Errorf("shutting down"))
+	} else {
+		add("accepting", nil)
+	}
+
+	if len(inst.options.HostKeys) == 0 {
+		add("host_keys", fmt.Errorf("no host key loaded from %v", inst.config.PiperKeyFile))
+	} else {
+		add("host_keys", nil)
+	}
+
+	if checker, ok := upstream.Get(inst.config.UpstreamDriver).(upstream.HealthChecker); ok {
+		add("upstream."+inst.config.UpstreamDriver, checkWithTimeout(checker, healthCheckTimeout))
+	}
+
+	return checks, ready
+}
+
+// checkWithTimeout returns error if checker does not finish within timeout
+func checkWithTimeout(checker upstream.HealthChecker, timeout time.Duration) error {
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- checker.HealthCheck()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("health check timed out after %v", timeout)
+	}
+}
+
+// registerHealthHandlers serves /healthz and /readyz
+func (d *piperd) registerHealthHandlers(mux *http.ServeMux) {
+	// alive as long as http is served
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks, ready := d.readiness()
+
+		code := http.StatusOK
+		if !ready {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, code, struct {
+			Ready  bool          `json:"ready"`
+			Checks []healthCheck `json:"checks"`
+		}{ready, checks})
+	})
+}
+
+// serveHTTP serves metrics and health checks on the listener
+func (d *piperd) serveHTTP(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics.handler(d.logger))
+	d.registerHealthHandlers(mux)
+
+	d.logger.Printf("serving metrics and health checks on http://%v", l.Addr())
+
+	err := http.Serve(l, mux)
+	d.logger.Printf("metrics listener closed reason: %v", err)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/libpiper"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type testhealthupstream struct {
+	testupstream
+	err   error
+	block chan struct{}
+}
+
+func (u *testhealthupstream) HealthCheck() error {
+	if u.block != nil {
+		<-u.block
+	}
+
+	return u.err
+}
+
+func TestReadyz(t *testing.T) {
+	upstreamName := fmt.Sprintf("u_%v", time.Now().UTC().UnixNano())
+
+	u := &testhealthupstream{
+		testupstream: testupstream{
+			testplugin: testplugin{
+				name: upstreamName,
+			},
+			h: func(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+				return nil, nil, nil
+			},
+		},
+	}
+	upstream.Register(upstreamName, u)
+
+	d := &piperd{
+		current: &piperInstance{
+			config:  &piperdConfig{UpstreamDriver: upstreamName},
+			options: libpiper.Options{HostKeys: []ssh.Signer{nil}},
+		},
+		closing: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	d.registerHealthHandlers(mux)
+
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+
+		return w.Code, body
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz should be ok, got %v", code)
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK || body["ready"] != true {
+		t.Errorf("should be ready, got %v %v", code, body)
+	}
+
+	u.err = fmt.Errorf("database down")
+
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body["ready"] != false {
+		t.Errorf("should not be ready when upstream unhealthy, got %v %v", code, body)
+	}
+
+	u.err = nil
+	u.block = make(chan struct{})
+	defer close(u.block)
+
+	timeout := healthCheckTimeout
+	healthCheckTimeout = 100 * time.Millisecond
+	defer func() { healthCheckTimeout = timeout }()
+
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body["ready"] != false {
+		t.Errorf("should not be ready when upstream health check hangs, got %v %v", code, body)
+	}
+
+	d.current.options.HostKeys = nil
+
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("should not be ready without host key, got %v", code)
+	}
+
+	d.current.options.HostKeys = []ssh.Signer{nil}
+	close(d.closing)
+
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("should not be ready when shutting down, got %v", code)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// reasons of rejected connections
+const (
+	rejectUnauthLimit = "unauth_limit"
+	rejectIPConnLimit = "ip_conn_limit"
+	rejectIPRateLimit = "ip_rate_limit"
+)
+
+// interval to drop idle token buckets
+const connLimiterSweepInterval = time.Minute
+
+// connLimits are limits of connections, zero means unlimited
+type connLimits struct {
+	maxUnauth int
+	maxPerIP  int
+	ratePerIP float64
+	burst     int
+}
+
+func (c *piperdConfig) connLimits() connLimits {
+	return connLimits{
+		maxUnauth: c.MaxUnauthConns,
+		maxPerIP:  c.MaxConnsPerIP,
+		ratePerIP: c.ConnRatePerIP,
+		burst:     c.ConnBurstPerIP,
+	}
+}
+
+// tokenBucket allows rate tokens per second with at most burst tokens saved
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+
+	b.last = now
+}
+
+// connRejectedError is returned when a connection is over limit
+type connRejectedError struct {
+	reason string
+	ip     string
+}
+
+func (e *connRejectedError) Error() string {
+	return fmt.Sprintf("connection from %v rejected: %v", e.ip, e.reason)
+}
+
+// connLimiter tracks connections by source ip
+// it lives across config reloads, limits are passed in on each acquire
+type connLimiter struct {
+	mu        sync.Mutex
+	unauth    int
+	perIP     map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		perIP:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// connSlot is a connection counted by connLimiter
+type connSlot struct {
+	l  *connLimiter
+	ip string
+
+	authedOnce   sync.Once
+	releasedOnce sync.Once
+}
+
+// acquire counts a new connection from ip, returns connRejectedError if over limits
+func (l *connLimiter) acquire(ip string, limits connLimits) (*connSlot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now, limits)
+
+	if limits.maxUnauth > 0 && l.unauth >= limits.maxUnauth {
+		return nil, &connRejectedError{reason: rejectUnauthLimit, ip: ip}
+	}
+
+	if limits.maxPerIP > 0 && l.perIP[ip] >= limits.maxPerIP {
+		return nil, &connRejectedError{reason: rejectIPConnLimit, ip: ip}
+	}
+
+	if limits.ratePerIP > 0 {
+		burst := limits.burst
+		if burst < 1 {
+			burst = 1
+		}
+
+		b, ok := l.buckets[ip]
+		if !ok {
+			b = &tokenBucket{tokens: float64(burst), last: now}
+			l.buckets[ip] = b
+		}
+
+		b.refill(now, limits.ratePerIP, burst)
+
+		if b.tokens < 1 {
+			return nil, &connRejectedError{reason: rejectIPRateLimit, ip: ip}
+		}
+
+		b.tokens--
+	}
+
+	l.unauth++
+	l.perIP[ip]++
+
+	return &connSlot{l: l, ip: ip}, nil
+}
+
+// sweep drops buckets which are full, they are the same as new ones
+func (l *connLimiter) sweep(now time.Time, limits connLimits) {
+	if now.Sub(l.lastSweep) < connLimiterSweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for ip, b := range l.buckets {
+		if limits.ratePerIP <= 0 || b.tokens+now.Sub(b.last).Seconds()*limits.ratePerIP >= float64(limits.burst) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func (l *connLimiter) unauthCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.unauth
+}
+
+// authenticated marks the connection as no longer counted as unauthenticated
+func (s *connSlot) authenticated() {
+	s.authedOnce.Do(func() {
+		s.l.mu.Lock()
+		defer s.l.mu.Unlock()
+
+		s.l.unauth--
+	})
+}
+
+// release removes the connection from limiter
+func (s *connSlot) release() {
+	s.authenticated()
+
+	s.releasedOnce.Do(func() {
+		s.l.mu.Lock()
+		defer s.l.mu.Unlock()
+
+		s.l.perIP[s.ip]--
+		if s.l.perIP[s.ip] <= 0 {
+			delete(s.l.perIP, s.ip)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func expectRejected(t *testing.T, err error, reason string) {
+	t.Helper()
+
+	rejected, ok := err.(*connRejectedError)
+	if !ok {
+		t.Fatalf("expect rejected by %v, got %v", reason, err)
+	}
+
+	if rejected.reason != reason {
+		t.Errorf("expect rejected by %v, got %v", reason, rejected.reason)
+	}
+}
+
+func TestConnLimiterUnauth(t *testing.T) {
+	l := newConnLimiter()
+	limits := connLimits{maxUnauth: 2}
+
+	s1, err := l.acquire("10.0.0.1", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.acquire("10.0.0.2", limits); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.acquire("10.0.0.3", limits)
+	expectRejected(t, err, rejectUnauthLimit)
+
+	// authenticated conn is not counted
+	s1.authenticated()
+	s1.authenticated()
+
+	if l.unauthCount() != 1 {
+		t.Errorf("expect 1 unauth conn got %v", l.unauthCount())
+	}
+
+	if _, err := l.acquire("10.0.0.3", limits); err != nil {
+		t.Errorf("should accept after authenticated %v", err)
+	}
+
+	s1.release()
+
+	if l.unauthCount() != 2 {
+		t.Errorf("release should not change unauth count of authenticated conn, got %v", l.unauthCount())
+	}
+}
+
+func TestConnLimiterPerIP(t *testing.T) {
+	l := newConnLimiter()
+	limits := connLimits{maxPerIP: 1}
+
+	s, err := l.acquire("10.0.0.1", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.acquire("10.0.0.1", limits)
+	expectRejected(t, err, rejectIPConnLimit)
+
+	if _, err := l.acquire("10.0.0.2", limits); err != nil {
+		t.Errorf("other ip should not be limited %v", err)
+	}
+
+	s.release()
+	s.release()
+
+	if _, err := l.acquire("10.0.0.1", limits); err != nil {
+		t.Errorf("should accept after release %v", err)
+	}
+}
+
+func TestConnLimiterRate(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	l := newConnLimiter()
+	l.now = func() time.Time { return now }
+
+	limits := connLimits{ratePerIP: 2, burst: 3}
+
+	for i := 0; i < 3; i++ {
+		s, err := l.acquire("10.0.0.1", limits)
+		if err != nil {
+			t.Fatalf("burst conn %v rejected %v", i, err)
+		}
+		s.release()
+	}
+
+	_, err := l.acquire("10.0.0.1", limits)
+	expectRejected(t, err, rejectIPRateLimit)
+
+	// 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+
+	if _, err := l.acquire("10.0.0.1", limits); err != nil {
+		t.Errorf("should accept after refill %v", err)
+	}
+
+	_, err = l.acquire("10.0.0.1", limits)
+	expectRejected(t, err, rejectIPRateLimit)
+
+	// idle buckets are dropped
+	now = now.Add(time.Hour)
+
+	if _, err := l.acquire("10.0.0.2", limits); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := l.buckets["10.0.0.1"]; ok {
+		t.Errorf("idle bucket should be dropped")
+	}
+}
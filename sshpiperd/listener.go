@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first fd passed by systemd, see sd_listen_fds(3)
+const systemdListenFdsStart = 3
+
+// listen on all ipv4 addresses if no listen option
+const defaultListenAddr = "0.0.0.0"
+
+// listenAddrs converts listen options to addresses with port
+// each option can be a comma separated list, and port is taken from
+// defaultPort if not specified, e.g. 0.0.0.0,[::]:2222,10.0.0.5:22
+func listenAddrs(opts []string, defaultPort uint) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+
+	// not a struct default, or addresses from config file are appended to it
+	if len(opts) == 0 {
+		opts = []string{defaultListenAddr}
+	}
+
+	for _, opt := range opts {
+		for _, addr := range strings.Split(opt, ",") {
+			addr = strings.TrimSpace(addr)
+
+			if addr == "" {
+				continue
+			}
+
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+				addr = net.JoinHostPort(host, strconv.Itoa(int(defaultPort)))
+
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return nil, fmt.Errorf("bad listening address %v", addr)
+				}
+			}
+
+			if seen[addr] {
+				continue
+			}
+
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no listening address")
+	}
+
+	return addrs, nil
+}
+
+// systemdListeners returns listeners passed by systemd socket activation
+// nil if not activated by systemd
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	var listeners []net.Listener
+
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%v", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("failed to use socket fd %v from systemd: %v", fd, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// createListeners listens on all addresses, or uses sockets from systemd if activated
+func createListeners(config *piperdConfig) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	addrs, err := listenAddrs(config.ListenAddr, config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("failed to listen for connection: %v", err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func Test_listenAddrs(t *testing.T) {
+	for _, c := range []struct {
+		opts   []string
+		port   uint
+		expect []string
+		fail   bool
+	}{
+		{[]string{"0.0.0.0"}, 2222, []string{"0.0.0.0:2222"}, false},
+		{[]string{"0.0.0.0:2222,[::]:2222,10.0.0.5:22"}, 2222, []string{"0.0.0.0:2222", "[::]:2222", "10.0.0.5:22"}, false},
+		{[]string{"0.0.0.0", "::", "[::1]"}, 22, []string{"0.0.0.0:22", "[::]:22", "[::1]:22"}, false},
+		{[]string{"0.0.0.0", " 0.0.0.0:2222 ", ""}, 2222, []string{"0.0.0.0:2222"}, false},
+		{[]string{",,"}, 2222, nil, true},
+		{nil, 2222, []string{"0.0.0.0:2222"}, false},
+	} {
+		addrs, err := listenAddrs(c.opts, c.port)
+
+		if c.fail {
+			if err == nil {
+				t.Errorf("%v should fail", c.opts)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v failed %v", c.opts, err)
+		}
+
+		if !reflect.DeepEqual(addrs, c.expect) {
+			t.Errorf("%v expect %v, got %v", c.opts, c.expect, addrs)
+		}
+	}
+}
+
+func Test_createListeners(t *testing.T) {
+	// not for this process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := createListeners(&piperdConfig{
+		ListenAddr: []string{"127.0.0.1:0,localhost"},
+		Port:       0,
+	})
+
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+
+	if len(listeners) != 2 {
+		t.Errorf("should listen on 2 addresses")
+	}
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("systemd env should be unset")
+	}
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/composite"
 	_ "github.com/tg123/sshpiper/sshpiperd/upstream/database"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/docker"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/exec"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/http"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/kubernetes"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/kv"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/ldap"
+	_ "github.com/tg123/sshpiper/sshpiperd/upstream/target"
 	_ "github.com/tg123/sshpiper/sshpiperd/upstream/workingdir"
 	_ "github.com/tg123/sshpiper/sshpiperd/upstream/yaml"
 
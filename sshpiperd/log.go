@@ -1,29 +1,90 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type loggerConfig struct {
 	LogFile string `long:"log" description:"LogFile path. Leave empty or any error occurs will fall back to stdout" env:"SSHPIPERD_LOG_PATH" ini-name:"log-path"`
 
-	LogFlags int `long:"log-flags" default:"3" description:"Flags for logger see https://godoc.org/log, default LstdFlags" env:"SSHPIPERD_LOG_FLAGS" ini-name:"log-flags"`
+	LogFlags int `long:"log-flags" default:"3" description:"Flags for logger see https://godoc.org/log, default LstdFlags, only used in text format" env:"SSHPIPERD_LOG_FLAGS" ini-name:"log-flags"`
+
+	LogFormat string `long:"log-format" default:"text" description:"Format of log lines, text or json (one object per line)" choice:"text" choice:"json" env:"SSHPIPERD_LOG_FORMAT" ini-name:"log-format"`
+
+	LogLevel string `long:"log-level" default:"info" description:"Minimum level of log lines" choice:"debug" choice:"info" choice:"warn" choice:"error" env:"SSHPIPERD_LOG_LEVEL" ini-name:"log-level"`
+
+	LogMaxSize int64 `long:"log-max-size" default:"0" description:"Rotate LogFile when it grows over this size in MB, 0 to disable" env:"SSHPIPERD_LOG_MAX_SIZE" ini-name:"log-max-size"`
+
+	LogMaxAge time.Duration `long:"log-max-age" default:"0" description:"Rotate LogFile after it has been written for this long, e.g. 24h, 0 to disable" env:"SSHPIPERD_LOG_MAX_AGE" ini-name:"log-max-age"`
+
+	LogMaxBackups int `long:"log-max-backups" default:"7" description:"Number of rotated LogFile to keep, as LogFile.1, LogFile.2 ..." env:"SSHPIPERD_LOG_MAX_BACKUPS" ini-name:"log-max-backups"`
 }
 
-func (l loggerConfig) createLogger() (logger *log.Logger) {
+// createLogger returns the logger and the opened LogFile, which is nil if logging to stdout
+func (l loggerConfig) createLogger() (logging.Logger, *logging.RotateFile) {
 
-	logger = log.New(os.Stdout, "", l.LogFlags)
+	var w io.Writer = os.Stdout
+	var file *logging.RotateFile
+	var problems []string
 
 	if l.LogFile != "" {
-		f, err := os.OpenFile(l.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		f, err := logging.OpenRotateFile(l.LogFile, l.LogMaxSize*1024*1024, l.LogMaxAge, l.LogMaxBackups)
 		if err != nil {
-			logger.Printf("cannot open log file %v", err)
-			return
+			problems = append(problems, "cannot open log file "+err.Error())
+		} else {
+			w = f
+			file = f
 		}
+	}
+
+	level, err := logging.ParseLevel(l.LogLevel)
+	if l.LogLevel != "" && err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	format := l.LogFormat
+	if format == "" {
+		format = logging.FormatText
+	}
+
+	logger, err := logging.New(w, format, level, l.LogFlags)
+	if err != nil {
+		problems = append(problems, err.Error())
+		logger = logging.FromStdLogger(log.New(w, "", l.LogFlags))
+	}
 
-		logger = log.New(f, "", logger.Flags())
+	for _, p := range problems {
+		logger.Errorf("%v", p)
 	}
 
-	return
+	return logger, file
+}
+
+// reopenOnSignal reopens file on SIGUSR1, for external tools like logrotate
+func reopenOnSignal(file *logging.RotateFile, logger logging.Logger) (stop func()) {
+	usr1c := make(chan os.Signal, 1)
+	signal.Notify(usr1c, syscall.SIGUSR1)
+
+	go func() {
+		for range usr1c {
+			if err := file.Reopen(); err != nil {
+				logger.Errorf("failed to reopen log file: %v", err)
+				continue
+			}
+
+			logger.Printf("signal SIGUSR1 received, log file reopened")
+		}
+	}()
+
+	return func() {
+		signal.Stop(usr1c)
+		close(usr1c)
+	}
 }
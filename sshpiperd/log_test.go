@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -9,16 +10,28 @@ import (
 
 func TestCreateLogger(t *testing.T) {
 
-	// flags
+	// file
 	{
-		logger := loggerConfig{LogFlags: 2}.createLogger()
+		tmpfile, err := ioutil.TempFile("", "sshpiperlog")
+		if err != nil {
+			t.Errorf("failed to create tmp file %v", err)
+		}
+		defer os.Remove(tmpfile.Name()) // clean up
+
+		logger, file := loggerConfig{LogFile: tmpfile.Name()}.createLogger()
+		defer file.Close()
 
-		if logger.Flags() != 2 {
-			t.Errorf("flags not set")
+		logger.Printf("test123")
+
+		s, _ := ioutil.ReadFile(tmpfile.Name())
+
+		if !strings.Contains(string(s), "test123") {
+
+			t.Errorf("log failed")
 		}
 	}
 
-	// file
+	// json and level
 	{
 		tmpfile, err := ioutil.TempFile("", "sshpiperlog")
 		if err != nil {
@@ -26,15 +39,21 @@ func TestCreateLogger(t *testing.T) {
 		}
 		defer os.Remove(tmpfile.Name()) // clean up
 
-		logger := loggerConfig{LogFile: tmpfile.Name()}.createLogger()
+		logger, file := loggerConfig{LogFile: tmpfile.Name(), LogFormat: "json", LogLevel: "warn"}.createLogger()
+		defer file.Close()
 
-		logger.Print("test123")
+		logger.Infof("skipped")
+		logger.Warnf("test123")
 
 		s, _ := ioutil.ReadFile(tmpfile.Name())
 
-		if !strings.Contains(string(s), "test123") {
+		var line map[string]interface{}
+		if err := json.Unmarshal(s, &line); err != nil {
+			t.Fatalf("log is not a single json line %v: %v", string(s), err)
+		}
 
-			t.Errorf("log failed")
+		if line["msg"] != "test123" || line["level"] != "warn" {
+			t.Errorf("unexpected log line %v", string(s))
 		}
 	}
 }
@@ -0,0 +1,293 @@
+// Package logging provides the leveled and structured logger used by sshpiperd and its plugins
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	// LevelDebug is for verbose messages for troubleshooting
+	LevelDebug Level = iota
+	// LevelInfo is for normal messages
+	LevelInfo
+	// LevelWarn is for unexpected but recoverable situations
+	LevelWarn
+	// LevelError is for failures
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel converts name of level, e.g. info, to Level
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %v", name)
+}
+
+// Formats of log output
+const (
+	// FormatText is the classic free text format, fields are appended as key=value
+	FormatText = "text"
+	// FormatJSON writes one json object per line
+	FormatJSON = "json"
+)
+
+// Fields are key-values attached to log lines
+type Fields map[string]interface{}
+
+// Logger is a leveled logger with fields
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+
+	// Printf logs at info level, compatible with log.Logger
+	Printf(format string, v ...interface{})
+
+	// Println logs at info level, compatible with log.Logger
+	Println(v ...interface{})
+
+	// With returns a Logger which adds fields to all lines
+	With(fields Fields) Logger
+
+	// WithConn returns a Logger which adds fields of the downstream conn,
+	// including fields bound by BindConn
+	WithConn(conn ssh.ConnMetadata) Logger
+}
+
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+	flags  int
+	std    *log.Logger
+}
+
+type logger struct {
+	out    *output
+	fields Fields
+}
+
+// New creates a Logger writing to w, flags is the same as log.Logger's and only used in text format
+func New(w io.Writer, format string, level Level, flags int) (Logger, error) {
+	switch format {
+	case FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %v", format)
+	}
+
+	return &logger{
+		out: &output{
+			w:      w,
+			format: format,
+			level:  level,
+			flags:  flags,
+			std:    log.New(w, "", flags),
+		},
+	}, nil
+}
+
+// FromStdLogger creates a text Logger writing lines to l
+func FromStdLogger(l *log.Logger) Logger {
+	return &logger{
+		out: &output{
+			w:      l.Writer(),
+			format: FormatText,
+			level:  LevelDebug,
+			flags:  l.Flags(),
+			std:    l,
+		},
+	}
+}
+
+// Discard returns a Logger which writes nothing
+func Discard() Logger {
+	return FromStdLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func (l *logger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Warnf(format string, v ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Printf(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Println(v ...interface{}) {
+	l.output(LevelInfo, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l *logger) With(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &logger{
+		out:    l.out,
+		fields: merged,
+	}
+}
+
+func (l *logger) WithConn(conn ssh.ConnMetadata) Logger {
+	if conn == nil {
+		return l
+	}
+
+	fields := Fields{
+		"user": conn.User(),
+	}
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		fields["remote_addr"] = addr.String()
+	}
+
+	if bound, ok := boundFields(conn); ok {
+		for k, v := range bound {
+			fields[k] = v
+		}
+	}
+
+	return l.With(fields)
+}
+
+func (l *logger) output(level Level, msg string) {
+	out := l.out
+
+	if level < out.level {
+		return
+	}
+
+	switch out.format {
+	case FormatJSON:
+		line := make(map[string]interface{}, len(l.fields)+3)
+
+		for k, v := range l.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+
+			line[k] = v
+		}
+
+		line["time"] = time.Now().Format(time.RFC3339Nano)
+		line["level"] = level.String()
+		line["msg"] = msg
+
+		data, err := json.Marshal(line)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{
+				"time":  line["time"],
+				"level": line["level"],
+				"msg":   fmt.Sprintf("%v (bad fields: %v)", msg, err),
+			})
+		}
+
+		out.mu.Lock()
+		defer out.mu.Unlock()
+
+		out.w.Write(append(data, '\n'))
+
+	default:
+		var b strings.Builder
+
+		if level != LevelInfo {
+			fmt.Fprintf(&b, "[%v] ", strings.ToUpper(level.String()))
+		}
+
+		b.WriteString(msg)
+
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %v=%v", k, l.fields[k])
+		}
+
+		out.std.Output(3, b.String())
+	}
+}
+
+var boundConns sync.Map
+
+// only comparable conn can be used as key of boundConns
+func bindable(conn ssh.ConnMetadata) bool {
+	return conn != nil && reflect.TypeOf(conn).Comparable()
+}
+
+func boundFields(conn ssh.ConnMetadata) (Fields, bool) {
+	if !bindable(conn) {
+		return nil, false
+	}
+
+	bound, ok := boundConns.Load(conn)
+	if !ok {
+		return nil, false
+	}
+
+	return bound.(Fields), true
+}
+
+// BindConn attaches fields to the downstream conn, loggers from WithConn(conn) will carry them
+// UnbindConn must be called after the conn closed
+func BindConn(conn ssh.ConnMetadata, fields Fields) {
+	if bindable(conn) {
+		boundConns.Store(conn, fields)
+	}
+}
+
+// UnbindConn removes fields attached by BindConn
+func UnbindConn(conn ssh.ConnMetadata) {
+	if bindable(conn) {
+		boundConns.Delete(conn)
+	}
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testconn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c *testconn) User() string {
+	return c.user
+}
+
+func (c *testconn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		parsed, err := ParseLevel(strings.ToUpper(l.String()))
+		if err != nil {
+			t.Errorf("parse %v failed %v", l, err)
+		}
+
+		if parsed != l {
+			t.Errorf("expect %v got %v", l, parsed)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("should fail with unknown level")
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := New(&buf, FormatText, LevelInfo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debugf("hidden")
+	logger.With(Fields{"b": 2, "a": 1}).Infof("hello %v", "world")
+	logger.Errorf("bad")
+
+	expected := "hello world a=1 b=2\n[ERROR] bad\n"
+	if buf.String() != expected {
+		t.Errorf("expect %q got %q", expected, buf.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := New(&buf, FormatJSON, LevelDebug, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &testconn{user: "alice"}
+
+	BindConn(conn, Fields{"conn_id": "42"})
+	logger.WithConn(conn).With(Fields{"reason": fmt.Errorf("boom")}).Warnf("failed")
+	UnbindConn(conn)
+	logger.WithConn(conn).Debugf("unbound")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines got %v", lines)
+	}
+
+	var first map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"level":       "warn",
+		"msg":         "failed",
+		"user":        "alice",
+		"remote_addr": "127.0.0.1:2222",
+		"conn_id":     "42",
+		"reason":      "boom",
+	} {
+		if first[k] != v {
+			t.Errorf("expect %v=%v got %v", k, v, first[k])
+		}
+	}
+
+	var second map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := second["conn_id"]; ok {
+		t.Errorf("conn_id should be gone after unbind")
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", LevelInfo, 0); err == nil {
+		t.Errorf("should fail with unknown format")
+	}
+}
@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotateFile is an io.Writer appending to a log file
+// the file is rotated to path.1, path.2 ... when it grows over maxSize bytes
+// or has been written for longer than maxAge, at most maxBackups rotated files are kept
+type RotateFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotateFile opens path for appending, maxSize and maxAge are ignored if not positive
+func OpenRotateFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotateFile, error) {
+	f := &RotateFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	return nil
+}
+
+func (f *RotateFile) backupName(i int) string {
+	return fmt.Sprintf("%v.%v", f.path, i)
+}
+
+func (f *RotateFile) rotate() error {
+	if f.maxBackups > 0 {
+		os.Remove(f.backupName(f.maxBackups))
+
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.backupName(i), f.backupName(i+1))
+		}
+
+		if err := os.Rename(f.path, f.backupName(1)); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+	}
+
+	return f.open()
+}
+
+func (f *RotateFile) needRotate(n int) bool {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+
+	if f.maxAge > 0 && time.Since(f.opened) >= f.maxAge {
+		return true
+	}
+
+	return false
+}
+
+// Write appends p to the file, rotates the file first if needed
+// the current file is kept if rotation fails
+func (f *RotateFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.needRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %v: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Rotate rotates the file immediately
+func (f *RotateFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rotate()
+}
+
+// Reopen closes and opens the file again, for the file was moved by tools like logrotate
+func (f *RotateFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.open()
+}
+
+// Close closes the file
+func (f *RotateFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read %v failed: %v", name, err)
+	}
+
+	return string(data)
+}
+
+func TestRotateFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "sshpiperd.log")
+
+	f, err := OpenRotateFile(name, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(f, "line %v\n", i)
+	}
+
+	if s := readFile(t, name); s != "line 3\n" {
+		t.Errorf("unexpected current file %q", s)
+	}
+
+	if s := readFile(t, name+".1"); s != "line 2\n" {
+		t.Errorf("unexpected backup 1 %q", s)
+	}
+
+	if s := readFile(t, name+".2"); s != "line 1\n" {
+		t.Errorf("unexpected backup 2 %q", s)
+	}
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("should keep 2 backups only")
+	}
+}
+
+func TestRotateFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "sshpiperd.log")
+
+	f, err := OpenRotateFile(name, 0, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "old\n")
+	f.opened = time.Now().Add(-2 * time.Hour)
+	fmt.Fprintf(f, "new\n")
+
+	if s := readFile(t, name); s != "new\n" {
+		t.Errorf("unexpected current file %q", s)
+	}
+
+	if s := readFile(t, name+".1"); s != "old\n" {
+		t.Errorf("unexpected backup %q", s)
+	}
+}
+
+func TestRotateFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshpiperlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "sshpiperd.log")
+
+	f, err := OpenRotateFile(name, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "before\n")
+
+	// logrotate style move and create
+	if err := os.Rename(name, name+".moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(f, "after\n")
+
+	if s := readFile(t, name+".moved"); s != "before\n" {
+		t.Errorf("unexpected moved file %q", s)
+	}
+
+	if s := readFile(t, name); s != "after\n" {
+		t.Errorf("unexpected reopened file %q", s)
+	}
+}
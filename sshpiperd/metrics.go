@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+)
+
+// reasons of handshake failures
+const (
+	handshakeFailureTimeout          = "timeout"
+	handshakeFailureUpstreamNotFound = "upstream_not_found"
+	handshakeFailureUpstream         = "upstream_failure"
+	handshakeFailureAuth             = "auth_failure"
+	handshakeFailureBanned           = "banned"
+	handshakeFailureOther            = "other"
+)
+
+// piperMetrics holds prometheus metrics of sshpiperd
+type piperMetrics struct {
+	registry *prometheus.Registry
+
+	accepted          prometheus.Counter
+	rejected          *prometheus.CounterVec
+	handshakeFailures *prometheus.CounterVec
+	upstreamDial      prometheus.Histogram
+	pipedBytes        *prometheus.CounterVec
+	driverErrors      *prometheus.CounterVec
+}
+
+func newPiperMetrics(activePipes func() int) *piperMetrics {
+	m := &piperMetrics{
+		registry: prometheus.NewRegistry(),
+
+		accepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sshpiperd",
+			Name:      "connections_accepted_total",
+			Help:      "Number of accepted downstream connections.",
+		}),
+
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sshpiperd",
+			Name:      "connections_rejected_total",
+			Help:      "Number of connections rejected by limits before handshake, by reason.",
+		}, []string{"reason"}),
+
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sshpiperd",
+			Name:      "handshake_failures_total",
+			Help:      "Number of connections failed to establish a pipe, by reason.",
+		}, []string{"reason"}),
+
+		upstreamDial: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sshpiperd",
+			Name:      "upstream_dial_duration_seconds",
+			Help:      "Time spent by upstream driver to find and dial upstream.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+
+		pipedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sshpiperd",
+			Name:      "piped_bytes_total",
+			Help:      "Bytes of ssh messages piped, up is from downstream to upstream, down is the reverse.",
+		}, []string{"direction"}),
+
+		driverErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sshpiperd",
+			Name:      "driver_errors_total",
+			Help:      "Number of errors returned by drivers.",
+		}, []string{"type", "driver"}),
+	}
+
+	m.registry.MustRegister(
+		m.accepted,
+		m.rejected,
+		m.handshakeFailures,
+		m.upstreamDial,
+		m.pipedBytes,
+		m.driverErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sshpiperd",
+			Name:      "pipes_active",
+			Help:      "Number of established pipes.",
+		}, func() float64 {
+			return float64(activePipes())
+		}),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// handler exposes metrics in prometheus format
+func (m *piperMetrics) handler(logger logging.Logger) http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog: logger,
+	})
+}
+
+// instrumentPipe counts bytes piped and errors from auditor hooks
+func (m *piperMetrics) instrumentPipe(p *ssh.PiperConn, inst *piperInstance) {
+	up := m.pipedBytes.WithLabelValues("up")
+	down := m.pipedBytes.WithLabelValues("down")
+	auditorErrors := m.driverErrors.WithLabelValues("auditor", inst.config.AuditorDriver)
+
+	wrap := func(hook func(ssh.ConnMetadata, []byte) ([]byte, error), counter prometheus.Counter) func(ssh.ConnMetadata, []byte) ([]byte, error) {
+		return func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+			counter.Add(float64(len(msg)))
+
+			if hook == nil {
+				return msg, nil
+			}
+
+			msg, err := hook(conn, msg)
+			if err != nil {
+				auditorErrors.Inc()
+			}
+
+			return msg, err
+		}
+	}
+
+	// upstream hook handles msg from upstream to downstream
+	p.HookUpstreamMsg = wrap(p.HookUpstreamMsg, down)
+	p.HookDownstreamMsg = wrap(p.HookDownstreamMsg, up)
+}
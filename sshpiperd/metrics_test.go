@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+)
+
+func TestMetricsInstrumentPipe(t *testing.T) {
+	m := newPiperMetrics(func() int { return 42 })
+
+	inst := &piperInstance{
+		config: &piperdConfig{AuditorDriver: "testauditor"},
+	}
+
+	p := &ssh.PiperConn{}
+	p.HookDownstreamMsg = func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		return nil, fmt.Errorf("audit failed")
+	}
+
+	m.instrumentPipe(p, inst)
+
+	if _, err := p.HookUpstreamMsg(nil, []byte("hello")); err != nil {
+		t.Errorf("nil hook should pass msg")
+	}
+
+	if _, err := p.HookDownstreamMsg(nil, []byte("hi")); err == nil {
+		t.Errorf("should return error from auditor hook")
+	}
+
+	if testutil.ToFloat64(m.pipedBytes.WithLabelValues("down")) != 5 {
+		t.Errorf("down bytes not counted")
+	}
+
+	if testutil.ToFloat64(m.pipedBytes.WithLabelValues("up")) != 2 {
+		t.Errorf("up bytes not counted")
+	}
+
+	if testutil.ToFloat64(m.driverErrors.WithLabelValues("auditor", "testauditor")) != 1 {
+		t.Errorf("auditor error not counted")
+	}
+
+	// endpoint
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, m.handler(logging.Discard()))
+
+	resp, err := http.Get(fmt.Sprintf("http://%v/metrics", l.Addr()))
+	if err != nil {
+		t.Fatalf("failed to get metrics %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), "sshpiperd_pipes_active 42") {
+		t.Errorf("active pipes not exposed")
+	}
+
+	if !strings.Contains(string(body), `sshpiperd_piped_bytes_total{direction="down"} 5`) {
+		t.Errorf("piped bytes not exposed")
+	}
+}
@@ -24,7 +24,10 @@ func createPipeMgr(load func() (upstream.Provider, error)) interface{} {
 			UpstreamPort     int    `short:"p" long:"port" description:"upstream sshd port" default:"22" no-ini:"true"`
 			// UpstreamKeyFile  flags.Filename
 
-			// UpstreamHostKey
+			UpstreamHostKey       string `long:"host-key" description:"upstream host key in authorized_keys format, e.g. ssh-ed25519 AAAA..." no-ini:"true"`
+			UpstreamIgnoreHostKey bool   `long:"ignore-host-key" description:"do not verify upstream host key" no-ini:"true"`
+
+			Source string `long:"source" description:"member driver to create the pipe in, for drivers combining others, e.g. composite" no-ini:"true"`
 			// MapType
 
 		} `command:"add" description:"add a pipe to current upstream"`
@@ -47,7 +50,7 @@ func createPipeMgr(load func() (upstream.Provider, error)) interface{} {
 			return err
 		}
 
-		t := template.Must(template.New("").Parse(`{{.Username}} -> {{.UpstreamUsername}}@{{.Host}}:{{.Port}}`))
+		t := template.Must(template.New("").Parse(`{{.Username}} -> {{.UpstreamUsername}}@{{.Host}}:{{.Port}}{{if .Source}} ({{.Source}}){{end}}`))
 
 		for _, pipe := range pipes {
 			t.Execute(os.Stdout, pipe)
@@ -70,6 +73,9 @@ func createPipeMgr(load func() (upstream.Provider, error)) interface{} {
 			UpstreamUsername: opt.UpstreamUserName,
 			Host:             opt.UpstreamHost,
 			Port:             opt.UpstreamPort,
+			HostKey:          opt.UpstreamHostKey,
+			IgnoreHostKey:    opt.UpstreamIgnoreHostKey,
+			Source:           opt.Source,
 		})
 	}
 
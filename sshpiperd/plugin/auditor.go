@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/auditor"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+)
+
+// auditorPlugin is auditor.Provider backed by a plugin binary
+type auditorPlugin struct {
+	*process
+}
+
+func (p *auditorPlugin) GetName() string {
+	return p.name
+}
+
+func (p *auditorPlugin) GetOpts() interface{} {
+	return nil
+}
+
+func (p *auditorPlugin) Init(logger logging.Logger) error {
+	return p.init(logger, func(raw interface{}) error {
+		ctx, cancel := p.rpcContext()
+		defer cancel()
+
+		_, err := raw.(proto.AuditorClient).Init(ctx, &proto.InitRequest{})
+		return err
+	})
+}
+
+// Create starts an audit stream for the pipe and waits for the plugin to be ready
+func (p *auditorPlugin) Create(conn ssh.ConnMetadata) (auditor.Auditor, error) {
+	var a *streamAuditor
+
+	err := p.call(func(raw interface{}) error {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		stream, err := raw.(proto.AuditorClient).Audit(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		if err := stream.Send(&proto.AuditRequest{Conn: toConnMeta(conn)}); err != nil {
+			cancel()
+			return err
+		}
+
+		// ready
+		if _, err := stream.Recv(); err != nil {
+			cancel()
+			return err
+		}
+
+		a = &streamAuditor{stream: stream, cancel: cancel}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// streamAuditor sends msgs of a pipe to plugin one by one
+type streamAuditor struct {
+	mu     sync.Mutex
+	stream proto.Auditor_AuditClient
+	cancel context.CancelFunc
+}
+
+func (a *streamAuditor) audit(direction proto.AuditRequest_Direction, msg []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.stream.Send(&proto.AuditRequest{Direction: direction, Data: msg}); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Data, nil
+}
+
+func (a *streamAuditor) GetUpstreamHook() auditor.Hook {
+	return func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		return a.audit(proto.AuditRequest_UPSTREAM, msg)
+	}
+}
+
+func (a *streamAuditor) GetDownstreamHook() auditor.Hook {
+	return func(conn ssh.ConnMetadata, msg []byte) ([]byte, error) {
+		return a.audit(proto.AuditRequest_DOWNSTREAM, msg)
+	}
+}
+
+func (a *streamAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.stream.CloseSend()
+	a.cancel()
+
+	return err
+}
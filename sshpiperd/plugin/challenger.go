@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+)
+
+// challengerPlugin is challenger.Provider backed by a plugin binary
+type challengerPlugin struct {
+	*process
+}
+
+func (p *challengerPlugin) GetName() string {
+	return p.name
+}
+
+func (p *challengerPlugin) GetOpts() interface{} {
+	return nil
+}
+
+func (p *challengerPlugin) Init(logger logging.Logger) error {
+	return p.init(logger, func(raw interface{}) error {
+		ctx, cancel := p.rpcContext()
+		defer cancel()
+
+		_, err := raw.(proto.ChallengerClient).Init(ctx, &proto.InitRequest{})
+		return err
+	})
+}
+
+func (p *challengerPlugin) GetHandler() challenger.Handler {
+	return p.challenge
+}
+
+func (p *challengerPlugin) challenge(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (ssh.AdditionalChallengeContext, error) {
+	raw, err := p.dispense()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := raw.(proto.ChallengerClient).Challenge(ctx)
+	if err != nil {
+		return nil, p.check(raw, err)
+	}
+
+	if err := stream.Send(&proto.ChallengeRequest{
+		Msg: &proto.ChallengeRequest_Conn{Conn: toConnMeta(conn)},
+	}); err != nil {
+		return nil, p.check(raw, err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, p.check(raw, err)
+		}
+
+		switch msg := resp.Msg.(type) {
+		case *proto.ChallengeResponse_Questions:
+			q := msg.Questions
+
+			answers, err := client(q.User, q.Instruction, q.Questions, q.Echos)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := stream.Send(&proto.ChallengeRequest{
+				Msg: &proto.ChallengeRequest_Answers{Answers: &proto.KeyboardInteractiveAnswers{Answers: answers}},
+			}); err != nil {
+				return nil, err
+			}
+
+		case *proto.ChallengeResponse_Result:
+			stream.CloseSend()
+
+			if msg.Result == nil {
+				return nil, nil
+			}
+
+			return &challengeContext{msg.Result}, nil
+
+		default:
+			return nil, fmt.Errorf("unexpected challenge response from plugin %v", p.path)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+)
+
+func toConnMeta(conn ssh.ConnMetadata) *proto.ConnMeta {
+	if conn == nil {
+		return &proto.ConnMeta{}
+	}
+
+	meta := &proto.ConnMeta{
+		User:          conn.User(),
+		SessionId:     conn.SessionID(),
+		ClientVersion: string(conn.ClientVersion()),
+	}
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		meta.RemoteAddr = addr.String()
+	}
+
+	if addr := conn.LocalAddr(); addr != nil {
+		meta.LocalAddr = addr.String()
+	}
+
+	return meta
+}
+
+// challengeContext is ssh.AdditionalChallengeContext returned by challenger plugins
+type challengeContext struct {
+	ctx *proto.ChallengeContext
+}
+
+func (c *challengeContext) ChallengerName() string {
+	return c.ctx.ChallengerName
+}
+
+// Meta returns map[string]string from the plugin
+func (c *challengeContext) Meta() interface{} {
+	return c.ctx.Meta
+}
+
+func (c *challengeContext) ChallengedUsername() string {
+	return c.ctx.ChallengedUsername
+}
+
+// toChallengeContext converts ctx to proto, meta is kept only if it is map[string]string
+func toChallengeContext(ctx ssh.AdditionalChallengeContext) *proto.ChallengeContext {
+	if ctx == nil {
+		return nil
+	}
+
+	c := &proto.ChallengeContext{
+		ChallengerName:     ctx.ChallengerName(),
+		ChallengedUsername: ctx.ChallengedUsername(),
+	}
+
+	if meta, ok := ctx.Meta().(map[string]string); ok {
+		c.Meta = meta
+	}
+
+	return c
+}
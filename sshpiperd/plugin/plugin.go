@@ -0,0 +1,111 @@
+// Package plugin runs upstream, challenger and auditor drivers as external binaries
+//
+// sshpiperd starts the binaries and talks to them with the gRPC protocol in
+// plugin/proto, see Serve for writing a plugin and Register for loading one.
+package plugin
+
+//go:generate protoc -I proto --go_out=proto --go_opt=paths=source_relative --go-grpc_out=proto --go-grpc_opt=paths=source_relative plugin.proto
+
+import (
+	"context"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+)
+
+// ProtocolVersion is the version of plugin/proto, plugins with a different version are refused
+const ProtocolVersion = 1
+
+// kinds of plugins, also the names used in plugin set
+const (
+	KindUpstream   = "upstream"
+	KindChallenger = "challenger"
+	KindAuditor    = "auditor"
+)
+
+// Handshake is shared by sshpiperd and plugins to make sure the binary is a plugin of sshpiperd
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  ProtocolVersion,
+	MagicCookieKey:   "SSHPIPERD_PLUGIN",
+	MagicCookieValue: "5f7ad6b0-1b9e-4c8e-9d6a-0e3f1c2b7a94",
+}
+
+// grpcPlugin registers a service in plugin side and creates its client in sshpiperd side
+type grpcPlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+
+	register func(s *grpc.Server)
+	client   func(c *grpc.ClientConn) interface{}
+}
+
+func (p *grpcPlugin) GRPCServer(broker *goplugin.GRPCBroker, s *grpc.Server) error {
+	p.register(s)
+	return nil
+}
+
+func (p *grpcPlugin) GRPCClient(ctx context.Context, broker *goplugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
+	return p.client(c), nil
+}
+
+// clientPlugins are plugins known by sshpiperd
+var clientPlugins = map[string]goplugin.Plugin{
+	KindUpstream: &grpcPlugin{
+		client: func(c *grpc.ClientConn) interface{} {
+			return proto.NewUpstreamClient(c)
+		},
+	},
+	KindChallenger: &grpcPlugin{
+		client: func(c *grpc.ClientConn) interface{} {
+			return proto.NewChallengerClient(c)
+		},
+	},
+	KindAuditor: &grpcPlugin{
+		client: func(c *grpc.ClientConn) interface{} {
+			return proto.NewAuditorClient(c)
+		},
+	},
+}
+
+// ServeConfig holds services a plugin binary provides, nil for not provided
+type ServeConfig struct {
+	Upstream   proto.UpstreamServer
+	Challenger proto.ChallengerServer
+	Auditor    proto.AuditorServer
+}
+
+// Serve is called by main of plugin binaries and blocks until sshpiperd stops the plugin
+func Serve(config *ServeConfig) {
+	plugins := make(map[string]goplugin.Plugin)
+
+	if s := config.Upstream; s != nil {
+		plugins[KindUpstream] = &grpcPlugin{
+			register: func(g *grpc.Server) {
+				proto.RegisterUpstreamServer(g, s)
+			},
+		}
+	}
+
+	if s := config.Challenger; s != nil {
+		plugins[KindChallenger] = &grpcPlugin{
+			register: func(g *grpc.Server) {
+				proto.RegisterChallengerServer(g, s)
+			},
+		}
+	}
+
+	if s := config.Auditor; s != nil {
+		plugins[KindAuditor] = &grpcPlugin{
+			register: func(g *grpc.Server) {
+				proto.RegisterAuditorServer(g, s)
+			},
+		}
+	}
+
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         plugins,
+		GRPCServer:      goplugin.DefaultGRPCServer,
+	})
+}
@@ -0,0 +1,425 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tg123/sshpiper/sshpiperd/auditor"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// the test binary serves as plugin when this env is set
+const testPluginEnv = "SSHPIPERD_TEST_PLUGIN"
+
+// address returned by the test upstream plugin
+const testUpstreamEnv = "SSHPIPERD_TEST_UPSTREAM"
+
+// timeout of unary rpcs to test plugins
+const testTimeout = time.Second
+
+type testUpstream struct {
+	proto.UnimplementedUpstreamServer
+}
+
+func (u *testUpstream) Init(ctx context.Context, req *proto.InitRequest) (*proto.InitResponse, error) {
+	return &proto.InitResponse{}, nil
+}
+
+func (u *testUpstream) FindUpstream(ctx context.Context, req *proto.FindUpstreamRequest) (*proto.FindUpstreamResponse, error) {
+	switch req.Conn.User {
+	case "alice":
+		return &proto.FindUpstreamResponse{
+			Address:       os.Getenv(testUpstreamEnv),
+			User:          "bob",
+			IgnoreHostKey: true,
+			MapPassword:   true,
+			Context:       []byte("ctx"),
+		}, nil
+	case "carol":
+		// no host key
+		return &proto.FindUpstreamResponse{
+			Address: os.Getenv(testUpstreamEnv),
+		}, nil
+	case "slow":
+		time.Sleep(2 * testTimeout)
+	}
+
+	return nil, fmt.Errorf("no upstream for %v", req.Conn.User)
+}
+
+func (u *testUpstream) MapPassword(ctx context.Context, req *proto.MapPasswordRequest) (*proto.AuthMapping, error) {
+	if string(req.Context) != "ctx" {
+		return nil, fmt.Errorf("context not passed back")
+	}
+
+	return &proto.AuthMapping{
+		Type:     proto.AuthMapping_MAP,
+		Password: append([]byte("mapped-"), req.Password...),
+	}, nil
+}
+
+func (u *testUpstream) ListPipe(ctx context.Context, req *proto.ListPipeRequest) (*proto.ListPipeResponse, error) {
+	return &proto.ListPipeResponse{
+		Pipes: []*proto.Pipe{{Username: "alice", UpstreamUsername: "bob", Host: "127.0.0.1", Port: 22}},
+	}, nil
+}
+
+func (u *testUpstream) CreatePipe(ctx context.Context, req *proto.CreatePipeRequest) (*proto.CreatePipeResponse, error) {
+	if req.Pipe.HostKey != "key" && !req.Pipe.IgnoreHostKey {
+		return nil, fmt.Errorf("no host key for %v", req.Pipe.Username)
+	}
+
+	return &proto.CreatePipeResponse{}, nil
+}
+
+type testChallenger struct {
+	proto.UnimplementedChallengerServer
+}
+
+func (c *testChallenger) Init(ctx context.Context, req *proto.InitRequest) (*proto.InitResponse, error) {
+	return &proto.InitResponse{}, nil
+}
+
+func (c *testChallenger) Challenge(stream proto.Challenger_ChallengeServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	user := req.GetConn().User
+
+	if err := stream.Send(&proto.ChallengeResponse{
+		Msg: &proto.ChallengeResponse_Questions{Questions: &proto.KeyboardInteractiveQuestions{
+			Questions: []string{"answer?"},
+			Echos:     []bool{true},
+		}},
+	}); err != nil {
+		return err
+	}
+
+	req, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if answers := req.GetAnswers().Answers; len(answers) != 1 || answers[0] != "42" {
+		return fmt.Errorf("wrong answer")
+	}
+
+	return stream.Send(&proto.ChallengeResponse{
+		Msg: &proto.ChallengeResponse_Result{Result: &proto.ChallengeContext{
+			ChallengerName:     "test",
+			ChallengedUsername: user,
+			Meta:               map[string]string{"answer": "42"},
+		}},
+	})
+}
+
+type testAuditor struct {
+	proto.UnimplementedAuditorServer
+}
+
+func (a *testAuditor) Init(ctx context.Context, req *proto.InitRequest) (*proto.InitResponse, error) {
+	return &proto.InitResponse{}, nil
+}
+
+func (a *testAuditor) Audit(stream proto.Auditor_AuditServer) error {
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+
+	if err := stream.Send(&proto.AuditResponse{}); err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		data := req.Data
+		if req.Direction == proto.AuditRequest_DOWNSTREAM {
+			data = bytes.ToUpper(data)
+		}
+
+		if err := stream.Send(&proto.AuditResponse{Data: data}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testPluginEnv) != "" {
+		Serve(&ServeConfig{
+			Upstream:   &testUpstream{},
+			Challenger: &testChallenger{},
+			Auditor:    &testAuditor{},
+		})
+		os.Exit(0)
+	}
+
+	os.Setenv(testPluginEnv, "1")
+	defer Cleanup()
+
+	os.Exit(m.Run())
+}
+
+func TestParseSpec(t *testing.T) {
+	kind, name, path, err := parseSpec("upstream.foo=/usr/bin/foo")
+	if err != nil || kind != "upstream" || name != "foo" || path != "/usr/bin/foo" {
+		t.Errorf("unexpected %v %v %v %v", kind, name, path, err)
+	}
+
+	for _, spec := range []string{"", "upstream.foo", "upstream=/bin/foo", "upstream.=/bin/foo", "unknown.foo=/bin/foo"} {
+		if _, _, _, err := parseSpec(spec); err == nil {
+			t.Errorf("%q should fail", spec)
+		}
+	}
+}
+
+type testConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c *testConn) User() string {
+	return c.user
+}
+
+func (c *testConn) SessionID() []byte {
+	return nil
+}
+
+func (c *testConn) ClientVersion() []byte {
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func TestUpstreamPlugin(t *testing.T) {
+	restartBackoff = 0
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	os.Setenv(testUpstreamEnv, l.Addr().String())
+
+	name := fmt.Sprintf("plugin_%v", time.Now().UnixNano())
+	if err := Register("upstream."+name+"="+os.Args[0], testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Register("upstream."+name+"="+os.Args[0], testTimeout); err == nil {
+		t.Errorf("should fail to register twice")
+	}
+
+	p := upstream.Get(name)
+	if err := p.Init(logging.Discard()); err != nil {
+		t.Fatalf("init failed %v", err)
+	}
+
+	if _, _, err := p.GetHandler()(&testConn{user: "eve"}, nil); err == nil {
+		t.Errorf("should fail for unknown user")
+	}
+
+	if _, _, err := p.GetHandler()(&testConn{user: "carol"}, nil); err == nil {
+		t.Errorf("should fail without host key")
+	}
+
+	if _, _, err := p.GetHandler()(&testConn{user: "slow"}, nil); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("should time out, got %v", err)
+	}
+
+	c, pipe, err := p.GetHandler()(&testConn{user: "alice"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != l.Addr().String() || pipe.User != "bob" || pipe.PublicKeyCallback != nil {
+		t.Errorf("unexpected pipe %v %v", c.RemoteAddr(), pipe)
+	}
+
+	authType, _, err := pipe.PasswordCallback(nil, []byte("secret"))
+	if err != nil || authType != ssh.AuthPipeTypeMap {
+		t.Errorf("unexpected password mapping %v %v", authType, err)
+	}
+
+	pipes, err := p.ListPipe()
+	if err != nil || len(pipes) != 1 || pipes[0].UpstreamUsername != "bob" {
+		t.Errorf("unexpected pipes %v %v", pipes, err)
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice"}); err == nil {
+		t.Errorf("create without host key should fail")
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", HostKey: "key"}); err != nil {
+		t.Errorf("host key should be passed to plugin %v", err)
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", IgnoreHostKey: true}); err != nil {
+		t.Errorf("ignore host key should be passed to plugin %v", err)
+	}
+
+	checker := p.(upstream.HealthChecker)
+	if err := checker.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	proc := p.(*upstreamPlugin).process
+	crash := func() {
+		proc.mu.Lock()
+		pid := proc.client.ReattachConfig().Pid
+		proc.mu.Unlock()
+
+		crashed, err := os.FindProcess(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crashed.Kill()
+		crashed.Wait()
+	}
+
+	// calls right after crash restart the binary, even before go-plugin notices it exited
+	crash()
+
+	if _, err := p.ListPipe(); err != nil {
+		t.Errorf("should restart after crash %v", err)
+	}
+
+	if err := checker.HealthCheck(); err != nil {
+		t.Errorf("should be healthy after restart %v", err)
+	}
+
+	// not healthy after crash, restarted by next call
+	crash()
+
+	for i := 0; i < 100 && proc.ping() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := checker.HealthCheck(); err == nil {
+		t.Errorf("should not be healthy after crash")
+	}
+
+	if _, err := p.ListPipe(); err != nil {
+		t.Errorf("should restart after crash %v", err)
+	}
+
+	if err := checker.HealthCheck(); err != nil {
+		t.Errorf("should be healthy after restart %v", err)
+	}
+
+	// concurrent calls after crash share one restart
+	crash()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = p.ListPipe()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("concurrent calls should restart after crash %v", err)
+		}
+	}
+}
+
+func TestChallengerPlugin(t *testing.T) {
+	name := fmt.Sprintf("plugin_%v", time.Now().UnixNano())
+	if err := Register("challenger."+name+"="+os.Args[0], testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	p := challenger.Get(name)
+	if err := p.Init(logging.Discard()); err != nil {
+		t.Fatalf("init failed %v", err)
+	}
+
+	answer := "41"
+	client := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 1 || questions[0] != "answer?" {
+			return nil, fmt.Errorf("unexpected questions %v", questions)
+		}
+
+		return []string{answer}, nil
+	}
+
+	if _, err := p.GetHandler()(&testConn{user: "alice"}, client); err == nil {
+		t.Errorf("wrong answer should fail")
+	}
+
+	answer = "42"
+	ctx, err := p.GetHandler()(&testConn{user: "alice"}, client)
+	if err != nil {
+		t.Fatalf("challenge failed %v", err)
+	}
+
+	if ctx.ChallengerName() != "test" || ctx.ChallengedUsername() != "alice" || ctx.Meta().(map[string]string)["answer"] != "42" {
+		t.Errorf("unexpected context %v", ctx)
+	}
+}
+
+func TestAuditorPlugin(t *testing.T) {
+	name := fmt.Sprintf("plugin_%v", time.Now().UnixNano())
+	if err := Register("auditor."+name+"="+os.Args[0], testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	p := auditor.Get(name)
+	if err := p.Init(logging.Discard()); err != nil {
+		t.Fatalf("init failed %v", err)
+	}
+
+	a, err := p.Create(&testConn{user: "alice"})
+	if err != nil {
+		t.Fatalf("create failed %v", err)
+	}
+	defer a.Close()
+
+	msg, err := a.GetDownstreamHook()(nil, []byte("hello"))
+	if err != nil || string(msg) != "HELLO" {
+		t.Errorf("unexpected downstream msg %q %v", msg, err)
+	}
+
+	msg, err = a.GetUpstreamHook()(nil, []byte("hello"))
+	if err != nil || string(msg) != "hello" {
+		t.Errorf("unexpected upstream msg %q %v", msg, err)
+	}
+}
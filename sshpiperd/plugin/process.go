@@ -0,0 +1,356 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+)
+
+// min interval between two starts of a plugin, avoid busy restarting a broken binary
+var restartBackoff = 5 * time.Second
+
+// interval to check whether plugins are alive
+var superviseInterval = 10 * time.Second
+
+// process is a plugin binary started and supervised by sshpiperd
+// it is started on first use and restarted if crashed or not responding
+type process struct {
+	kind string
+	name string
+	path string
+
+	// timeout of unary rpcs, 0 for no timeout
+	timeout time.Duration
+
+	mu        sync.Mutex
+	logger    logging.Logger
+	client    *goplugin.Client
+	raw       interface{}
+	lastStart time.Time
+
+	// closed when the start in progress is done, nil if not starting
+	starting chan struct{}
+	startErr error
+
+	// called with the dispensed client after every start, e.g. to init the plugin
+	onStart func(raw interface{}) error
+
+	superviseOnce sync.Once
+	stop          chan struct{}
+}
+
+func newProcess(kind, name, path string, timeout time.Duration) *process {
+	return &process{
+		kind:    kind,
+		name:    name,
+		path:    path,
+		timeout: timeout,
+		logger:  logging.Discard(),
+		stop:    make(chan struct{}),
+	}
+}
+
+// rpcContext returns the context of a unary rpc, streams are bound to the pipe instead
+func (p *process) rpcContext() (context.Context, context.CancelFunc) {
+	if p.timeout > 0 {
+		return context.WithTimeout(context.Background(), p.timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// init sets logger and onStart, starts the binary and supervising
+// called again on config reload, the running binary is reused and onStart is called again
+func (p *process) init(logger logging.Logger, onStart func(raw interface{}) error) error {
+	p.mu.Lock()
+	p.logger = logger
+	p.onStart = onStart
+	raw := p.raw
+	running := p.client != nil && !p.client.Exited()
+	p.mu.Unlock()
+
+	var err error
+	if running {
+		// crashed but not noticed yet
+		if err = p.check(raw, onStart(raw)); status.Code(err) == codes.Unavailable {
+			running = false
+		}
+	}
+
+	if !running {
+		_, err = p.dispense()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.superviseOnce.Do(func() {
+		go p.supervise()
+	})
+
+	return nil
+}
+
+// dispense returns the client of the plugin, the binary is (re)started if not running
+// the binary is started without holding the lock, concurrent callers wait for the same start
+func (p *process) dispense() (interface{}, error) {
+	p.mu.Lock()
+
+	for p.starting != nil {
+		starting := p.starting
+		p.mu.Unlock()
+		<-starting
+		p.mu.Lock()
+
+		if p.client == nil {
+			err := p.startErr
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	if p.client != nil {
+		if !p.client.Exited() {
+			raw := p.raw
+			p.mu.Unlock()
+			return raw, nil
+		}
+
+		p.logger.Errorf("plugin %v exited unexpectedly, restarting", p.path)
+		p.client = nil
+		p.raw = nil
+	}
+
+	if since := time.Since(p.lastStart); since < restartBackoff {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("plugin %v restarted %v ago, wait for %v before next start", p.path, since.Round(time.Millisecond), restartBackoff)
+	}
+
+	select {
+	case <-p.stop:
+		p.mu.Unlock()
+		return nil, fmt.Errorf("plugin %v is stopped", p.path)
+	default:
+	}
+
+	starting := make(chan struct{})
+	p.starting = starting
+	p.lastStart = time.Now()
+	logger := p.logger
+	onStart := p.onStart
+	p.mu.Unlock()
+
+	client, raw, err := p.start(logger, onStart)
+
+	p.mu.Lock()
+	p.starting = nil
+	p.startErr = err
+
+	// killed while starting
+	select {
+	case <-p.stop:
+		if err == nil {
+			client.Kill()
+			raw, err = nil, fmt.Errorf("plugin %v is stopped", p.path)
+			p.startErr = err
+		}
+	default:
+		if err == nil {
+			p.client = client
+			p.raw = raw
+		}
+	}
+	p.mu.Unlock()
+
+	close(starting)
+
+	return raw, err
+}
+
+// start starts the binary and dispenses its client
+func (p *process) start(logger logging.Logger, onStart func(raw interface{}) error) (*goplugin.Client, interface{}, error) {
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig:  Handshake,
+		Plugins:          map[string]goplugin.Plugin{p.kind: clientPlugins[p.kind]},
+		Cmd:              exec.Command(p.path),
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolGRPC},
+		Managed:          true,
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:        p.kind + "." + p.name,
+			Level:       hclog.Debug,
+			Output:      &hclogWriter{logger},
+			DisableTime: true,
+		}),
+	})
+
+	rpc, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, nil, fmt.Errorf("failed to start plugin %v: %v", p.path, err)
+	}
+
+	raw, err := rpc.Dispense(p.kind)
+	if err != nil {
+		client.Kill()
+		return nil, nil, fmt.Errorf("plugin %v does not provide %v: %v", p.path, p.kind, err)
+	}
+
+	if onStart != nil {
+		if err := onStart(raw); err != nil {
+			client.Kill()
+			return nil, nil, err
+		}
+	}
+
+	logger.Printf("plugin %v started", p.path)
+
+	return client, raw, nil
+}
+
+// restart kills the binary behind raw if it is still in use, the next dispense starts a new one
+// called when raw is found unavailable before go-plugin notices the binary exited
+func (p *process) restart(raw interface{}, reason error) {
+	p.mu.Lock()
+	if p.client == nil || p.raw != raw {
+		p.mu.Unlock()
+		return
+	}
+
+	client := p.client
+	logger := p.logger
+	p.client = nil
+	p.raw = nil
+	p.mu.Unlock()
+
+	logger.Errorf("plugin %v unavailable, restarting: %v", p.path, reason)
+	client.Kill()
+}
+
+// check restarts the binary behind raw if err shows it is unavailable, err is returned as is
+func (p *process) check(raw interface{}, err error) error {
+	if status.Code(err) == codes.Unavailable {
+		p.restart(raw, err)
+	}
+
+	return err
+}
+
+// call calls fn with the client of the plugin
+// if the plugin is unavailable, e.g. crashed, it is restarted and fn is retried once
+func (p *process) call(fn func(raw interface{}) error) error {
+	for retried := false; ; retried = true {
+		raw, err := p.dispense()
+		if err != nil {
+			return err
+		}
+
+		err = p.check(raw, fn(raw))
+		if retried || err == nil {
+			return err
+		}
+
+		// retry if the plugin was restarted, by this call or a concurrent one
+		p.mu.Lock()
+		restarted := p.raw != raw
+		p.mu.Unlock()
+
+		if !restarted {
+			return err
+		}
+	}
+}
+
+// ping returns error if the plugin is not running or not responding
+func (p *process) ping() error {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+
+	if client == nil || client.Exited() {
+		return fmt.Errorf("plugin %v is not running", p.path)
+	}
+
+	rpc, err := client.Client()
+	if err != nil {
+		return err
+	}
+
+	return rpc.Ping()
+}
+
+// supervise restarts the binary if it crashed or stopped responding
+func (p *process) supervise() {
+	t := time.NewTicker(superviseInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+
+		if err := p.ping(); err != nil {
+			p.mu.Lock()
+			raw := p.raw
+			logger := p.logger
+			p.mu.Unlock()
+
+			p.restart(raw, err)
+
+			if _, err := p.dispense(); err != nil {
+				logger.Errorf("failed to restart plugin %v: %v", p.path, err)
+			}
+		}
+	}
+}
+
+func (p *process) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+
+	if p.client != nil {
+		p.client.Kill()
+		p.client = nil
+		p.raw = nil
+	}
+}
+
+// hclogWriter writes logs of go-plugin and stderr of plugins to logger
+type hclogWriter struct {
+	logger logging.Logger
+}
+
+func (w *hclogWriter) Write(b []byte) (int, error) {
+	msg := string(bytes.TrimSpace(b))
+
+	switch {
+	case bytes.Contains(b, []byte("[ERROR]")):
+		w.logger.Errorf("%v", msg)
+	case bytes.Contains(b, []byte("[WARN]")):
+		w.logger.Warnf("%v", msg)
+	case bytes.Contains(b, []byte("[INFO]")):
+		w.logger.Infof("%v", msg)
+	default:
+		w.logger.Debugf("%v", msg)
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,671 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// UpstreamClient is the client API for Upstream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UpstreamClient interface {
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	// FindUpstream returns where to dial for the downstream, an error status refuses the connection
+	FindUpstream(ctx context.Context, in *FindUpstreamRequest, opts ...grpc.CallOption) (*FindUpstreamResponse, error)
+	// MapPassword is called for password auth if map_password is set in FindUpstreamResponse
+	MapPassword(ctx context.Context, in *MapPasswordRequest, opts ...grpc.CallOption) (*AuthMapping, error)
+	// MapPublicKey is called for publickey auth if map_public_key is set in FindUpstreamResponse
+	MapPublicKey(ctx context.Context, in *MapPublicKeyRequest, opts ...grpc.CallOption) (*AuthMapping, error)
+	ListPipe(ctx context.Context, in *ListPipeRequest, opts ...grpc.CallOption) (*ListPipeResponse, error)
+	CreatePipe(ctx context.Context, in *CreatePipeRequest, opts ...grpc.CallOption) (*CreatePipeResponse, error)
+	RemovePipe(ctx context.Context, in *RemovePipeRequest, opts ...grpc.CallOption) (*RemovePipeResponse, error)
+	// HealthCheck returns an error status if the upstream is not ready, e.g. its database is unreachable
+	HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error)
+}
+
+type upstreamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUpstreamClient(cc grpc.ClientConnInterface) UpstreamClient {
+	return &upstreamClient{cc}
+}
+
+func (c *upstreamClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	out := new(InitResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/Init", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) FindUpstream(ctx context.Context, in *FindUpstreamRequest, opts ...grpc.CallOption) (*FindUpstreamResponse, error) {
+	out := new(FindUpstreamResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/FindUpstream", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) MapPassword(ctx context.Context, in *MapPasswordRequest, opts ...grpc.CallOption) (*AuthMapping, error) {
+	out := new(AuthMapping)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/MapPassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) MapPublicKey(ctx context.Context, in *MapPublicKeyRequest, opts ...grpc.CallOption) (*AuthMapping, error) {
+	out := new(AuthMapping)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/MapPublicKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) ListPipe(ctx context.Context, in *ListPipeRequest, opts ...grpc.CallOption) (*ListPipeResponse, error) {
+	out := new(ListPipeResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/ListPipe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) CreatePipe(ctx context.Context, in *CreatePipeRequest, opts ...grpc.CallOption) (*CreatePipeResponse, error) {
+	out := new(CreatePipeResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/CreatePipe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) RemovePipe(ctx context.Context, in *RemovePipeRequest, opts ...grpc.CallOption) (*RemovePipeResponse, error) {
+	out := new(RemovePipeResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/RemovePipe", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upstreamClient) HealthCheck(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error) {
+	out := new(HealthCheckResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Upstream/HealthCheck", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpstreamServer is the server API for Upstream service.
+// All implementations must embed UnimplementedUpstreamServer
+// for forward compatibility
+type UpstreamServer interface {
+	Init(context.Context, *InitRequest) (*InitResponse, error)
+	// FindUpstream returns where to dial for the downstream, an error status refuses the connection
+	FindUpstream(context.Context, *FindUpstreamRequest) (*FindUpstreamResponse, error)
+	// MapPassword is called for password auth if map_password is set in FindUpstreamResponse
+	MapPassword(context.Context, *MapPasswordRequest) (*AuthMapping, error)
+	// MapPublicKey is called for publickey auth if map_public_key is set in FindUpstreamResponse
+	MapPublicKey(context.Context, *MapPublicKeyRequest) (*AuthMapping, error)
+	ListPipe(context.Context, *ListPipeRequest) (*ListPipeResponse, error)
+	CreatePipe(context.Context, *CreatePipeRequest) (*CreatePipeResponse, error)
+	RemovePipe(context.Context, *RemovePipeRequest) (*RemovePipeResponse, error)
+	// HealthCheck returns an error status if the upstream is not ready, e.g. its database is unreachable
+	HealthCheck(context.Context, *HealthCheckRequest) (*HealthCheckResponse, error)
+	mustEmbedUnimplementedUpstreamServer()
+}
+
+// UnimplementedUpstreamServer must be embedded to have forward compatible implementations.
+type UnimplementedUpstreamServer struct {
+}
+
+func (UnimplementedUpstreamServer) Init(context.Context, *InitRequest) (*InitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Init not implemented")
+}
+func (UnimplementedUpstreamServer) FindUpstream(context.Context, *FindUpstreamRequest) (*FindUpstreamResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindUpstream not implemented")
+}
+func (UnimplementedUpstreamServer) MapPassword(context.Context, *MapPasswordRequest) (*AuthMapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MapPassword not implemented")
+}
+func (UnimplementedUpstreamServer) MapPublicKey(context.Context, *MapPublicKeyRequest) (*AuthMapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MapPublicKey not implemented")
+}
+func (UnimplementedUpstreamServer) ListPipe(context.Context, *ListPipeRequest) (*ListPipeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPipe not implemented")
+}
+func (UnimplementedUpstreamServer) CreatePipe(context.Context, *CreatePipeRequest) (*CreatePipeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreatePipe not implemented")
+}
+func (UnimplementedUpstreamServer) RemovePipe(context.Context, *RemovePipeRequest) (*RemovePipeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemovePipe not implemented")
+}
+func (UnimplementedUpstreamServer) HealthCheck(context.Context, *HealthCheckRequest) (*HealthCheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HealthCheck not implemented")
+}
+func (UnimplementedUpstreamServer) mustEmbedUnimplementedUpstreamServer() {}
+
+// UnsafeUpstreamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UpstreamServer will
+// result in compilation errors.
+type UnsafeUpstreamServer interface {
+	mustEmbedUnimplementedUpstreamServer()
+}
+
+func RegisterUpstreamServer(s grpc.ServiceRegistrar, srv UpstreamServer) {
+	s.RegisterService(&_Upstream_serviceDesc, srv)
+}
+
+func _Upstream_Init_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).Init(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/Init",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).Init(ctx, req.(*InitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_FindUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FindUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).FindUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/FindUpstream",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).FindUpstream(ctx, req.(*FindUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_MapPassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MapPasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).MapPassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/MapPassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).MapPassword(ctx, req.(*MapPasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_MapPublicKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MapPublicKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).MapPublicKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/MapPublicKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).MapPublicKey(ctx, req.(*MapPublicKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_ListPipe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPipeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).ListPipe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/ListPipe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).ListPipe(ctx, req.(*ListPipeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_CreatePipe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreatePipeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).CreatePipe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/CreatePipe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).CreatePipe(ctx, req.(*CreatePipeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_RemovePipe_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemovePipeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).RemovePipe(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/RemovePipe",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).RemovePipe(ctx, req.(*RemovePipeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upstream_HealthCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServer).HealthCheck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Upstream/HealthCheck",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServer).HealthCheck(ctx, req.(*HealthCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Upstream_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "sshpiper.plugin.v1.Upstream",
+	HandlerType: (*UpstreamServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Init",
+			Handler:    _Upstream_Init_Handler,
+		},
+		{
+			MethodName: "FindUpstream",
+			Handler:    _Upstream_FindUpstream_Handler,
+		},
+		{
+			MethodName: "MapPassword",
+			Handler:    _Upstream_MapPassword_Handler,
+		},
+		{
+			MethodName: "MapPublicKey",
+			Handler:    _Upstream_MapPublicKey_Handler,
+		},
+		{
+			MethodName: "ListPipe",
+			Handler:    _Upstream_ListPipe_Handler,
+		},
+		{
+			MethodName: "CreatePipe",
+			Handler:    _Upstream_CreatePipe_Handler,
+		},
+		{
+			MethodName: "RemovePipe",
+			Handler:    _Upstream_RemovePipe_Handler,
+		},
+		{
+			MethodName: "HealthCheck",
+			Handler:    _Upstream_HealthCheck_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "plugin.proto",
+}
+
+// ChallengerClient is the client API for Challenger service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChallengerClient interface {
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	// Challenge starts with conn from sshpiperd, plugin asks questions and
+	// finishes with result, an error status fails the challenge
+	Challenge(ctx context.Context, opts ...grpc.CallOption) (Challenger_ChallengeClient, error)
+}
+
+type challengerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChallengerClient(cc grpc.ClientConnInterface) ChallengerClient {
+	return &challengerClient{cc}
+}
+
+func (c *challengerClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	out := new(InitResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Challenger/Init", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *challengerClient) Challenge(ctx context.Context, opts ...grpc.CallOption) (Challenger_ChallengeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Challenger_serviceDesc.Streams[0], "/sshpiper.plugin.v1.Challenger/Challenge", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &challengerChallengeClient{stream}
+	return x, nil
+}
+
+type Challenger_ChallengeClient interface {
+	Send(*ChallengeRequest) error
+	Recv() (*ChallengeResponse, error)
+	grpc.ClientStream
+}
+
+type challengerChallengeClient struct {
+	grpc.ClientStream
+}
+
+func (x *challengerChallengeClient) Send(m *ChallengeRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *challengerChallengeClient) Recv() (*ChallengeResponse, error) {
+	m := new(ChallengeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ChallengerServer is the server API for Challenger service.
+// All implementations must embed UnimplementedChallengerServer
+// for forward compatibility
+type ChallengerServer interface {
+	Init(context.Context, *InitRequest) (*InitResponse, error)
+	// Challenge starts with conn from sshpiperd, plugin asks questions and
+	// finishes with result, an error status fails the challenge
+	Challenge(Challenger_ChallengeServer) error
+	mustEmbedUnimplementedChallengerServer()
+}
+
+// UnimplementedChallengerServer must be embedded to have forward compatible implementations.
+type UnimplementedChallengerServer struct {
+}
+
+func (UnimplementedChallengerServer) Init(context.Context, *InitRequest) (*InitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Init not implemented")
+}
+func (UnimplementedChallengerServer) Challenge(Challenger_ChallengeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Challenge not implemented")
+}
+func (UnimplementedChallengerServer) mustEmbedUnimplementedChallengerServer() {}
+
+// UnsafeChallengerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChallengerServer will
+// result in compilation errors.
+type UnsafeChallengerServer interface {
+	mustEmbedUnimplementedChallengerServer()
+}
+
+func RegisterChallengerServer(s grpc.ServiceRegistrar, srv ChallengerServer) {
+	s.RegisterService(&_Challenger_serviceDesc, srv)
+}
+
+func _Challenger_Init_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChallengerServer).Init(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Challenger/Init",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChallengerServer).Init(ctx, req.(*InitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Challenger_Challenge_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ChallengerServer).Challenge(&challengerChallengeServer{stream})
+}
+
+type Challenger_ChallengeServer interface {
+	Send(*ChallengeResponse) error
+	Recv() (*ChallengeRequest, error)
+	grpc.ServerStream
+}
+
+type challengerChallengeServer struct {
+	grpc.ServerStream
+}
+
+func (x *challengerChallengeServer) Send(m *ChallengeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *challengerChallengeServer) Recv() (*ChallengeRequest, error) {
+	m := new(ChallengeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Challenger_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "sshpiper.plugin.v1.Challenger",
+	HandlerType: (*ChallengerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Init",
+			Handler:    _Challenger_Init_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Challenge",
+			Handler:       _Challenger_Challenge_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "plugin.proto",
+}
+
+// AuditorClient is the client API for Auditor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AuditorClient interface {
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	// Audit is a stream per pipe, starts with conn from sshpiperd, plugin
+	// replies an empty response when ready, then one response per message
+	// an error status closes the pipe
+	Audit(ctx context.Context, opts ...grpc.CallOption) (Auditor_AuditClient, error)
+}
+
+type auditorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuditorClient(cc grpc.ClientConnInterface) AuditorClient {
+	return &auditorClient{cc}
+}
+
+func (c *auditorClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	out := new(InitResponse)
+	err := c.cc.Invoke(ctx, "/sshpiper.plugin.v1.Auditor/Init", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *auditorClient) Audit(ctx context.Context, opts ...grpc.CallOption) (Auditor_AuditClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Auditor_serviceDesc.Streams[0], "/sshpiper.plugin.v1.Auditor/Audit", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &auditorAuditClient{stream}
+	return x, nil
+}
+
+type Auditor_AuditClient interface {
+	Send(*AuditRequest) error
+	Recv() (*AuditResponse, error)
+	grpc.ClientStream
+}
+
+type auditorAuditClient struct {
+	grpc.ClientStream
+}
+
+func (x *auditorAuditClient) Send(m *AuditRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *auditorAuditClient) Recv() (*AuditResponse, error) {
+	m := new(AuditResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AuditorServer is the server API for Auditor service.
+// All implementations must embed UnimplementedAuditorServer
+// for forward compatibility
+type AuditorServer interface {
+	Init(context.Context, *InitRequest) (*InitResponse, error)
+	// Audit is a stream per pipe, starts with conn from sshpiperd, plugin
+	// replies an empty response when ready, then one response per message
+	// an error status closes the pipe
+	Audit(Auditor_AuditServer) error
+	mustEmbedUnimplementedAuditorServer()
+}
+
+// UnimplementedAuditorServer must be embedded to have forward compatible implementations.
+type UnimplementedAuditorServer struct {
+}
+
+func (UnimplementedAuditorServer) Init(context.Context, *InitRequest) (*InitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Init not implemented")
+}
+func (UnimplementedAuditorServer) Audit(Auditor_AuditServer) error {
+	return status.Errorf(codes.Unimplemented, "method Audit not implemented")
+}
+func (UnimplementedAuditorServer) mustEmbedUnimplementedAuditorServer() {}
+
+// UnsafeAuditorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AuditorServer will
+// result in compilation errors.
+type UnsafeAuditorServer interface {
+	mustEmbedUnimplementedAuditorServer()
+}
+
+func RegisterAuditorServer(s grpc.ServiceRegistrar, srv AuditorServer) {
+	s.RegisterService(&_Auditor_serviceDesc, srv)
+}
+
+func _Auditor_Init_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuditorServer).Init(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sshpiper.plugin.v1.Auditor/Init",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuditorServer).Init(ctx, req.(*InitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Auditor_Audit_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AuditorServer).Audit(&auditorAuditServer{stream})
+}
+
+type Auditor_AuditServer interface {
+	Send(*AuditResponse) error
+	Recv() (*AuditRequest, error)
+	grpc.ServerStream
+}
+
+type auditorAuditServer struct {
+	grpc.ServerStream
+}
+
+func (x *auditorAuditServer) Send(m *AuditResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *auditorAuditServer) Recv() (*AuditRequest, error) {
+	m := new(AuditRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Auditor_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "sshpiper.plugin.v1.Auditor",
+	HandlerType: (*AuditorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Init",
+			Handler:    _Auditor_Init_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Audit",
+			Handler:       _Auditor_Audit_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "plugin.proto",
+}
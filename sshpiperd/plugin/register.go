@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/auditor"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+var (
+	processesMu sync.Mutex
+	processes   []*process
+)
+
+// parseSpec parses kind.name=path
+func parseSpec(spec string) (kind, name, path string, err error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", "", fmt.Errorf("bad plugin %q, expect kind.name=path", spec)
+	}
+
+	path = parts[1]
+
+	parts = strings.SplitN(parts[0], ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", "", fmt.Errorf("bad plugin %q, expect kind.name=path", spec)
+	}
+
+	kind, name = parts[0], parts[1]
+
+	if _, ok := clientPlugins[kind]; !ok {
+		return "", "", "", fmt.Errorf("unknown plugin kind %v, must be one of upstream, challenger and auditor", kind)
+	}
+
+	return kind, name, path, nil
+}
+
+// Register adds the plugin binary as a driver to registry of its kind
+// spec is kind.name=path, e.g. upstream.mydriver=/usr/lib/sshpiperd/mydriver
+// the binary is started when the driver is initialized, unary rpcs fail after timeout if not 0
+func Register(spec string, timeout time.Duration) error {
+	kind, name, path, err := parseSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	path, err = exec.LookPath(path)
+	if err != nil {
+		return fmt.Errorf("plugin %v not found: %v", spec, err)
+	}
+
+	p := newProcess(kind, name, path, timeout)
+
+	switch kind {
+	case KindUpstream:
+		if upstream.Get(name) != nil {
+			return fmt.Errorf("upstream driver %v already exists", name)
+		}
+
+		upstream.Register(name, &upstreamPlugin{p})
+	case KindChallenger:
+		if challenger.Get(name) != nil {
+			return fmt.Errorf("challenger driver %v already exists", name)
+		}
+
+		challenger.Register(name, &challengerPlugin{p})
+	case KindAuditor:
+		if auditor.Get(name) != nil {
+			return fmt.Errorf("auditor driver %v already exists", name)
+		}
+
+		auditor.Register(name, &auditorPlugin{p})
+	}
+
+	processesMu.Lock()
+	defer processesMu.Unlock()
+
+	processes = append(processes, p)
+
+	return nil
+}
+
+// Cleanup stops all plugin binaries
+func Cleanup() {
+	processesMu.Lock()
+	defer processesMu.Unlock()
+
+	for _, p := range processes {
+		p.kill()
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/plugin/proto"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// upstreamPlugin is upstream.Provider backed by a plugin binary
+type upstreamPlugin struct {
+	*process
+}
+
+func (p *upstreamPlugin) GetName() string {
+	return p.name
+}
+
+func (p *upstreamPlugin) GetOpts() interface{} {
+	return nil
+}
+
+func (p *upstreamPlugin) Init(logger logging.Logger) error {
+	return p.init(logger, func(raw interface{}) error {
+		ctx, cancel := p.rpcContext()
+		defer cancel()
+
+		_, err := raw.(proto.UpstreamClient).Init(ctx, &proto.InitRequest{})
+		return err
+	})
+}
+
+// call calls fn with the client of the plugin, see process.call
+func (p *upstreamPlugin) call(fn func(c proto.UpstreamClient, ctx context.Context) error) error {
+	return p.process.call(func(raw interface{}) error {
+		ctx, cancel := p.rpcContext()
+		defer cancel()
+
+		return fn(raw.(proto.UpstreamClient), ctx)
+	})
+}
+
+func (p *upstreamPlugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+func (p *upstreamPlugin) findUpstream(conn ssh.ConnMetadata, challengeCtx ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	meta := toConnMeta(conn)
+
+	var c proto.UpstreamClient
+	var resp *proto.FindUpstreamResponse
+
+	err := p.call(func(client proto.UpstreamClient, ctx context.Context) (err error) {
+		c = client
+		resp, err = c.FindUpstream(ctx, &proto.FindUpstreamRequest{
+			Conn:      meta,
+			Challenge: toChallengeContext(challengeCtx),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case resp.IgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case len(resp.HostKey) > 0:
+		key, _, _, _, err := ssh.ParseAuthorizedKey(resp.HostKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad upstream host key from plugin: %v", err)
+		}
+
+		hostKeyCallback = ssh.FixedHostKey(key)
+	default:
+		return nil, nil, fmt.Errorf("plugin %v returned no upstream host key, set ignore_host_key to accept any", p.path)
+	}
+
+	pipe := &ssh.AuthPipe{
+		User:                    resp.User,
+		UpstreamHostKeyCallback: hostKeyCallback,
+	}
+
+	if resp.MapPassword {
+		pipe.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			ctx, cancel := p.rpcContext()
+			defer cancel()
+
+			m, err := c.MapPassword(ctx, &proto.MapPasswordRequest{
+				Conn:     meta,
+				Password: password,
+				Context:  resp.Context,
+			})
+			if err != nil {
+				return ssh.AuthPipeTypeDiscard, nil, p.check(c, err)
+			}
+
+			return fromAuthMapping(m)
+		}
+	}
+
+	if resp.MapPublicKey {
+		pipe.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			ctx, cancel := p.rpcContext()
+			defer cancel()
+
+			m, err := c.MapPublicKey(ctx, &proto.MapPublicKeyRequest{
+				Conn:      meta,
+				PublicKey: key.Marshal(),
+				Context:   resp.Context,
+			})
+			if err != nil {
+				return ssh.AuthPipeTypeDiscard, nil, p.check(c, err)
+			}
+
+			return fromAuthMapping(m)
+		}
+	}
+
+	upconn, err := upstream.DialForSSH(resp.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return upconn, pipe, nil
+}
+
+func fromAuthMapping(m *proto.AuthMapping) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+	switch m.Type {
+	case proto.AuthMapping_PASS_THROUGH:
+		return ssh.AuthPipeTypePassThrough, nil, nil
+	case proto.AuthMapping_DISCARD:
+		return ssh.AuthPipeTypeDiscard, nil, nil
+	case proto.AuthMapping_NONE:
+		return ssh.AuthPipeTypeNone, nil, nil
+	case proto.AuthMapping_MAP:
+		if len(m.PrivateKey) > 0 {
+			signer, err := ssh.ParsePrivateKey(m.PrivateKey)
+			if err != nil {
+				return ssh.AuthPipeTypeNone, nil, fmt.Errorf("bad private key from plugin: %v", err)
+			}
+
+			return ssh.AuthPipeTypeMap, ssh.PublicKeys(signer), nil
+		}
+
+		return ssh.AuthPipeTypeMap, ssh.Password(string(m.Password)), nil
+	}
+
+	return ssh.AuthPipeTypeNone, nil, fmt.Errorf("unknown auth mapping type %v from plugin", m.Type)
+}
+
+func (p *upstreamPlugin) ListPipe() ([]upstream.Pipe, error) {
+	var resp *proto.ListPipeResponse
+
+	err := p.call(func(c proto.UpstreamClient, ctx context.Context) (err error) {
+		resp, err = c.ListPipe(ctx, &proto.ListPipeRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pipes []upstream.Pipe
+	for _, pipe := range resp.Pipes {
+		pipes = append(pipes, upstream.Pipe{
+			Username:         pipe.Username,
+			UpstreamUsername: pipe.UpstreamUsername,
+			Host:             pipe.Host,
+			Port:             int(pipe.Port),
+		})
+	}
+
+	return pipes, nil
+}
+
+func (p *upstreamPlugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return p.call(func(c proto.UpstreamClient, ctx context.Context) error {
+		_, err := c.CreatePipe(ctx, &proto.CreatePipeRequest{
+			Pipe: &proto.Pipe{
+				Username:         opt.Username,
+				UpstreamUsername: opt.UpstreamUsername,
+				Host:             opt.Host,
+				Port:             int32(opt.Port),
+				HostKey:          opt.HostKey,
+				IgnoreHostKey:    opt.IgnoreHostKey,
+			},
+		})
+		return err
+	})
+}
+
+func (p *upstreamPlugin) RemovePipe(name string) error {
+	return p.call(func(c proto.UpstreamClient, ctx context.Context) error {
+		_, err := c.RemovePipe(ctx, &proto.RemovePipeRequest{Username: name})
+		return err
+	})
+}
+
+// HealthCheck checks the binary is alive and the plugin is ready
+// the binary is restarted if it is not responding
+func (p *upstreamPlugin) HealthCheck() error {
+	if err := p.ping(); err != nil {
+		p.mu.Lock()
+		raw := p.raw
+		p.mu.Unlock()
+
+		p.restart(raw, err)
+		return err
+	}
+
+	return p.call(func(c proto.UpstreamClient, ctx context.Context) error {
+		_, err := c.HealthCheck(ctx, &proto.HealthCheckRequest{})
+
+		// health check is optional for plugins
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// PROXY protocol, see https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// max length of v1 header including CRLF
+	proxyProtoV1MaxLen = 107
+
+	proxyProtoV2CmdLocal = 0x0
+	proxyProtoV2CmdProxy = 0x1
+
+	proxyProtoV2FamTCP4 = 0x11
+	proxyProtoV2FamTCP6 = 0x21
+)
+
+// proxyProtoConn is a net.Conn with addresses from PROXY protocol header
+type proxyProtoConn struct {
+	net.Conn
+
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// parseCIDRs parses a list of comma separated CIDRs, same syntax as source acls of pipes
+func parseCIDRs(opts []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range strings.Split(strings.Join(opts, ","), ",") {
+		if strings.TrimSpace(cidr) == "" {
+			continue
+		}
+
+		n, err := upstream.ParseNetwork(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// addrIP returns the ip of addr, nil if addr has no ip
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	default:
+		if addr == nil {
+			return nil
+		}
+
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+
+		return net.ParseIP(host)
+	}
+}
+
+// addrInNets returns true if the ip of addr is inside one of nets
+func addrInNets(addr net.Addr, nets []*net.IPNet) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readProxyProtoHeader reads PROXY protocol v1 or v2 header from conn
+// the returned conn reports the addresses of the real client
+func readProxyProtoHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	pconn := &proxyProtoConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	sig, err := pconn.r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtoV2Sig) {
+		err = pconn.readV2()
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		err = pconn.readV1()
+	} else {
+		err = fmt.Errorf("proxy protocol header not found")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pconn, nil
+}
+
+func (c *proxyProtoConn) readV1() error {
+	var line []byte
+
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= proxyProtoV1MaxLen {
+			return fmt.Errorf("proxy protocol v1 header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("proxy protocol v1 header not ended with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) < 2 {
+		return fmt.Errorf("bad proxy protocol v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// keep addresses of the conn
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("unsupported proxy protocol v1 protocol %v", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return fmt.Errorf("bad proxy protocol v1 header")
+	}
+
+	src, err := parseProxyProtoV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	dst, err := parseProxyProtoV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	c.remote = src
+	c.local = dst
+
+	return nil
+}
+
+func parseProxyProtoV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bad proxy protocol v1 address %v", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy protocol v1 port %v", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func (c *proxyProtoConn) readV2() error {
+	header := make([]byte, len(proxyProtoV2Sig)+4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+
+	verCmd := header[12]
+	fam := header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("unsupported proxy protocol version %v", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch verCmd & 0xf {
+	case proxyProtoV2CmdLocal:
+		// health check from proxy, keep addresses of the conn
+		return nil
+	case proxyProtoV2CmdProxy:
+	default:
+		return fmt.Errorf("unsupported proxy protocol v2 command %v", verCmd&0xf)
+	}
+
+	var iplen int
+
+	switch fam {
+	case proxyProtoV2FamTCP4:
+		iplen = net.IPv4len
+	case proxyProtoV2FamTCP6:
+		iplen = net.IPv6len
+	default:
+		// unspec or unix socket, keep addresses of the conn
+		return nil
+	}
+
+	if len(payload) < iplen*2+4 {
+		return fmt.Errorf("proxy protocol v2 address too short")
+	}
+
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:iplen]),
+		Port: int(binary.BigEndian.Uint16(payload[iplen*2:])),
+	}
+
+	c.local = &net.TCPAddr{
+		IP:   net.IP(payload[iplen : iplen*2]),
+		Port: int(binary.BigEndian.Uint16(payload[iplen*2+2:])),
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func testProxyProtoHeader(t *testing.T, header []byte) (net.Conn, error) {
+	server, client := net.Pipe()
+
+	go func() {
+		client.Write(header)
+		client.Write([]byte("SSH-2.0-test"))
+		client.Close()
+	}()
+
+	c, err := readProxyProtoHeader(server, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	rest, _ := ioutil.ReadAll(c)
+	if string(rest) != "SSH-2.0-test" {
+		t.Errorf("data after header should be kept, got %q", rest)
+	}
+
+	return c, nil
+}
+
+func TestProxyProtoV1(t *testing.T) {
+	c, err := testProxyProtoHeader(t, []byte("PROXY TCP4 192.168.0.1 10.0.0.5 56324 2222\r\n"))
+	if err != nil {
+		t.Fatalf("read header failed %v", err)
+	}
+
+	if c.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Errorf("wrong remote addr %v", c.RemoteAddr())
+	}
+
+	if c.LocalAddr().String() != "10.0.0.5:2222" {
+		t.Errorf("wrong local addr %v", c.LocalAddr())
+	}
+
+	c, err = testProxyProtoHeader(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"))
+	if err != nil {
+		t.Fatalf("read header failed %v", err)
+	}
+
+	if c.RemoteAddr().String() != "[2001:db8::1]:56324" {
+		t.Errorf("wrong remote addr %v", c.RemoteAddr())
+	}
+
+	// unknown keeps conn address
+	c, err = testProxyProtoHeader(t, []byte("PROXY UNKNOWN\r\n"))
+	if err != nil {
+		t.Fatalf("read header failed %v", err)
+	}
+
+	if c.RemoteAddr().String() != "pipe" {
+		t.Errorf("wrong remote addr %v", c.RemoteAddr())
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 192.168.0.1 10.0.0.5 56324\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.5 56324 99999\r\n",
+		"PROXY TCP4 bad 10.0.0.5 56324 2222\r\n",
+		"PROXY UDP4 192.168.0.1 10.0.0.5 56324 2222\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.5 56324 2222\n",
+		"SSH-2.0-OpenSSH_8.4\r\n",
+	} {
+		if _, err := testProxyProtoHeader(t, []byte(bad)); err == nil {
+			t.Errorf("should fail with header %q", bad)
+		}
+	}
+}
+
+func proxyProtoV2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte{}, proxyProtoV2Sig...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestProxyProtoV2(t *testing.T) {
+	addrs := []byte{192, 168, 0, 1, 10, 0, 0, 5, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(addrs[8:], 56324)
+	binary.BigEndian.PutUint16(addrs[10:], 2222)
+
+	c, err := testProxyProtoHeader(t, proxyProtoV2Header(proxyProtoV2CmdProxy, proxyProtoV2FamTCP4, addrs))
+	if err != nil {
+		t.Fatalf("read header failed %v", err)
+	}
+
+	if c.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Errorf("wrong remote addr %v", c.RemoteAddr())
+	}
+
+	if c.LocalAddr().String() != "10.0.0.5:2222" {
+		t.Errorf("wrong local addr %v", c.LocalAddr())
+	}
+
+	// local command keeps conn address
+	c, err = testProxyProtoHeader(t, proxyProtoV2Header(proxyProtoV2CmdLocal, 0, nil))
+	if err != nil {
+		t.Fatalf("read header failed %v", err)
+	}
+
+	if c.RemoteAddr().String() != "pipe" {
+		t.Errorf("wrong remote addr %v", c.RemoteAddr())
+	}
+
+	// too short
+	if _, err := testProxyProtoHeader(t, proxyProtoV2Header(proxyProtoV2CmdProxy, proxyProtoV2FamTCP6, addrs)); err == nil {
+		t.Errorf("should fail with short address")
+	}
+}
+
+func Test_addrInNets(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8,192.168.1.1", " 2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("parse failed %v", err)
+	}
+
+	for addr, expect := range map[string]bool{
+		"10.1.2.3:22":      true,
+		"192.168.1.1:22":   true,
+		"192.168.1.2:22":   false,
+		"[2001:db8::1]:22": true,
+		"[2001:db9::1]:22": false,
+		"172.16.0.1:2222":  false,
+	} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+
+		if addrInNets(a, nets) != expect {
+			t.Errorf("%v in nets should be %v", addr, expect)
+		}
+	}
+
+	if _, err := parseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("should fail with bad cidr")
+	}
+
+	if _, err := parseCIDRs([]string{"not ip"}); err == nil {
+		t.Errorf("should fail with bad ip")
+	}
+}
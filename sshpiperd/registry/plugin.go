@@ -1,7 +1,7 @@
 package registry
 
 import (
-	"log"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 // Plugin is to be registered with sshpiper to provide additional functions
@@ -15,5 +15,5 @@ type Plugin interface {
 	GetOpts() interface{}
 
 	// Will be called before the Plugin is used to ensure the Plugin is ready
-	Init(logger *log.Logger) error
+	Init(logger logging.Logger) error
 }
@@ -1,9 +1,10 @@
 package registry
 
 import (
-	"log"
 	"reflect"
 	"testing"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
 type testplugin struct {
@@ -18,7 +19,7 @@ func (p *testplugin) GetOpts() interface{} {
 	return nil
 }
 
-func (p *testplugin) Init(logger *log.Logger) error {
+func (p *testplugin) Init(logger logging.Logger) error {
 	return nil
 }
 
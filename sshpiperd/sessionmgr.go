@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tg123/sshpiper/libpiper"
+)
+
+func createSessionMgr(load func() (*adminClient, error)) interface{} {
+	// session management
+	sessionMgrCmd := struct {
+		List struct {
+			subCommand
+		} `command:"list" description:"list active pipes"`
+		Show struct {
+			subCommand
+		} `command:"show" description:"show details of pipes, e.g. sshpiperd session show <id>"`
+		Kill struct {
+			subCommand
+		} `command:"kill" description:"close pipes, e.g. sshpiperd session kill <id>"`
+	}{}
+
+	sessionMgrCmd.List.callback = func(args []string) error {
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		var sessions []libpiper.ConnInfo
+		if err := c.call(http.MethodGet, "/sessions", nil, nil, &sessions); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tREMOTE\tUPSTREAM\tSTART\tUP\tDOWN")
+
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v@%v\t%v\t%v\t%v\n", s.ID, s.User, s.RemoteAddr, s.UpstreamUser, s.Upstream, s.Start.Local().Format(time.RFC3339), s.BytesUp, s.BytesDown)
+		}
+
+		return w.Flush()
+	}
+
+	sessionMgrCmd.Show.callback = func(args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("no session id")
+		}
+
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range args {
+			var s libpiper.ConnInfo
+			if err := c.call(http.MethodGet, "/sessions/"+url.PathEscape(id), nil, nil, &s); err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "id:\t%v\n", s.ID)
+			fmt.Fprintf(w, "user:\t%v\n", s.User)
+			fmt.Fprintf(w, "remote address:\t%v\n", s.RemoteAddr)
+			fmt.Fprintf(w, "upstream:\t%v@%v\n", s.UpstreamUser, s.Upstream)
+			fmt.Fprintf(w, "challenger:\t%v\n", s.Challenger)
+			fmt.Fprintf(w, "challenged user:\t%v\n", s.ChallengedUser)
+			fmt.Fprintf(w, "start:\t%v (%v ago)\n", s.Start.Local().Format(time.RFC3339), time.Since(s.Start).Round(time.Second))
+			fmt.Fprintf(w, "bytes up:\t%v\n", s.BytesUp)
+			fmt.Fprintf(w, "bytes down:\t%v\n", s.BytesDown)
+			fmt.Fprintln(w)
+
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	sessionMgrCmd.Kill.callback = func(args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("no session id")
+		}
+
+		c, err := load()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range args {
+			if err := c.call(http.MethodDelete, "/sessions/"+url.PathEscape(id), nil, nil, nil); err != nil {
+				return err
+			}
+
+			fmt.Printf("session %v killed\n", id)
+		}
+
+		return nil
+	}
+
+	return &sessionMgrCmd
+}
@@ -1,28 +1,59 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
-	"log"
-
+	"github.com/tg123/sshpiper/libpiper"
 	"github.com/tg123/sshpiper/sshpiperd/auditor"
 	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/registry"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
 type piperdConfig struct {
-	ListenAddr     string        `short:"l" long:"listen" description:"Listening Address" default:"0.0.0.0" env:"SSHPIPERD_LISTENADDR" ini-name:"listen-address"`
-	Port           uint          `short:"p" long:"port" description:"Listening Port" default:"2222" env:"SSHPIPERD_PORT" ini-name:"listen-port"`
+	ListenAddr     []string      `short:"l" long:"listen" description:"Listening Address, can be repeated or comma separated, e.g. 0.0.0.0:2222,[::]:2222, 0.0.0.0 if not set. Ignored when activated by systemd socket" env:"SSHPIPERD_LISTENADDR" env-delim:"," ini-name:"listen-address"`
+	Port           uint          `short:"p" long:"port" description:"Listening Port, used when port is not specified in listening address" default:"2222" env:"SSHPIPERD_PORT" ini-name:"listen-port"`
 	PiperKeyFile   string        `short:"i" long:"server-key" description:"Server key file for SSH Piper" default:"/etc/ssh/ssh_host_rsa_key" env:"SSHPIPERD_SERVER_KEY" ini-name:"server-key"`
 	LoginGraceTime time.Duration `long:"login-grace-time" description:"Piper disconnects after this time if the pipe has not successfully established" default:"30s" env:"SSHPIPERD_LOGIN_GRACETIME" ini-name:"login-grace-time"`
 
+	DrainTimeout      time.Duration `long:"drain-timeout" description:"Time to wait for active pipes to finish after SIGTERM/SIGINT, the remaining pipes will be closed after that" default:"30s" env:"SSHPIPERD_DRAIN_TIMEOUT" ini-name:"drain-timeout"`
+	DisconnectMessage string        `long:"disconnect-message" description:"Message sent to downstream when its pipe is closed due to shutdown, empty for no message" env:"SSHPIPERD_DISCONNECT_MESSAGE" ini-name:"disconnect-message"`
+
+	ProxyProtocol        bool     `long:"proxy-protocol" description:"Read PROXY protocol v1/v2 header from connections of trusted sources to get the real client address" env:"SSHPIPERD_PROXY_PROTOCOL" ini-name:"proxy-protocol"`
+	ProxyProtocolTrusted []string `long:"proxy-protocol-trusted" description:"Trusted source CIDRs which must send PROXY protocol header, can be repeated or comma separated, empty for all sources" env:"SSHPIPERD_PROXY_PROTOCOL_TRUSTED" env-delim:"," ini-name:"proxy-protocol-trusted"`
+
+	MaxUnauthConns int     `long:"max-unauth-conns" description:"Max concurrent connections which have not established pipes, 0 for unlimited" default:"0" env:"SSHPIPERD_MAX_UNAUTH_CONNS" ini-name:"max-unauth-conns"`
+	MaxConnsPerIP  int     `long:"max-conns-per-ip" description:"Max concurrent connections from one source ip, 0 for unlimited" default:"0" env:"SSHPIPERD_MAX_CONNS_PER_IP" ini-name:"max-conns-per-ip"`
+	ConnRatePerIP  float64 `long:"conn-rate-per-ip" description:"Max new connections per second from one source ip, 0 for unlimited" default:"0" env:"SSHPIPERD_CONN_RATE_PER_IP" ini-name:"conn-rate-per-ip"`
+	ConnBurstPerIP int     `long:"conn-burst-per-ip" description:"Max new connections from one source ip in a burst when conn-rate-per-ip is set" default:"10" env:"SSHPIPERD_CONN_BURST_PER_IP" ini-name:"conn-burst-per-ip"`
+
+	BanThreshold int           `long:"ban-threshold" description:"Ban source ip and username after this many auth failures within ban-window, 0 for disabled" default:"0" env:"SSHPIPERD_BAN_THRESHOLD" ini-name:"ban-threshold"`
+	BanWindow    time.Duration `long:"ban-window" description:"Sliding window to count auth failures" default:"10m" env:"SSHPIPERD_BAN_WINDOW" ini-name:"ban-window"`
+	BanDuration  time.Duration `long:"ban-duration" description:"Time a source ip or username stays banned" default:"1h" env:"SSHPIPERD_BAN_DURATION" ini-name:"ban-duration"`
+	BanAllowlist []string      `long:"ban-allowlist" description:"Source CIDRs never banned, can be repeated or comma separated" env:"SSHPIPERD_BAN_ALLOWLIST" env-delim:"," ini-name:"ban-allowlist"`
+
+	AdminListen string `long:"admin-listen" description:"Listening address for admin api, unix:/path/to.sock or loopback host:port, empty for disabled" env:"SSHPIPERD_ADMIN_LISTEN" ini-name:"admin-listen"`
+
+	UpstreamCacheTTL         time.Duration `long:"upstream-cache-ttl" description:"Cache upstream lookups of drivers supporting cache for this long, 0 for disabled" default:"0" env:"SSHPIPERD_UPSTREAM_CACHE_TTL" ini-name:"upstream-cache-ttl"`
+	UpstreamCacheNegativeTTL time.Duration `long:"upstream-cache-negative-ttl" description:"Cache lookups of unknown users for this long, 0 for disabled" default:"0" env:"SSHPIPERD_UPSTREAM_CACHE_NEGATIVE_TTL" ini-name:"upstream-cache-negative-ttl"`
+	UpstreamCacheSize        int           `long:"upstream-cache-size" description:"Max cached lookups, least recently used ones are evicted, 0 for unlimited" default:"10000" env:"SSHPIPERD_UPSTREAM_CACHE_SIZE" ini-name:"upstream-cache-size"`
+	UpstreamCachePoll        time.Duration `long:"upstream-cache-poll-interval" description:"Check data behind the upstream driver this often and purge the cache when it changes, 0 for disabled" default:"0" env:"SSHPIPERD_UPSTREAM_CACHE_POLL_INTERVAL" ini-name:"upstream-cache-poll-interval"`
+
+	MetricsListen string `long:"metrics-listen" description:"Listening address for prometheus metrics on /metrics and health checks on /healthz and /readyz, e.g. 127.0.0.1:9090, empty for disabled" env:"SSHPIPERD_METRICS_LISTEN" ini-name:"metrics-listen"`
+
 	UpstreamDriver   string `short:"u" long:"upstream-driver" description:"Upstream provider driver" default:"workingdir" env:"SSHPIPERD_UPSTREAM_DRIVER" ini-name:"upstream-driver"`
 	ChallengerDriver string `short:"c" long:"challenger-driver" description:"Additional challenger name, e.g. pam, empty for no additional challenge" env:"SSHPIPERD_CHALLENGER" ini-name:"challenger-driver"`
 	AuditorDriver    string `long:"auditor-driver" description:"Auditor for ssh connections piped by SSH Piper" env:"SSHPIPERD_AUDITOR" ini-name:"auditor-driver"`
@@ -31,7 +62,7 @@ type piperdConfig struct {
 	BannerFile string `long:"banner-file" description:"Display a banner from file before authentication" env:"SSHPIPERD_BANNERFILE" ini-name:"banner-file" `
 }
 
-func getAndInstall(reg, name string, get func(n string) registry.Plugin, install func(plugin registry.Plugin) error, logger *log.Logger) error {
+func getAndInstall(reg, name string, get func(n string) registry.Plugin, install func(plugin registry.Plugin) error, logger logging.Logger) error {
 	if name == "" {
 		return nil
 	}
@@ -42,22 +73,21 @@ func getAndInstall(reg, name string, get func(n string) registry.Plugin, install
 		return fmt.Errorf("%v driver %v not found", reg, name)
 	}
 
-	err := p.Init(logger)
+	err := p.Init(logger.With(logging.Fields{"driver": name}))
 	if err != nil {
 		return err
 	}
 	return install(p)
 }
 
-func installDrivers(piper *ssh.PiperConfig, config *piperdConfig, logger *log.Logger) (auditor.Provider, error) {
+// installDrivers sets providers of opts from drivers in config
+func installDrivers(opts *libpiper.Options, config *piperdConfig, logger logging.Logger) error {
 
 	// install upstreamProvider driver
 	if config.UpstreamDriver == "" {
-		return nil, fmt.Errorf("must provider upstream driver")
+		return fmt.Errorf("must provider upstream driver")
 	}
 
-	var bigbro auditor.Provider
-
 	for _, d := range []struct {
 		reg     string
 		name    string
@@ -72,13 +102,13 @@ func installDrivers(piper *ssh.PiperConfig, config *piperdConfig, logger *log.Lo
 				return upstream.Get(n)
 			},
 			func(plugin registry.Plugin) error {
-				handler := plugin.(upstream.Provider).GetHandler()
+				provider := plugin.(upstream.Provider)
 
-				if handler == nil {
+				if provider.GetHandler() == nil {
 					return fmt.Errorf("upstream driver return nil handler")
 				}
 
-				piper.FindUpstream = handler
+				opts.Upstream = provider
 				return nil
 			},
 		},
@@ -90,13 +120,13 @@ func installDrivers(piper *ssh.PiperConfig, config *piperdConfig, logger *log.Lo
 				return challenger.Get(n)
 			},
 			func(plugin registry.Plugin) error {
-				handler := plugin.(challenger.Provider).GetHandler()
+				provider := plugin.(challenger.Provider)
 
-				if handler == nil {
+				if provider.GetHandler() == nil {
 					return fmt.Errorf("challenger driver return nil handler")
 				}
 
-				piper.AdditionalChallenge = handler
+				opts.Challenger = provider
 				return nil
 			},
 		},
@@ -108,36 +138,126 @@ func installDrivers(piper *ssh.PiperConfig, config *piperdConfig, logger *log.Lo
 				return auditor.Get(n)
 			},
 			func(plugin registry.Plugin) error {
-				bigbro = plugin.(auditor.Provider)
+				opts.Auditor = plugin.(auditor.Provider)
 				return nil
 			},
 		},
 	} {
 		err := getAndInstall(d.reg, d.name, d.get, d.install, logger)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return bigbro, nil
+	return nil
 }
 
-func startPiper(config *piperdConfig, logger *log.Logger) error {
+// piperInstance is a set of config and drivers to serve new connections
+// a new instance is created when config reloaded, running pipes keep using the old one
+type piperInstance struct {
+	config  *piperdConfig
+	options libpiper.Options
 
-	logger.Println("sshpiper is about to start")
+	proxyTrusted []*net.IPNet
+	banAllowlist []*net.IPNet
+
+	cache *upstream.Cache
+}
 
-	piper := &ssh.PiperConfig{}
+func (inst *piperInstance) banPolicy() banPolicy {
+	return banPolicy{
+		threshold: inst.config.BanThreshold,
+		window:    inst.config.BanWindow,
+		duration:  inst.config.BanDuration,
+		allowlist: inst.banAllowlist,
+	}
+}
 
-	// drivers
-	bigbro, err := installDrivers(piper, config, logger)
+// driverOpts holds options of drivers parsed on reload, keyed by driver
+// they are copied to drivers after the rest of config is validated
+type driverOpts map[registry.Plugin]interface{}
+
+// zeroed returns a zeroed copy of options of p to parse into, nil if p has no options
+func (d driverOpts) zeroed(p registry.Plugin) interface{} {
+	opts := p.GetOpts()
+	if opts == nil {
+		return nil
+	}
+
+	fresh := reflect.New(reflect.ValueOf(opts).Elem().Type()).Interface()
+	d[p] = fresh
+
+	return fresh
+}
+
+// apply copies options to drivers and returns a func restoring previous ones
+func (d driverOpts) apply() (restore func()) {
+	var restores []func()
+
+	for p, opts := range d {
+		dst := reflect.ValueOf(p.GetOpts()).Elem()
+
+		prev := reflect.New(dst.Type()).Elem()
+		prev.Set(dst)
+		dst.Set(reflect.ValueOf(opts).Elem())
+
+		restores = append(restores, func() { dst.Set(prev) })
+	}
+
+	return func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+}
+
+// checkDrivers ensures drivers in config exist before any of them is initialized
+func checkDrivers(config *piperdConfig) error {
+	if config.UpstreamDriver == "" {
+		return fmt.Errorf("must provider upstream driver")
+	}
+
+	for _, d := range []struct {
+		reg   string
+		name  string
+		found bool
+	}{
+		{"Upstream", config.UpstreamDriver, upstream.Get(config.UpstreamDriver) != nil},
+		{"Challenger", config.ChallengerDriver, config.ChallengerDriver == "" || challenger.Get(config.ChallengerDriver) != nil},
+		{"Auditor", config.AuditorDriver, config.AuditorDriver == "" || auditor.Get(config.AuditorDriver) != nil},
+	} {
+		if !d.found {
+			return fmt.Errorf("%v driver %v not found", d.reg, d.name)
+		}
+	}
+
+	return nil
+}
+
+// newPiperInstance creates drivers and host keys from config
+// drivers, if not nil, are options of drivers parsed on reload, drivers are left
+// untouched if anything else in config is invalid
+// prev, if not nil, is the instance in use, its drivers are initialized again if any driver of config failed
+func newPiperInstance(config *piperdConfig, drivers driverOpts, prev *piperInstance, logger logging.Logger) (*piperInstance, error) {
+	proxyTrusted, err := parseCIDRs(config.ProxyProtocolTrusted)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// listeners
+	banAllowlist, err := parseCIDRs(config.BanAllowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := libpiper.Options{
+		LoginGraceTime:    config.LoginGraceTime,
+		DisconnectMessage: config.DisconnectMessage,
+	}
+
+	// host keys
 	privateKeys, err := filepath.Glob(config.PiperKeyFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Println("Found host keys", privateKeys)
@@ -145,99 +265,459 @@ func startPiper(config *piperdConfig, logger *log.Logger) error {
 		logger.Println("Loading host key", privateKey)
 		privateBytes, err := ioutil.ReadFile(privateKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		private, err := ssh.ParsePrivateKey(privateBytes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		piper.AddHostKey(private)
-	}
-
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.ListenAddr, config.Port))
-	if err != nil {
-		return fmt.Errorf("failed to listen for connection: %v", err)
+		opts.HostKeys = append(opts.HostKeys, private)
 	}
-	defer listener.Close()
 
 	// banner
 	if config.BannerFile != "" {
 
-		piper.BannerCallback = func(conn ssh.ConnMetadata) string {
+		opts.Banner = func(conn ssh.ConnMetadata) string {
 
 			msg, err := ioutil.ReadFile(config.BannerFile)
 
 			if err != nil {
-				logger.Printf("failed to read banner file: %v", err)
+				logger.WithConn(conn).Errorf("failed to read banner file: %v", err)
 				return ""
 			}
 
 			return string(msg)
 		}
 	} else if config.BannerText != "" {
-		piper.BannerCallback = func(conn ssh.ConnMetadata) string {
+		opts.Banner = func(conn ssh.ConnMetadata) string {
 			return config.BannerText + "\n"
 		}
 	}
 
+	if err := checkDrivers(config); err != nil {
+		return nil, err
+	}
+
+	// drivers
+	restore := drivers.apply()
+
+	cache := upstream.NewCache(upstream.CacheOptions{
+		TTL:         config.UpstreamCacheTTL,
+		NegativeTTL: config.UpstreamCacheNegativeTTL,
+		MaxSize:     config.UpstreamCacheSize,
+	})
+
+	// must be set before driver init
+	if c, ok := upstream.Get(config.UpstreamDriver).(upstream.Cacheable); ok {
+		c.UseCache(cache)
+	}
+
+	if err := installDrivers(&opts, config, logger); err != nil {
+		restore()
+		cache.Close()
+
+		if prev != nil {
+			prev.reinitDrivers(config, logger)
+		}
+
+		return nil, err
+	}
+
+	// stopped when replaced by reload
+	if d, ok := opts.Upstream.(upstream.ChangeDetector); ok && cache.Enabled() && config.UpstreamCachePoll > 0 {
+		cache.Poll(config.UpstreamCachePoll, d.Fingerprint)
+	}
+
+	return &piperInstance{
+		config:       config,
+		options:      opts,
+		proxyTrusted: proxyTrusted,
+		banAllowlist: banAllowlist,
+		cache:        cache,
+	}, nil
+}
+
+// reinitDrivers initializes drivers of inst shared with config again with options of inst
+// they may have been initialized with options of config before another driver failed
+func (inst *piperInstance) reinitDrivers(config *piperdConfig, logger logging.Logger) {
+	if c, ok := upstream.Get(inst.config.UpstreamDriver).(upstream.Cacheable); ok {
+		c.UseCache(inst.cache)
+	}
+
+	for _, d := range []struct {
+		name string
+		next string
+		get  func(n string) registry.Plugin
+	}{
+		{inst.config.UpstreamDriver, config.UpstreamDriver, func(n string) registry.Plugin { return upstream.Get(n) }},
+		{inst.config.ChallengerDriver, config.ChallengerDriver, func(n string) registry.Plugin { return challenger.Get(n) }},
+		{inst.config.AuditorDriver, config.AuditorDriver, func(n string) registry.Plugin { return auditor.Get(n) }},
+	} {
+		if d.name == "" || d.name != d.next {
+			continue
+		}
+
+		if err := d.get(d.name).Init(logger.With(logging.Fields{"driver": d.name})); err != nil {
+			logger.Errorf("failed to restore driver %v, reason: %v", d.name, err)
+		}
+	}
+}
+
+// piperd holds states of a running sshpiperd
+type piperd struct {
+	logger logging.Logger
+
+	mu      sync.RWMutex
+	current *piperInstance
+
+	srv       *libpiper.Server
+	listeners []net.Listener
+	limiter   *connLimiter
+	bans      *banList
+	metrics   *piperMetrics
+
+	// *connSlot of connections, keyed by *libpiper.Conn
+	slots sync.Map
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newPiperd(inst *piperInstance, logger logging.Logger) (*piperd, error) {
+	d := &piperd{
+		logger:  logger,
+		current: inst,
+		limiter: newConnLimiter(),
+		bans:    newBanList(),
+		closing: make(chan struct{}),
+	}
+
+	srv, err := libpiper.NewServer(d.serverOptions(inst))
+	if err != nil {
+		return nil, err
+	}
+
+	d.srv = srv
+	d.metrics = newPiperMetrics(srv.ActivePipes)
+
+	return d, nil
+}
+
+// startPiper serves until SIGTERM/SIGINT
+// reload is called on SIGHUP to get the new config
+func startPiper(config *piperdConfig, logger logging.Logger, reload func() (*piperdConfig, driverOpts, error)) error {
+
+	logger.Println("sshpiper is about to start")
+
+	inst, err := newPiperInstance(config, nil, nil, logger)
+	if err != nil {
+		return err
+	}
+
+	d, err := newPiperd(inst, logger)
+	if err != nil {
+		return err
+	}
+
+	// listeners
+	d.listeners, err = createListeners(config)
+	if err != nil {
+		return err
+	}
+	defer d.shutdown()
+
+	if config.MetricsListen != "" {
+		l, err := net.Listen("tcp", config.MetricsListen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics: %v", err)
+		}
+		defer l.Close()
+
+		go d.serveHTTP(l)
+	}
+
+	if config.AdminListen != "" {
+		l, err := adminListen(config.AdminListen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for admin api: %v", err)
+		}
+		defer l.Close()
+
+		go d.serveAdmin(l)
+	}
+
+	// SIGHUP reloads config for new connections
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	defer signal.Stop(hupc)
+
+	go func() {
+		for range hupc {
+			logger.Printf("signal SIGHUP received, reloading config")
+			d.reload(reload)
+		}
+	}()
+
+	// SIGTERM/SIGINT stops accepting and drains active pipes
+	// the second one closes all remaining pipes immediately
+	abort := make(chan struct{})
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigc)
+
+	go func() {
+		sig := <-sigc
+		logger.Printf("signal %v received, stop accepting new connections", sig)
+		d.shutdown()
+
+		sig = <-sigc
+		logger.Printf("signal %v received again, closing all pipes", sig)
+		close(abort)
+	}()
+
+	var wg sync.WaitGroup
+	for _, l := range d.listeners {
+		logger.Printf("listening on %v", l.Addr())
+
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			d.serve(l)
+		}(l)
+	}
+
 	logger.Printf("sshpiperd started")
 
-	for {
-		conn, err := listener.Accept()
+	wg.Wait()
+	d.drain(abort)
+
+	logger.Printf("sshpiperd stopped")
+	return nil
+}
+
+// instance returns the piperInstance for new connections
+func (d *piperd) instance() *piperInstance {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.current
+}
+
+// reload replaces current piperInstance with the one created from new config
+// previous one is kept if any error occurs
+func (d *piperd) reload(load func() (*piperdConfig, driverOpts, error)) {
+	if load == nil {
+		d.logger.Warnf("reload is not supported")
+		return
+	}
+
+	config, drivers, err := load()
+	if err != nil {
+		d.logger.Errorf("failed to reload config, keep previous one, reason: %v", err)
+		return
+	}
+
+	inst, err := newPiperInstance(config, drivers, d.instance(), d.logger)
+	if err != nil {
+		d.logger.Errorf("failed to reload drivers and host keys, keep previous one, reason: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.srv.Update(d.serverOptions(inst)); err != nil {
+		d.logger.Errorf("failed to reload server options, keep previous one, reason: %v", err)
+		inst.cache.Close()
+		return
+	}
+
+	old := d.current
+	d.current = inst
+	old.cache.Close()
+
+	if !reflect.DeepEqual(old.config.ListenAddr, config.ListenAddr) || old.config.Port != config.Port {
+		d.logger.Warnf("listening address change will not take effect until restart")
+	}
+
+	d.logger.Printf("config reloaded")
+}
+
+// shutdown stops the daemon from accepting new connections
+func (d *piperd) shutdown() {
+	d.closeOnce.Do(func() {
+		close(d.closing)
+
+		for _, l := range d.listeners {
+			l.Close()
+		}
+	})
+}
+
+func (d *piperd) isClosing() bool {
+	select {
+	case <-d.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// serve accepts connections until shutdown
+func (d *piperd) serve(listener net.Listener) {
+	err := d.srv.Serve(listener)
+
+	if !d.isClosing() {
+		d.logger.Errorf("stop accepting connections on %v: %v", listener.Addr(), err)
+	}
+}
+
+// drain waits for active pipes to finish and closes the rest after drain timeout
+func (d *piperd) drain(abort <-chan struct{}) {
+	config := d.instance().config
+
+	d.logger.Printf("waiting up to %v for %v active pipes", config.DrainTimeout, d.srv.ActivePipes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	d.srv.Shutdown(ctx)
+}
+
+// serverOptions returns options of libpiper server for connections served by inst
+func (d *piperd) serverOptions(inst *piperInstance) libpiper.Options {
+	opts := inst.options
+	opts.Logger = d.logger
+	opts.Hooks = libpiper.Hooks{
+		Accept: func(c *libpiper.Conn) error {
+			return d.accept(c, inst)
+		},
+		CheckUser: d.checkUser,
+		HandshakeFailed: func(c *libpiper.Conn, err error) {
+			d.handshakeFailed(c, inst)
+		},
+		PipeEstablished: func(c *libpiper.Conn) {
+			d.pipeEstablished(c, inst)
+		},
+		Closed: d.closed,
+	}
+
+	return opts
+}
+
+// useProxyProtocol returns true if PROXY protocol header must be read from the conn
+func (inst *piperInstance) useProxyProtocol(c net.Conn) bool {
+	if !inst.config.ProxyProtocol {
+		return false
+	}
+
+	return len(inst.proxyTrusted) == 0 || addrInNets(c.RemoteAddr(), inst.proxyTrusted)
+}
+
+// accept resolves the real client address and applies bans and limits before ssh handshake
+func (d *piperd) accept(c *libpiper.Conn, inst *piperInstance) error {
+	d.metrics.accepted.Inc()
+
+	if inst.useProxyProtocol(c.NetConn()) {
+		proxy := c.RemoteAddr()
+
+		pc, err := readProxyProtoHeader(c.NetConn(), inst.config.LoginGraceTime)
 		if err != nil {
-			logger.Printf("failed to accept connection: %v", err)
-			continue
+			c.Logger().With(logging.Fields{"event": "handshake_failed", "reason": err}).Errorf("connection from %v failed to read proxy protocol header reason: %v", proxy, err)
+			return err
 		}
 
-		logger.Printf("connection accepted: %v", conn.RemoteAddr())
+		c.SetNetConn(pc)
+		c.AddLogFields(logging.Fields{"proxy_addr": proxy.String()})
 
-		go func(c net.Conn) {
-			defer c.Close()
+		c.Logger().With(logging.Fields{"event": "conn_proxied"}).Infof("connection from %v is proxied for %v", proxy, pc.RemoteAddr())
+	}
 
-			pipec := make(chan *ssh.PiperConn, 0)
-			errorc := make(chan error, 0)
+	ip := addrIP(c.RemoteAddr())
 
-			go func() {
-				p, err := ssh.NewSSHPiperConn(c, piper)
+	if until, banned := d.bans.isBanned(banKeyIP(ip.String())); banned {
+		c.Logger().With(logging.Fields{"event": "conn_rejected", "reason": handshakeFailureBanned}).Warnf("connection from %v rejected reason: banned until %v", c.RemoteAddr(), until.Format(time.RFC3339))
+		d.metrics.rejected.WithLabelValues(handshakeFailureBanned).Inc()
+		return fmt.Errorf("%v is banned until %v", ip, until.Format(time.RFC3339))
+	}
 
-				if err != nil {
-					errorc <- err
-					return
-				}
+	// limits are checked against the real client address before ssh handshake
+	slot, err := d.limiter.acquire(ip.String(), inst.config.connLimits())
+	if err != nil {
+		reason := err.(*connRejectedError).reason
+		c.Logger().With(logging.Fields{"event": "conn_rejected", "reason": reason}).Warnf("connection from %v rejected reason: %v", c.RemoteAddr(), reason)
+		d.metrics.rejected.WithLabelValues(reason).Inc()
+		return err
+	}
 
-				pipec <- p
-			}()
+	d.slots.Store(c, slot)
+	return nil
+}
 
-			var p *ssh.PiperConn
+// checkUser refuses banned usernames before calling drivers
+func (d *piperd) checkUser(c *libpiper.Conn, user string) error {
+	if until, banned := d.bans.isBanned(banKeyUser(user)); banned {
+		return fmt.Errorf("user %v is banned until %v", user, until.Format(time.RFC3339))
+	}
 
-			select {
-			case p = <-pipec:
-			case err := <-errorc:
-				logger.Printf("connection from %v establishing failed reason: %v", c.RemoteAddr(), err)
-				return
-			case <-time.After(config.LoginGraceTime):
-				logger.Printf("pipe establishing timeout, disconnected connection from %v", c.RemoteAddr())
-				return
-			}
+	return nil
+}
 
-			defer p.Close()
+// handshakeFailed counts the failure and records auth failures for bans
+func (d *piperd) handshakeFailed(c *libpiper.Conn, inst *piperInstance) {
+	reason := handshakeFailureOther
+
+	switch c.FailureReason() {
+	case libpiper.FailureTimeout:
+		reason = handshakeFailureTimeout
+	case libpiper.FailureRefused:
+		reason = handshakeFailureBanned
+	case libpiper.FailureUpstreamNotFound:
+		d.metrics.driverErrors.WithLabelValues("upstream", inst.config.UpstreamDriver).Inc()
+		reason = handshakeFailureUpstreamNotFound
+	case libpiper.FailureChallenge:
+		d.metrics.driverErrors.WithLabelValues("challenger", inst.config.ChallengerDriver).Inc()
+		reason = handshakeFailureAuth
+	case libpiper.FailureUpstream, libpiper.FailureUpstreamHostKey:
+		reason = handshakeFailureUpstream
+	case libpiper.FailureAuth:
+		reason = handshakeFailureAuth
+	case libpiper.FailureAuditor:
+		d.metrics.driverErrors.WithLabelValues("auditor", inst.config.AuditorDriver).Inc()
+		return
+	}
 
-			if bigbro != nil {
-				a, err := bigbro.Create(p.DownstreamConnMeta())
-				if err != nil {
-					logger.Printf("connection from %v failed to create auditor reason: %v", c.RemoteAddr(), err)
-					return
-				}
-				defer a.Close()
+	d.metrics.handshakeFailures.WithLabelValues(reason).Inc()
 
-				p.HookUpstreamMsg = a.GetUpstreamHook()
-				p.HookDownstreamMsg = a.GetDownstreamHook()
-			}
+	if reason == handshakeFailureAuth {
+		for _, key := range d.bans.fail(addrIP(c.RemoteAddr()), c.User(), inst.banPolicy()) {
+			c.Logger().With(logging.Fields{"event": "banned", "key": key}).Warnf("%v banned for %v after too many auth failures", key, inst.config.BanDuration)
+		}
+	}
+}
+
+func (d *piperd) pipeEstablished(c *libpiper.Conn, inst *piperInstance) {
+	if slot, ok := d.slots.Load(c); ok {
+		slot.(*connSlot).authenticated()
+	}
+
+	d.metrics.upstreamDial.Observe(c.UpstreamDialDuration().Seconds())
+	d.metrics.instrumentPipe(c.Pipe(), inst)
+}
 
-			err = p.Wait()
-			logger.Printf("connection from %v closed reason: %v", c.RemoteAddr(), err)
-		}(conn)
+func (d *piperd) closed(c *libpiper.Conn) {
+	if slot, ok := d.slots.Load(c); ok {
+		d.slots.Delete(c)
+		slot.(*connSlot).release()
 	}
 }
@@ -1,12 +1,20 @@
 package main
 
 import (
-	"log"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
 
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tg123/sshpiper/libpiper"
 	"github.com/tg123/sshpiper/sshpiperd/auditor"
 	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/registry"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 	"golang.org/x/crypto/ssh"
@@ -16,7 +24,8 @@ import (
 
 type testplugin struct {
 	name string
-	init func(logger *log.Logger) error
+	opts interface{}
+	init func(logger logging.Logger) error
 }
 
 func (p *testplugin) GetName() string {
@@ -24,10 +33,10 @@ func (p *testplugin) GetName() string {
 }
 
 func (p *testplugin) GetOpts() interface{} {
-	return nil
+	return p.opts
 }
 
-func (p *testplugin) Init(logger *log.Logger) error {
+func (p *testplugin) Init(logger logging.Logger) error {
 	if p.init == nil {
 		return nil
 	}
@@ -43,7 +52,7 @@ func Test_getAndInstall(t *testing.T) {
 	}, func(plugin registry.Plugin) error {
 		t.Errorf("should not call install")
 		return nil
-	}, nil)
+	}, logging.Discard())
 
 	// fail when not found
 	err := getAndInstall("", "test", func(n string) registry.Plugin {
@@ -54,7 +63,7 @@ func Test_getAndInstall(t *testing.T) {
 	}, func(plugin registry.Plugin) error {
 		t.Errorf("should not call install")
 		return nil
-	}, nil)
+	}, logging.Discard())
 
 	if err == nil {
 		t.Errorf("should err when not found")
@@ -63,13 +72,13 @@ func Test_getAndInstall(t *testing.T) {
 	// init err
 	err = getAndInstall("", "test", func(n string) registry.Plugin {
 		return &testplugin{
-			init: func(logger *log.Logger) error {
+			init: func(logger logging.Logger) error {
 				return fmt.Errorf("init failed")
 			},
 		}
 	}, func(plugin registry.Plugin) error {
 		return fmt.Errorf("test")
-	}, nil)
+	}, logging.Discard())
 
 	if err == nil {
 		t.Errorf("should err when not found")
@@ -83,7 +92,7 @@ func Test_getAndInstall(t *testing.T) {
 			t.Errorf("plugin name changed")
 		}
 		return &testplugin{
-			init: func(logger *log.Logger) error {
+			init: func(logger logging.Logger) error {
 				inited = true
 				return nil
 			},
@@ -95,7 +104,7 @@ func Test_getAndInstall(t *testing.T) {
 
 		installed = true
 		return nil
-	}, nil)
+	}, logging.Discard())
 
 	if !installed {
 		t.Errorf("not installed")
@@ -188,7 +197,7 @@ func Test_installDriver(t *testing.T) {
 	upstream.Register(upstreamErrName, &testupstream{
 		testplugin: testplugin{
 			name: upstreamErrName,
-			init: func(logger *log.Logger) error {
+			init: func(logger logging.Logger) error {
 				return fmt.Errorf("test err")
 			},
 		},
@@ -215,10 +224,10 @@ func Test_installDriver(t *testing.T) {
 
 	// empty driver name
 	{
-		piper := &ssh.PiperConfig{}
-		_, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver: "",
-		}, nil)
+		}, logging.Discard())
 
 		if err == nil {
 			t.Errorf("should fail when empty driver")
@@ -227,97 +236,98 @@ func Test_installDriver(t *testing.T) {
 
 	// install upstream
 	{
-		piper := &ssh.PiperConfig{}
-		_, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver: upstreamName,
-		}, nil)
+		}, logging.Discard())
 
 		if err != nil {
 			t.Errorf("install failed %v", err)
 		}
 
-		if _, _, err := piper.FindUpstream(nil, nil); err != nil {
+		if _, _, err := opts.Upstream.GetHandler()(nil, nil); err != nil {
 			t.Errorf("install wrong func")
 		}
 
-		if piper.AdditionalChallenge != nil {
+		if opts.Challenger != nil {
 			t.Errorf("should not install challenger")
 		}
 	}
 
 	// install upstream with failed init
 	{
-		piper := &ssh.PiperConfig{}
-		_, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver: upstreamErrName,
-		}, nil)
+		}, logging.Discard())
 
 		if err == nil {
 			t.Errorf("install should fail")
 		}
 
-		if piper.FindUpstream != nil {
+		if opts.Upstream != nil {
 			t.Errorf("should not install upstream provider")
 		}
 
-		if piper.AdditionalChallenge != nil {
+		if opts.Challenger != nil {
 			t.Errorf("should not install challenger")
 		}
 	}
 
 	// install upstream with nil handler
 	{
-		piper := &ssh.PiperConfig{}
-		_, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver: upstreamNilName,
-		}, nil)
+		}, logging.Discard())
 
 		if err == nil {
 			t.Errorf("install should fail")
 		}
 
-		if piper.FindUpstream != nil {
+		if opts.Upstream != nil {
 			t.Errorf("should not install upstream provider")
 		}
 
-		if piper.AdditionalChallenge != nil {
+		if opts.Challenger != nil {
 			t.Errorf("should not install challenger")
 		}
 	}
 
 	// install challenger
 	{
-		piper := &ssh.PiperConfig{}
-		_, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver:   upstreamName,
 			ChallengerDriver: challengerName,
-		}, nil)
+		}, logging.Discard())
 
 		if err != nil {
 			t.Errorf("install failed %v", err)
 		}
 
-		if _, err := piper.AdditionalChallenge(nil, nil); err != nil {
+		if _, err := opts.Challenger.GetHandler()(nil, nil); err != nil {
 			t.Errorf("should install challenger")
 		}
 	}
 
 	// install auditor
 	{
-		piper := &ssh.PiperConfig{}
-		ap, err := installDrivers(piper, &piperdConfig{
+		opts := &libpiper.Options{}
+		err := installDrivers(opts, &piperdConfig{
 			UpstreamDriver: upstreamName,
 			AuditorDriver:  auditorName,
-		}, nil)
+		}, logging.Discard())
 
 		if err != nil {
 			t.Errorf("install failed %v", err)
 		}
 
-		if ap == nil {
-			t.Errorf("nil auditor provider")
+		if opts.Auditor == nil {
+			t.Fatalf("nil auditor provider")
 		}
 
+		ap := opts.Auditor
 		ap0 := ap.(*testauditorprovider)
 
 		ap0.a = &testauditor{
@@ -349,3 +359,333 @@ func Test_installDriver(t *testing.T) {
 		}
 	}
 }
+
+func Test_piperdReload(t *testing.T) {
+	upstreamName := fmt.Sprintf("u_%v", time.Now().UTC().UnixNano())
+	challengerErrName := fmt.Sprintf("ce_%v", time.Now().UTC().UnixNano())
+
+	// options of upstream when inited
+	var inited []string
+	upstreamOpts := &struct{ Name string }{"prev"}
+
+	upstream.Register(upstreamName, &testupstream{
+		testplugin: testplugin{
+			name: upstreamName,
+			opts: upstreamOpts,
+			init: func(logger logging.Logger) error {
+				inited = append(inited, upstreamOpts.Name)
+				return nil
+			},
+		},
+		h: func(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+			return nil, nil, nil
+		},
+	})
+
+	logger := logging.Discard()
+
+	inst, err := newPiperInstance(&piperdConfig{UpstreamDriver: upstreamName}, nil, nil, logger)
+	if err != nil {
+		t.Fatalf("create instance failed %v", err)
+	}
+
+	d, err := newPiperd(inst, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// load failed
+	d.reload(func() (*piperdConfig, driverOpts, error) {
+		return nil, nil, fmt.Errorf("test err")
+	})
+
+	if d.instance() != inst {
+		t.Errorf("should keep previous instance when load failed")
+	}
+
+	// driver not found
+	d.reload(func() (*piperdConfig, driverOpts, error) {
+		return &piperdConfig{UpstreamDriver: "not_exists"}, nil, nil
+	})
+
+	if d.instance() != inst {
+		t.Errorf("should keep previous instance when install failed")
+	}
+
+	// bad host key, drivers are left untouched
+	keyfile, err := ioutil.TempFile("", "sshpiperd_hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyfile.Name())
+	keyfile.Close()
+
+	target := upstream.Get("target")
+	drivers := make(driverOpts)
+	reflect.ValueOf(drivers.zeroed(target)).Elem().FieldByName("Separator").SetString("+")
+
+	d.reload(func() (*piperdConfig, driverOpts, error) {
+		return &piperdConfig{UpstreamDriver: upstreamName, PiperKeyFile: keyfile.Name()}, drivers, nil
+	})
+
+	if d.instance() != inst {
+		t.Errorf("should keep previous instance when host key is bad")
+	}
+
+	if reflect.ValueOf(target.GetOpts()).Elem().FieldByName("Separator").String() != "" {
+		t.Errorf("driver options should not be applied when host key is bad")
+	}
+
+	// challenger failed, upstream inited with new options is inited again with previous ones
+	challenger.Register(challengerErrName, &testchallenger{
+		testplugin: testplugin{
+			name: challengerErrName,
+			init: func(logger logging.Logger) error {
+				return fmt.Errorf("test err")
+			},
+		},
+	})
+
+	drivers = make(driverOpts)
+	reflect.ValueOf(drivers.zeroed(upstream.Get(upstreamName))).Elem().FieldByName("Name").SetString("next")
+	inited = nil
+
+	d.reload(func() (*piperdConfig, driverOpts, error) {
+		return &piperdConfig{UpstreamDriver: upstreamName, ChallengerDriver: challengerErrName}, drivers, nil
+	})
+
+	if d.instance() != inst {
+		t.Errorf("should keep previous instance when challenger failed")
+	}
+
+	if !reflect.DeepEqual(inited, []string{"next", "prev"}) || upstreamOpts.Name != "prev" {
+		t.Errorf("upstream should be inited again with previous options, got %v %v", inited, upstreamOpts.Name)
+	}
+
+	// reloaded
+	d.reload(func() (*piperdConfig, driverOpts, error) {
+		return &piperdConfig{UpstreamDriver: upstreamName, BannerText: "hello"}, nil, nil
+	})
+
+	if d.instance() == inst {
+		t.Errorf("should use new instance")
+	}
+
+	if d.instance().options.Banner(nil) != "hello\n" || d.srv.Options().Banner(nil) != "hello\n" {
+		t.Errorf("banner not reloaded")
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// startTestUpstream starts an sshd accepting user bob with password secret, exec echoes stdin
+func startTestUpstream(t *testing.T) net.Listener {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "bob" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %v", conn.User())
+		},
+	}
+	config.AddHostKey(newTestSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newChannel := range chans {
+					ch, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "exec", nil)
+
+							if req.Type == "exec" {
+								io.Copy(ch, ch)
+								ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+								ch.Close()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// startTestPiperd serves piperd piping alice to bob@upstream
+func startTestPiperd(t *testing.T, config *piperdConfig, up net.Listener) *piperd {
+	upstreamName := fmt.Sprintf("u_%v", time.Now().UTC().UnixNano())
+
+	upstream.Register(upstreamName, &testupstream{
+		testplugin: testplugin{
+			name: upstreamName,
+		},
+		h: func(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+			if conn.User() != "alice" {
+				return nil, nil, fmt.Errorf("no upstream for %v", conn.User())
+			}
+
+			c, err := net.Dial("tcp", up.Addr().String())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return c, &ssh.AuthPipe{
+				User:                    "bob",
+				UpstreamHostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}, nil
+		},
+	})
+
+	config.UpstreamDriver = upstreamName
+	config.LoginGraceTime = 5 * time.Second
+
+	inst, err := newPiperInstance(config, nil, nil, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst.options.HostKeys = []ssh.Signer{newTestSigner(t)}
+
+	d, err := newPiperd(inst, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.listeners = []net.Listener{l}
+	go d.serve(l)
+
+	return d
+}
+
+func dialTestPiperd(d *piperd, user, password string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", d.listeners[0].Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func Test_piperdPipe(t *testing.T) {
+	up := startTestUpstream(t)
+	defer up.Close()
+
+	d := startTestPiperd(t, &piperdConfig{
+		DrainTimeout:  time.Second,
+		MaxConnsPerIP: 1,
+		BanThreshold:  2,
+		BanWindow:     time.Minute,
+		BanDuration:   time.Hour,
+	}, up)
+
+	client, err := dialTestPiperd(d, "alice", "secret")
+	if err != nil {
+		t.Fatalf("dial failed %v", err)
+	}
+
+	if d.srv.ActivePipes() != 1 || testutil.ToFloat64(d.metrics.accepted) != 1 {
+		t.Errorf("pipe not established")
+	}
+
+	// slot is held by the established pipe
+	if _, err := dialTestPiperd(d, "alice", "secret"); err == nil {
+		t.Errorf("should be rejected by max conns per ip")
+	}
+
+	if testutil.ToFloat64(d.metrics.rejected.WithLabelValues(rejectIPConnLimit)) != 1 {
+		t.Errorf("rejection not counted")
+	}
+
+	// wait for the slot released after the connection closed in piperd
+	waitReleased := func() {
+		for i := 0; i < 100; i++ {
+			d.limiter.mu.Lock()
+			n := d.limiter.perIP["127.0.0.1"]
+			d.limiter.mu.Unlock()
+
+			if n == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Fatalf("slot not released")
+	}
+
+	client.Close()
+	waitReleased()
+
+	for i := 0; i < 2; i++ {
+		if _, err := dialTestPiperd(d, "alice", "wrong"); err == nil {
+			t.Fatalf("wrong password should fail")
+		}
+		waitReleased()
+	}
+
+	if testutil.ToFloat64(d.metrics.handshakeFailures.WithLabelValues(handshakeFailureAuth)) != 2 {
+		t.Errorf("auth failures not counted")
+	}
+
+	if _, banned := d.bans.isBanned(banKeyUser("alice")); !banned {
+		t.Errorf("alice should be banned")
+	}
+
+	if _, banned := d.bans.isBanned(banKeyIP("127.0.0.1")); !banned {
+		t.Errorf("127.0.0.1 should be banned")
+	}
+
+	if _, err := dialTestPiperd(d, "alice", "secret"); err == nil {
+		t.Errorf("banned ip should be rejected")
+	}
+
+	if testutil.ToFloat64(d.metrics.rejected.WithLabelValues(handshakeFailureBanned)) != 1 {
+		t.Errorf("banned rejection not counted")
+	}
+
+	d.shutdown()
+	d.shutdown()
+	d.drain(nil)
+
+	if !d.isClosing() {
+		t.Errorf("should be closing after shutdown")
+	}
+}
@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SourceACL allows or denies downstream by source address
+// empty Allowed means all sources are allowed unless Denied
+type SourceACL struct {
+	Allowed []string
+	Denied  []string
+}
+
+// ParseNetwork parses a CIDR, a single IP is treated as /32 or /128
+func ParseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad ip address %v", s)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func matchNetworks(ip net.IP, networks []string) (bool, error) {
+	for _, s := range networks {
+		n, err := ParseNetwork(s)
+		if err != nil {
+			return false, err
+		}
+
+		if n.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Check returns error if the source address is denied or not allowed
+// a bad CIDR in ACL denies all sources
+func (a SourceACL) Check(addr net.Addr) error {
+	if len(a.Allowed) == 0 && len(a.Denied) == 0 {
+		return nil
+	}
+
+	var ip net.IP
+
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip = tcp.IP
+	} else if addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+
+	if ip == nil {
+		return fmt.Errorf("source address %v is not an ip, denied by acl", addr)
+	}
+
+	denied, err := matchNetworks(ip, a.Denied)
+	if err != nil {
+		return fmt.Errorf("bad denied networks in acl: %v", err)
+	}
+
+	if denied {
+		return fmt.Errorf("source address %v is denied by acl", ip)
+	}
+
+	if len(a.Allowed) == 0 {
+		return nil
+	}
+
+	allowed, err := matchNetworks(ip, a.Allowed)
+	if err != nil {
+		return fmt.Errorf("bad allowed networks in acl: %v", err)
+	}
+
+	if !allowed {
+		return fmt.Errorf("source address %v is not in allowed networks of acl", ip)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSourceACL(t *testing.T) {
+	addr := func(s string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(s), Port: 2222}
+	}
+
+	for _, tc := range []struct {
+		acl     SourceACL
+		addr    net.Addr
+		allowed bool
+	}{
+		{SourceACL{}, addr("10.0.0.1"), true},
+		{SourceACL{}, nil, true},
+		{SourceACL{Allowed: []string{"10.0.0.0/8"}}, addr("10.0.0.1"), true},
+		{SourceACL{Allowed: []string{"10.0.0.0/8"}}, addr("192.168.0.1"), false},
+		{SourceACL{Allowed: []string{"192.168.0.1", "10.0.0.0/8"}}, addr("192.168.0.1"), true},
+		{SourceACL{Allowed: []string{"10.0.0.0/8"}, Denied: []string{"10.0.0.1"}}, addr("10.0.0.1"), false},
+		{SourceACL{Denied: []string{"10.0.0.0/8"}}, addr("192.168.0.1"), true},
+		{SourceACL{Denied: []string{"::1"}}, addr("::1"), false},
+		{SourceACL{Allowed: []string{"bad"}}, addr("10.0.0.1"), false},
+		{SourceACL{Allowed: []string{"10.0.0.0/8"}}, nil, false},
+		{SourceACL{Allowed: []string{"10.0.0.0/8"}}, &net.UnixAddr{Name: "10.0.0.1:22"}, true},
+	} {
+		err := tc.acl.Check(tc.addr)
+
+		if tc.allowed && err != nil {
+			t.Errorf("%v should be allowed by %v, got %v", tc.addr, tc.acl, err)
+		}
+
+		if !tc.allowed && err == nil {
+			t.Errorf("%v should be denied by %v", tc.addr, tc.acl)
+		}
+	}
+}
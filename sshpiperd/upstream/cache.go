@@ -0,0 +1,261 @@
+package upstream
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NotFoundError is returned by drivers when the downstream user has no upstream
+// it is cached by Cache for CacheOptions.NegativeTTL
+type NotFoundError struct {
+	User string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("username [%v] not found", e.User)
+}
+
+// IsNotFound tells if err is or wraps NotFoundError
+func IsNotFound(err error) bool {
+	var e *NotFoundError
+	return errors.As(err, &e)
+}
+
+// CacheOptions of Cache
+type CacheOptions struct {
+	// TTL of successful lookups, 0 to disable
+	TTL time.Duration
+
+	// TTL of lookups failed with NotFoundError, 0 to disable
+	NegativeTTL time.Duration
+
+	// Max entries, least recently used ones are evicted, 0 for unlimited
+	MaxSize int
+}
+
+// Cacheable is an optional interface of Provider which can cache its lookups
+type Cacheable interface {
+
+	// UseCache is called before Init, the provider should cache expensive lookups in cache
+	UseCache(cache *Cache)
+}
+
+// ChangeDetector is an optional interface of Cacheable Provider
+// the cache is purged when fingerprint of backing data changes, e.g. mtime of config file
+type ChangeDetector interface {
+
+	// Fingerprint changes when data behind the provider changes
+	Fingerprint() (string, error)
+}
+
+type cacheKey struct {
+	ns   string
+	user string
+	key  string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+type cacheStore struct {
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	// bumped by invalidation to drop results of lookups started before
+	gen uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Cache caches lookups of upstream by downstream user
+type Cache struct {
+	*cacheStore
+	ns string
+}
+
+// NewCache creates a cache, nothing is cached if both TTL and NegativeTTL are 0
+func NewCache(opts CacheOptions) *Cache {
+	return &Cache{
+		cacheStore: &cacheStore{
+			opts:    opts,
+			entries: make(map[cacheKey]*list.Element),
+			lru:     list.New(),
+			stop:    make(chan struct{}),
+		},
+	}
+}
+
+// Enabled tells if anything will be cached
+func (c *Cache) Enabled() bool {
+	return c != nil && (c.opts.TTL > 0 || c.opts.NegativeTTL > 0)
+}
+
+// Namespace returns a view of the cache whose keys do not collide with others
+// e.g. for members of composite driver, they share size limit and invalidation
+func (c *Cache) Namespace(ns string) *Cache {
+	if c == nil {
+		return nil
+	}
+
+	return &Cache{c.cacheStore, c.ns + "/" + ns}
+}
+
+// Get returns cached result of user and key or calls load to fill the cache
+// key is optional and distinguishes lookups of the same user, e.g. from different source
+func (c *Cache) Get(user, key string, load func() (interface{}, error)) (interface{}, error) {
+	if !c.Enabled() {
+		return load()
+	}
+
+	k := cacheKey{c.ns, user, key}
+	now := time.Now()
+
+	c.mu.Lock()
+	if el, ok := c.entries[k]; ok {
+		e := el.Value.(*cacheEntry)
+
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.value, e.err
+		}
+
+		c.remove(el)
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	value, err := load()
+
+	ttl := c.opts.TTL
+	if err != nil {
+		ttl = 0
+
+		if IsNotFound(err) {
+			ttl = c.opts.NegativeTTL
+		}
+	}
+
+	if ttl <= 0 {
+		return value, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// invalidated during load
+	if gen != c.gen {
+		return value, err
+	}
+
+	if el, ok := c.entries[k]; ok {
+		c.remove(el)
+	}
+
+	c.entries[k] = c.lru.PushFront(&cacheEntry{k, value, err, now.Add(ttl)})
+
+	for c.opts.MaxSize > 0 && c.lru.Len() > c.opts.MaxSize {
+		c.remove(c.lru.Back())
+	}
+
+	return value, err
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// Invalidate drops cached lookups of user, in all namespaces if called on the root cache
+func (c *Cache) Invalidate(user string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for k, el := range c.entries {
+		if k.user == user && (c.ns == "" || k.ns == c.ns) {
+			c.remove(el)
+		}
+	}
+}
+
+// Purge drops all cached lookups, namespaces included
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+}
+
+// Len returns number of cached lookups
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Poll purges the cache when fingerprint changes, checked every interval until Close
+// a failed fingerprint is treated as a change
+func (c *Cache) Poll(interval time.Duration, fingerprint func() (string, error)) {
+	last := func() string {
+		fp, err := fingerprint()
+		if err != nil {
+			return "error: " + err.Error()
+		}
+
+		return fp
+	}
+
+	prev := last()
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-t.C:
+				if fp := last(); fp != prev {
+					prev = fp
+					c.Purge()
+				}
+			}
+		}
+	}()
+}
+
+// Close stops polling
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countingLoad(n *int32, err error) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		return atomic.AddInt32(n, 1), err
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := NewCache(CacheOptions{TTL: 50 * time.Millisecond})
+
+	var n int32
+
+	for i := 0; i < 3; i++ {
+		if v, err := c.Get("alice", "", countingLoad(&n, nil)); err != nil || v.(int32) != 1 {
+			t.Errorf("should be cached %v %v", v, err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if v, _ := c.Get("alice", "", countingLoad(&n, nil)); v.(int32) != 2 {
+		t.Errorf("should be reloaded after ttl, got %v", v)
+	}
+
+	// errors other than not found are never cached
+	failed := fmt.Errorf("down")
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get("bob", "", countingLoad(&n, failed)); err != failed {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	if n != 4 {
+		t.Errorf("failed lookups should not be cached, loaded %v times", n)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	notFound := &NotFoundError{User: "eve"}
+
+	var n int32
+
+	c := NewCache(CacheOptions{TTL: time.Hour})
+	c.Get("eve", "", countingLoad(&n, notFound))
+	c.Get("eve", "", countingLoad(&n, notFound))
+
+	if n != 2 {
+		t.Errorf("not found should not be cached without negative ttl")
+	}
+
+	c = NewCache(CacheOptions{NegativeTTL: time.Hour})
+	c.Get("eve", "", countingLoad(&n, fmt.Errorf("wrapped: %w", notFound)))
+
+	if _, err := c.Get("eve", "", countingLoad(&n, nil)); !IsNotFound(err) {
+		t.Errorf("not found should be cached %v", err)
+	}
+
+	c.Get("alice", "", countingLoad(&n, nil))
+	c.Get("alice", "", countingLoad(&n, nil))
+
+	if n != 5 {
+		t.Errorf("found should not be cached without ttl, loaded %v times", n)
+	}
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	c := NewCache(CacheOptions{TTL: time.Hour, MaxSize: 2})
+
+	var n int32
+
+	c.Get("alice", "", countingLoad(&n, nil))
+	c.Get("bob", "", countingLoad(&n, nil))
+	c.Get("alice", "", countingLoad(&n, nil))
+	c.Get("carol", "", countingLoad(&n, nil))
+
+	if c.Len() != 2 {
+		t.Errorf("expect 2 entries got %v", c.Len())
+	}
+
+	// bob is least recently used
+	c.Get("alice", "", countingLoad(&n, nil))
+	c.Get("bob", "", countingLoad(&n, nil))
+
+	if n != 4 {
+		t.Errorf("only bob should be evicted, loaded %v times", n)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := NewCache(CacheOptions{TTL: time.Hour})
+	yaml := c.Namespace("yaml")
+	db := c.Namespace("database")
+
+	var n int32
+
+	yaml.Get("alice", "", countingLoad(&n, nil))
+	db.Get("alice", "", countingLoad(&n, nil))
+	db.Get("alice", "other", countingLoad(&n, nil))
+	db.Get("bob", "", countingLoad(&n, nil))
+
+	if c.Len() != 4 {
+		t.Errorf("namespaces and keys should not collide, got %v entries", c.Len())
+	}
+
+	yaml.Invalidate("alice")
+
+	if c.Len() != 3 {
+		t.Errorf("only alice in yaml should be invalidated, got %v entries", c.Len())
+	}
+
+	c.Invalidate("alice")
+
+	if c.Len() != 1 {
+		t.Errorf("alice should be invalidated in all namespaces, got %v entries", c.Len())
+	}
+
+	// purged during load
+	db.Get("carol", "", func() (interface{}, error) {
+		db.Purge()
+		return "stale", nil
+	})
+
+	if c.Len() != 0 {
+		t.Errorf("stale result should not be cached, got %v entries", c.Len())
+	}
+
+	var disabled *Cache
+	disabled.Invalidate("alice")
+	disabled.Purge()
+	disabled.Close()
+
+	if v, _ := disabled.Namespace("yaml").Get("alice", "", countingLoad(&n, nil)); v == nil {
+		t.Errorf("nil cache should load directly")
+	}
+}
+
+func TestCachePoll(t *testing.T) {
+	c := NewCache(CacheOptions{TTL: time.Hour})
+	defer c.Close()
+
+	var version int32
+
+	c.Poll(10*time.Millisecond, func() (string, error) {
+		return fmt.Sprint(atomic.LoadInt32(&version)), nil
+	})
+
+	var n int32
+	c.Get("alice", "", countingLoad(&n, nil))
+
+	time.Sleep(50 * time.Millisecond)
+
+	if c.Len() != 1 {
+		t.Errorf("should not purge if nothing changes")
+	}
+
+	atomic.AddInt32(&version, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache should be purged after change")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
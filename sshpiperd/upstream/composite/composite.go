@@ -0,0 +1,93 @@
+package composite
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	for _, m := range p.members {
+		c, pipe, err := m.provider.GetHandler()(conn, challengeContext)
+		if err == nil {
+			p.logger.WithConn(conn).Debugf("upstream of [%v] found by %v", conn.User(), m.name)
+			return c, pipe, nil
+		}
+
+		// e.g. denied by acl or failed to dial, the user belongs to this member
+		if !upstream.IsNotFound(err) {
+			return nil, nil, fmt.Errorf("%v: %v", m.name, err)
+		}
+
+		p.logger.WithConn(conn).Debugf("upstream of [%v] not found by %v, trying next", conn.User(), m.name)
+	}
+
+	return nil, nil, &upstream.NotFoundError{User: conn.User()}
+}
+
+// Return pipes of all members, tagged with the member name
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	var pipes []upstream.Pipe
+
+	for _, m := range p.members {
+		list, err := m.provider.ListPipe()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", m.name, err)
+		}
+
+		for _, pipe := range list {
+			if pipe.Source == "" {
+				pipe.Source = m.name
+			}
+
+			pipes = append(pipes, pipe)
+		}
+	}
+
+	return pipes, nil
+}
+
+// Create a pipe inside the member named by opt.Source, the write driver if empty
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	if opt.Source == "" {
+		return p.writer.CreatePipe(opt)
+	}
+
+	for _, m := range p.members {
+		if m.name == opt.Source {
+			opt.Source = ""
+			return m.provider.CreatePipe(opt)
+		}
+	}
+
+	return fmt.Errorf("driver %v is not in upstream-composite-drivers", opt.Source)
+}
+
+// Remove a pipe from the first member listing it, which is the member serving the user
+func (p *plugin) RemovePipe(name string) error {
+	var errs []string
+
+	for _, m := range p.members {
+		list, err := m.provider.ListPipe()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", m.name, err))
+			continue
+		}
+
+		for _, pipe := range list {
+			if pipe.Username == name {
+				return m.provider.RemovePipe(name)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("pipe %v not found, members failed to list pipes: %v", name, strings.Join(errs, ", "))
+	}
+
+	return fmt.Errorf("pipe %v not found in upstream-composite-drivers", name)
+}
@@ -0,0 +1,199 @@
+package composite
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+type testProvider struct {
+	name    string
+	users   map[string]string
+	denied  map[string]bool
+	created []string
+	removed []string
+	health  error
+	inited  bool
+}
+
+func (p *testProvider) GetName() string {
+	return p.name
+}
+
+func (p *testProvider) GetOpts() interface{} {
+	return nil
+}
+
+func (p *testProvider) Init(logger logging.Logger) error {
+	p.inited = true
+	return nil
+}
+
+func (p *testProvider) HealthCheck() error {
+	return p.health
+}
+
+func (p *testProvider) GetHandler() upstream.Handler {
+	return func(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+		if p.denied[conn.User()] {
+			return nil, nil, fmt.Errorf("username [%v] denied", conn.User())
+		}
+
+		mapped, ok := p.users[conn.User()]
+		if !ok {
+			return nil, nil, &upstream.NotFoundError{User: conn.User()}
+		}
+
+		c, _ := net.Pipe()
+		return c, &ssh.AuthPipe{User: mapped}, nil
+	}
+}
+
+func (p *testProvider) ListPipe() ([]upstream.Pipe, error) {
+	var pipes []upstream.Pipe
+	for u, mapped := range p.users {
+		pipes = append(pipes, upstream.Pipe{Username: u, UpstreamUsername: mapped})
+	}
+
+	return pipes, nil
+}
+
+func (p *testProvider) CreatePipe(opt upstream.CreatePipeOption) error {
+	p.created = append(p.created, opt.Username)
+	return nil
+}
+
+func (p *testProvider) RemovePipe(name string) error {
+	p.removed = append(p.removed, name)
+	return nil
+}
+
+var (
+	first  = &testProvider{name: "composite_test_first", users: map[string]string{"alice": "alice_first"}, denied: map[string]bool{"mallory": true}}
+	second = &testProvider{name: "composite_test_second", users: map[string]string{"alice": "alice_second", "bob": "bob_second", "mallory": "mallory_second"}}
+)
+
+func init() {
+	upstream.Register(first.name, first)
+	upstream.Register(second.name, second)
+}
+
+func TestFindUpstream(t *testing.T) {
+	p := &plugin{}
+	p.Config.Drivers = []string{first.name, second.name}
+	p.Config.WriteDriver = second.name
+
+	upstreamtest.Init(t, p)
+
+	if !first.inited || !second.inited {
+		t.Errorf("members should be initialized")
+	}
+
+	h := p.GetHandler()
+
+	for user, expect := range map[string]string{"alice": "alice_first", "bob": "bob_second"} {
+		c, pipe, err := h(upstreamtest.Conn{Username: user}, nil)
+		if err != nil {
+			t.Fatalf("find upstream of %v failed %v", user, err)
+		}
+		c.Close()
+
+		if pipe.User != expect {
+			t.Errorf("expect %v got %v", expect, pipe.User)
+		}
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "eve"}, nil); !upstream.IsNotFound(err) {
+		t.Errorf("eve should not be found %v", err)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "mallory"}, nil); err == nil || upstream.IsNotFound(err) {
+		t.Errorf("mallory denied by first member should not be tried in next one %v", err)
+	}
+
+	pipes, err := p.ListPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(map[string]int)
+	for _, pipe := range pipes {
+		sources[pipe.Source]++
+	}
+
+	if len(pipes) != 4 || sources[first.name] != 1 || sources[second.name] != 3 {
+		t.Errorf("unexpected pipes %v", pipes)
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first.created) != 0 || len(second.created) != 1 {
+		t.Errorf("pipe should be created in write driver")
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "dave", Source: first.name}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first.created) != 1 || len(second.created) != 1 {
+		t.Errorf("pipe should be created in selected member")
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "dave", Source: "composite_test_unknown"}); err == nil {
+		t.Errorf("create in unknown member should fail")
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		if err := p.RemovePipe(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(first.removed) != 1 || first.removed[0] != "alice" || len(second.removed) != 1 || second.removed[0] != "bob" {
+		t.Errorf("pipe should be removed from member serving it, got %v %v", first.removed, second.removed)
+	}
+
+	if err := p.RemovePipe("eve"); err == nil {
+		t.Errorf("remove unknown pipe should fail")
+	}
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	second.health = fmt.Errorf("down")
+	defer func() { second.health = nil }()
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("should not be healthy when a member is down")
+	}
+}
+
+func TestInit(t *testing.T) {
+	for _, c := range []struct {
+		drivers []string
+		writer  string
+	}{
+		{nil, ""},
+		{[]string{"composite"}, ""},
+		{[]string{first.name, first.name}, ""},
+		{[]string{"composite_test_unknown"}, ""},
+		{[]string{first.name}, second.name},
+	} {
+		p := &plugin{}
+		p.Config.Drivers = c.drivers
+		p.Config.WriteDriver = c.writer
+
+		if err := p.Init(logging.Discard()); err == nil {
+			t.Errorf("%v %v should fail", c.drivers, c.writer)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package composite
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type member struct {
+	name     string
+	provider upstream.Provider
+}
+
+type plugin struct {
+	Config struct {
+		Drivers     []string `long:"upstream-composite-drivers" description:"Upstream drivers tried in order until one finds the upstream, e.g. yaml,workingdir" env:"SSHPIPERD_UPSTREAM_COMPOSITE_DRIVERS" env-delim:"," ini-name:"upstream-composite-drivers"`
+		WriteDriver string   `long:"upstream-composite-write-driver" description:"Driver to create and remove pipes, the first of upstream-composite-drivers if empty" env:"SSHPIPERD_UPSTREAM_COMPOSITE_WRITE_DRIVER" ini-name:"upstream-composite-write-driver"`
+	}
+
+	logger  logging.Logger
+	members []member
+	writer  upstream.Provider
+	cache   *upstream.Cache
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "composite"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+// Members which can cache share the cache in their own namespaces
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.cache = cache
+}
+
+// Changes when any member's data changes
+func (p *plugin) Fingerprint() (string, error) {
+	var fp []string
+
+	for _, m := range p.members {
+		if d, ok := m.provider.(upstream.ChangeDetector); ok {
+			f, err := d.Fingerprint()
+			if err != nil {
+				return "", fmt.Errorf("%v: %v", m.name, err)
+			}
+
+			fp = append(fp, m.name+"="+f)
+		}
+	}
+
+	return strings.Join(fp, ","), nil
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+// members are initialized here as sshpiperd only initializes the selected driver
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	if len(p.Config.Drivers) == 0 {
+		return fmt.Errorf("upstream-composite-drivers is required")
+	}
+
+	var members []member
+	seen := make(map[string]bool)
+
+	for _, name := range p.Config.Drivers {
+		if name == p.GetName() {
+			return fmt.Errorf("composite driver cannot be its own member")
+		}
+
+		if seen[name] {
+			return fmt.Errorf("duplicate upstream driver %v in upstream-composite-drivers", name)
+		}
+		seen[name] = true
+
+		provider := upstream.Get(name)
+		if provider == nil {
+			return fmt.Errorf("upstream driver %v not found", name)
+		}
+
+		if c, ok := provider.(upstream.Cacheable); ok {
+			c.UseCache(p.cache.Namespace(name))
+		}
+
+		if err := provider.Init(logger); err != nil {
+			return fmt.Errorf("init upstream driver %v failed: %v", name, err)
+		}
+
+		if provider.GetHandler() == nil {
+			return fmt.Errorf("upstream driver %v return nil handler", name)
+		}
+
+		members = append(members, member{name, provider})
+	}
+
+	writer := members[0].provider
+
+	if p.Config.WriteDriver != "" {
+		writer = nil
+
+		for _, m := range members {
+			if m.name == p.Config.WriteDriver {
+				writer = m.provider
+			}
+		}
+
+		if writer == nil {
+			return fmt.Errorf("write driver %v is not in upstream-composite-drivers", p.Config.WriteDriver)
+		}
+	}
+
+	p.members = members
+	p.writer = writer
+
+	logger.Printf("upstream provider: composite of %v initializing", p.Config.Drivers)
+
+	return nil
+}
+
+// All members which can check health must be healthy
+func (p *plugin) HealthCheck() error {
+	for _, m := range p.members {
+		if checker, ok := m.provider.(upstream.HealthChecker); ok {
+			if err := checker.HealthCheck(); err != nil {
+				return fmt.Errorf("%v: %v", m.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+func init() {
+	upstream.Register("composite", &plugin{})
+}
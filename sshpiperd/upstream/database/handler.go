@@ -7,26 +7,53 @@ import (
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	upstreamprovider "github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
 func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
 
 	user := conn.User()
-	d, err := lookupDownstreamWithFallback(p.db, user)
+	local := conn.LocalAddr()
+
+	var listen string
+	if local != nil {
+		listen = local.String()
+	}
+
+	v, err := p.cache.Get(user, listen, func() (interface{}, error) {
+		r, err := lookupRoute(p.database(), user, local)
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, &upstreamprovider.NotFoundError{User: user}
+		}
+
+		return r, err
+	})
 
 	if err != nil {
 		return nil, nil, err
 	}
 
+	r := v.(*route)
+	d := r.downstream
+
 	addr := d.Upstream.Server.Address
 	upuser := d.Upstream.Username
 
 	if upuser == "" {
 		upuser = d.Username
+
+		if r.anyUser {
+			upuser = user
+		}
 	}
 
-	logger.Printf("mapping user [%v] to [%v@%v]", user, upuser, addr)
+	if err := d.sourceACL().Check(conn.RemoteAddr()); err != nil {
+		logger.WithConn(conn).With(logging.Fields{"event": "acl_denied", "reason": err}).Warnf("pipe [%v] refused from [%v]: %v", user, conn.RemoteAddr(), err)
+		return nil, nil, err
+	}
+
+	logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": addr, "mapped_user": upuser}).Infof("mapping user [%v] to [%v@%v]", user, upuser, addr)
 
 	c, err := upstreamprovider.DialForSSH(addr)
 
@@ -56,7 +83,7 @@ func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.Additi
 				publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key.Data))
 
 				if err != nil {
-					logger.Printf("parse [keyid = %v] error :%v. skip to next key", k.Key.ID, err)
+					logger.WithConn(conn).Warnf("parse [keyid = %v] error :%v. skip to next key", k.Key.ID, err)
 					continue
 				}
 
@@ -84,18 +111,59 @@ func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.Additi
 	return c, &pipe, nil
 }
 
-func lookupDownstreamWithFallback(db *gorm.DB, user string) (*downstream, error) {
+// route is the downstream matched by a connection
+type route struct {
+	downstream *downstream
+
+	// matched by listen address of any user rather than username
+	anyUser bool
+}
+
+// lookupRoute finds downstream of user connected to local address,
+// by username, then listen addresses of any user, then fallback user
+func lookupRoute(db *gorm.DB, user string, local net.Addr) (*route, error) {
 	d, err := lookupDownstream(db, user)
 
-	if gorm.IsRecordNotFoundError(err) {
-		fallback, _ := lookupConfigValue(db, fallbackUserEntry)
+	if err == nil && upstreamprovider.MatchListen(d.listen(), local) {
+		return &route{downstream: d}, nil
+	}
+
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	var addrs []listenAddress
+	if err := db.Where(&listenAddress{AnyUser: true}).Order("id").Find(&addrs).Error; err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if !upstreamprovider.MatchListen([]string{a.Address}, local) {
+			continue
+		}
+
+		d := downstream{}
+		if err := db.Set("gorm:auto_preload", true).First(&d, a.DownstreamID).Error; err != nil {
+			return nil, err
+		}
+
+		return &route{downstream: &d, anyUser: true}, nil
+	}
+
+	fallback, _ := lookupConfigValue(db, fallbackUserEntry)
+
+	if len(fallback) > 0 {
+		d, err := lookupDownstream(db, fallback)
+		if err != nil {
+			return nil, err
+		}
 
-		if len(fallback) > 0 {
-			return lookupDownstream(db, fallback)
+		if upstreamprovider.MatchListen(d.listen(), local) {
+			return &route{downstream: d}, nil
 		}
 	}
 
-	return d, err
+	return nil, gorm.ErrRecordNotFound
 }
 
 func lookupDownstream(db *gorm.DB, user string) (*downstream, error) {
@@ -7,8 +7,10 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	upstreamprovider "github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
@@ -34,7 +36,7 @@ func newTestPlugin(t *testing.T) *plugin {
 
 	p.Config.File = "file::memory:?mode=memory&cache=shared"
 
-	err := p.Init(log.New(os.Stdout, "", 0))
+	err := p.Init(logging.FromStdLogger(log.New(os.Stdout, "", 0)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -121,6 +123,10 @@ func TestFindUpstream(t *testing.T) {
 
 	p := newTestPlugin(t)
 	defer p.db.Close()
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("database should be healthy %v", err)
+	}
 	db := p.db
 	h := p.GetHandler()
 
@@ -206,3 +212,192 @@ func createListener(t *testing.T) (net.Listener, error) {
 	go listener.Accept()
 	return listener, err
 }
+
+type addrconn struct {
+	testconn
+	addr net.Addr
+}
+
+func (c addrconn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestFindUpstreamSourceNetworks(t *testing.T) {
+
+	p := newTestPlugin(t)
+	defer p.db.Close()
+	db := p.db
+	h := p.GetHandler()
+
+	listener, err := createListener(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	createEntry(t, db, "acldown0", "aclup0", listener.Addr().String(), true)
+
+	d, err := lookupDownstream(db, "acldown0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []sourceNetwork{
+		{CIDR: "10.0.0.0/8", DownstreamID: int(d.ID)},
+		{CIDR: "10.0.0.1", Deny: true, DownstreamID: int(d.ID)},
+	} {
+		if err := db.Create(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := func(ip string) ssh.ConnMetadata {
+		return addrconn{testconn{"acldown0"}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 2222}}
+	}
+
+	if _, _, err := h(conn("10.0.0.2"), nil); err != nil {
+		t.Errorf("should allow 10.0.0.2 %v", err)
+	}
+
+	if _, _, err := h(conn("10.0.0.1"), nil); err == nil {
+		t.Errorf("should deny 10.0.0.1")
+	}
+
+	if _, _, err := h(conn("192.168.0.1"), nil); err == nil {
+		t.Errorf("should deny 192.168.0.1 not in allowed networks")
+	}
+}
+
+func TestCache(t *testing.T) {
+
+	p := newTestPlugin(t)
+	defer p.db.Close()
+
+	p.UseCache(upstreamprovider.NewCache(upstreamprovider.CacheOptions{TTL: time.Hour, NegativeTTL: time.Hour}))
+	defer p.UseCache(nil)
+
+	db := p.db
+	h := p.GetHandler()
+
+	listener, err := createListener(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, _, err := h(testconn{"cachedown0"}, nil); !upstreamprovider.IsNotFound(err) {
+		t.Fatalf("should not be found %v", err)
+	}
+
+	before, err := p.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createEntry(t, db, "cachedown0", "cacheup0", listener.Addr().String(), true)
+
+	after, err := p.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Errorf("fingerprint should change after insert")
+	}
+
+	if _, _, err := h(testconn{"cachedown0"}, nil); !upstreamprovider.IsNotFound(err) {
+		t.Errorf("not found should be cached %v", err)
+	}
+
+	p.cache.Invalidate("cachedown0")
+
+	_, pipe, err := h(testconn{"cachedown0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pipe.User != "cacheup0" {
+		t.Errorf("unexpected mapped user %v", pipe.User)
+	}
+
+	if err := p.RemovePipe("cachedown0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := h(testconn{"cachedown0"}, nil); !upstreamprovider.IsNotFound(err) {
+		t.Errorf("removed pipe should not be found %v", err)
+	}
+}
+
+type localconn struct {
+	testconn
+	local net.Addr
+}
+
+func (c localconn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func TestFindUpstreamListenAddresses(t *testing.T) {
+
+	p := newTestPlugin(t)
+	defer p.db.Close()
+	db := p.db
+	h := p.GetHandler()
+
+	listener, err := createListener(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	createEntry(t, db, "listendown0", "listenup0", listener.Addr().String(), true)
+	createEntry(t, db, "staging", "", listener.Addr().String(), true)
+
+	for user, l := range map[string]listenAddress{
+		"listendown0": {Address: ":2201"},
+		"staging":     {Address: "10.0.0.1:2202", AnyUser: true},
+	} {
+		d, err := lookupDownstream(db, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.DownstreamID = int(d.ID)
+		if err := db.Create(&l).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := func(user string, port int) ssh.ConnMetadata {
+		return localconn{testconn{user}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}}
+	}
+
+	if _, pipe, err := h(conn("listendown0", 2201), nil); err != nil || pipe.User != "listenup0" {
+		t.Errorf("listendown0 should be routed on 2201 %v", err)
+	}
+
+	if _, _, err := h(conn("listendown0", 2222), nil); !upstreamprovider.IsNotFound(err) {
+		t.Errorf("listendown0 should not be found on 2222 %v", err)
+	}
+
+	// any user on 2202 goes to staging with own username
+	for _, user := range []string{"alice", "listendown0"} {
+		_, pipe, err := h(conn(user, 2202), nil)
+		if err != nil {
+			t.Fatalf("%v should be routed to staging %v", user, err)
+		}
+
+		if pipe.User != user {
+			t.Errorf("%v should keep username, got %v", user, pipe.User)
+		}
+	}
+
+	if _, _, err := h(conn("alice", 2222), nil); !upstreamprovider.IsNotFound(err) {
+		t.Errorf("alice should not be found on 2222 %v", err)
+	}
+
+	if _, _, err := h(testconn{"staging"}, nil); !upstreamprovider.IsNotFound(err) {
+		t.Errorf("staging should not be found without local address %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"github.com/jinzhu/gorm"
+
+	upstreamprovider "github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
 type authMapType int
@@ -68,6 +70,28 @@ type authorizedKey struct {
 	DownstreamID int
 }
 
+// sourceNetwork is a CIDR or ip allowed or denied to use the downstream
+// downstream without any allowed network can be used from everywhere unless denied
+type sourceNetwork struct {
+	gorm.Model
+
+	CIDR string `gorm:"type:varchar(50)"`
+	Deny bool
+
+	DownstreamID int
+}
+
+// listenAddress limits the downstream to connections accepted on the address
+// address is host:port, :port or host. with AnyUser, all usernames connected to the address use the downstream
+type listenAddress struct {
+	gorm.Model
+
+	Address string `gorm:"type:varchar(100)"`
+	AnyUser bool
+
+	DownstreamID int
+}
+
 type downstream struct {
 	gorm.Model
 
@@ -77,7 +101,33 @@ type downstream struct {
 	UpstreamID int
 	Upstream   upstream
 
-	AuthorizedKeys []authorizedKey
+	AuthorizedKeys  []authorizedKey
+	SourceNetworks  []sourceNetwork
+	ListenAddresses []listenAddress
+}
+
+func (d *downstream) listen() []string {
+	var addrs []string
+
+	for _, l := range d.ListenAddresses {
+		addrs = append(addrs, l.Address)
+	}
+
+	return addrs
+}
+
+func (d *downstream) sourceACL() upstreamprovider.SourceACL {
+	var acl upstreamprovider.SourceACL
+
+	for _, n := range d.SourceNetworks {
+		if n.Deny {
+			acl.Denied = append(acl.Denied, n.CIDR)
+		} else {
+			acl.Allowed = append(acl.Allowed, n.CIDR)
+		}
+	}
+
+	return acl
 }
 
 type config struct {
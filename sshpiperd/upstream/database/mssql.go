@@ -43,7 +43,7 @@ func (p *mssqlplugin) create() (*gorm.DB, error) {
 	return db, nil
 }
 
-func (mssqlplugin) GetName() string {
+func (*mssqlplugin) GetName() string {
 	return "mssql"
 }
 
@@ -40,7 +40,7 @@ func (p *mysqlplugin) create() (*gorm.DB, error) {
 	return db, nil
 }
 
-func (mysqlplugin) GetName() string {
+func (*mysqlplugin) GetName() string {
 	return "mysql"
 }
 
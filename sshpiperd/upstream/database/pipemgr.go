@@ -9,7 +9,7 @@ import (
 )
 
 func (p *plugin) ListPipe() ([]upstreamprovider.Pipe, error) {
-	db := p.db
+	db := p.database()
 
 	downstreams := make([]downstream, 0)
 	err := db.Set("gorm:auto_preload", true).Find(&downstreams).Error
@@ -44,7 +44,8 @@ func (p *plugin) ListPipe() ([]upstreamprovider.Pipe, error) {
 }
 
 func (p *plugin) CreatePipe(opt upstreamprovider.CreatePipeOption) error {
-	db := p.db
+	db := p.database()
+	defer p.cache.Purge()
 
 	return db.Create(&downstream{
 		Username: opt.Username,
@@ -60,7 +61,7 @@ func (p *plugin) CreatePipe(opt upstreamprovider.CreatePipeOption) error {
 }
 
 func (p *plugin) RemovePipe(name string) error {
-	db := p.db
+	db := p.database()
 
 	d, err := lookupDownstream(db, name)
 	if err != nil {
@@ -71,5 +72,7 @@ func (p *plugin) RemovePipe(name string) error {
 
 		return err
 	}
+
+	defer p.cache.Purge()
 	return db.Unscoped().Delete(d).Error
 }
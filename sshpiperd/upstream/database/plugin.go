@@ -1,14 +1,17 @@
 package database
 
 import (
-	"log"
+	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/jinzhu/gorm"
 
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	upstreamprovider "github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
-var logger *log.Logger
+var logger logging.Logger
 
 type createdb interface {
 	create() (*gorm.DB, error)
@@ -17,14 +20,81 @@ type createdb interface {
 type plugin struct {
 	createdb
 
-	db *gorm.DB
+	mu    sync.RWMutex
+	db    *gorm.DB
+	cache *upstreamprovider.Cache
+}
+
+// database returns the db of last Init, nil if not initialized
+func (p *plugin) database() *gorm.DB {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.db
 }
 
 func (p *plugin) GetHandler() upstreamprovider.Handler {
 	return p.findUpstream
 }
 
-func (p *plugin) Init(glogger *log.Logger) error {
+// The database must be reachable
+func (p *plugin) HealthCheck() error {
+	db := p.database()
+	if db == nil {
+		return fmt.Errorf("database is not initialized")
+	}
+
+	return db.DB().Ping()
+}
+
+// Downstreams are cached until any table changes
+func (p *plugin) UseCache(cache *upstreamprovider.Cache) {
+	p.cache = cache
+}
+
+// Changes when rows are added, updated or removed
+func (p *plugin) Fingerprint() (string, error) {
+	db := p.database()
+	if db == nil {
+		return "", fmt.Errorf("database is not initialized")
+	}
+
+	var fp []string
+
+	for _, m := range []interface{}{
+		new(keydata),
+		new(privateKey),
+		new(hostKey),
+		new(server),
+		new(upstream),
+		new(authorizedKey),
+		new(downstream),
+		new(sourceNetwork),
+		new(listenAddress),
+		new(config),
+	} {
+		s := db.Unscoped().Model(m)
+
+		var count, updated, deleted interface{}
+
+		// soft deletion only sets deleted_at
+		if db.NewScope(m).HasColumn("updated_at") {
+			s = s.Select("count(*), max(updated_at), max(deleted_at)")
+		} else {
+			s = s.Select("count(*), null, null")
+		}
+
+		if err := s.Row().Scan(&count, &updated, &deleted); err != nil {
+			return "", err
+		}
+
+		fp = append(fp, fmt.Sprintf("%v %v %v", count, updated, deleted))
+	}
+
+	return strings.Join(fp, ","), nil
+}
+
+func (p *plugin) Init(glogger logging.Logger) error {
 
 	logger = glogger
 
@@ -44,6 +114,8 @@ func (p *plugin) Init(glogger *log.Logger) error {
 		new(upstream),
 		new(authorizedKey),
 		new(downstream),
+		new(sourceNetwork),
+		new(listenAddress),
 		new(config),
 	).Error
 
@@ -51,10 +123,15 @@ func (p *plugin) Init(glogger *log.Logger) error {
 		logger.Printf("AutoMigrate error: %v", err)
 	}
 
+	// queries started on the db of previous Init are finished before it is closed
+	p.mu.Lock()
+	old := p.db
 	p.db = db
+	p.mu.Unlock()
 
-	// plugin is alive within program lifecycle, close when unload added
-	// defer db.Close()
+	if old != nil {
+		old.Close()
+	}
 
 	return nil
 }
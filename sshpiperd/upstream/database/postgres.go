@@ -47,7 +47,7 @@ func (p *postgresplugin) create() (*gorm.DB, error) {
 	return db, nil
 }
 
-func (postgresplugin) GetName() string {
+func (*postgresplugin) GetName() string {
 	return "postgres"
 }
 
@@ -25,7 +25,7 @@ func (p *sqliteplugin) create() (*gorm.DB, error) {
 	return db, nil
 }
 
-func (sqliteplugin) GetName() string {
+func (*sqliteplugin) GetName() string {
 	return "sqlite"
 }
 
@@ -0,0 +1,385 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// oldest engine api version supporting filters used here
+const apiVersion = "v1.24"
+
+// container is the part of GET /containers/json response used by the driver
+type container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+
+	Mounts []mount `json:"Mounts"`
+}
+
+// mount is a volume or bind mount, Source is the path on host
+type mount struct {
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+}
+
+func (c *container) String() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+
+	return c.ID
+}
+
+func (p *plugin) label(c *container, name string) string {
+	return c.Labels[p.Config.LabelPrefix+name]
+}
+
+func (p *plugin) usernames(c *container) []string {
+	var users []string
+
+	for _, u := range strings.Split(p.label(c, "username"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			users = append(users, u)
+		}
+	}
+
+	return users
+}
+
+func (p *plugin) get(api string, query url.Values, v interface{}) error {
+	u := p.base + "/" + apiVersion + api
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker api %v returned %v: %v", api, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (p *plugin) ping() error {
+	return p.get("/_ping", nil, nil)
+}
+
+// containers lists running containers having username label
+func (p *plugin) containers() ([]container, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"label":  {p.Config.LabelPrefix + "username"},
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cs []container
+	if err := p.get("/containers/json", url.Values{"filters": {string(filters)}}, &cs); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// findContainer returns the only running container labelled with user
+func (p *plugin) findContainer(user string) (*container, error) {
+	cs, err := p.containers()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*container
+
+	for i := range cs {
+		for _, u := range p.usernames(&cs[i]) {
+			if u == user {
+				found = append(found, &cs[i])
+				break
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, &upstream.NotFoundError{User: user}
+	case 1:
+		return found[0], nil
+	}
+
+	var names []string
+	for _, c := range found {
+		names = append(names, c.String())
+	}
+
+	return nil, fmt.Errorf("username [%v] is ambiguous: containers %v", user, strings.Join(names, ", "))
+}
+
+// ip returns ip of the network in label or config, or the first network having ip by name
+func (p *plugin) ip(c *container) (string, error) {
+	networks := c.NetworkSettings.Networks
+
+	network := p.label(c, "network")
+	if network == "" {
+		network = p.Config.Network
+	}
+
+	if network != "" {
+		n, ok := networks[network]
+		if !ok || n.IPAddress == "" {
+			return "", fmt.Errorf("container %v has no ip in network %v", c, network)
+		}
+
+		return n.IPAddress, nil
+	}
+
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+
+	return "", fmt.Errorf("container %v has no ip", c)
+}
+
+func (p *plugin) address(c *container) (string, error) {
+	ip, err := p.ip(c)
+	if err != nil {
+		return "", err
+	}
+
+	port := 22
+	if s := p.label(c, "port"); s != "" {
+		port, err = strconv.Atoi(s)
+		if err != nil {
+			return "", fmt.Errorf("bad port label %q of container %v", s, c)
+		}
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// hostPath maps path inside container to host by the mount containing it
+func hostPath(c *container, file string) (string, error) {
+	file = path.Clean(file)
+
+	best := -1
+	for i, m := range c.Mounts {
+		dest := path.Clean(m.Destination)
+
+		if file != dest && !strings.HasPrefix(file, strings.TrimSuffix(dest, "/")+"/") {
+			continue
+		}
+
+		if best < 0 || len(dest) > len(path.Clean(c.Mounts[best].Destination)) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return "", fmt.Errorf("%v is not on a mount of container %v", file, c)
+	}
+
+	m := c.Mounts[best]
+	rel := strings.TrimPrefix(file, path.Clean(m.Destination))
+
+	return path.Join(m.Source, rel), nil
+}
+
+// material reads key material from label name, or file in label name-path mounted from host
+func (p *plugin) material(c *container, name string) (string, error) {
+	if v := p.label(c, name); v != "" {
+		return v, nil
+	}
+
+	file := p.label(c, name+"-path")
+	if file == "" {
+		return "", nil
+	}
+
+	host, err := hostPath(c, file)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(host)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// pipeSpec converts labels of container to upstream.PipeSpec
+func (p *plugin) pipeSpec(c *container) (*upstream.PipeSpec, error) {
+	addr, err := p.address(c)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &upstream.PipeSpec{
+		Address:       addr,
+		User:          p.label(c, "mapped-user"),
+		IgnoreHostKey: p.label(c, "ignore-host-key") == "true",
+		Auth: upstream.AuthSpec{
+			NoPassthrough: p.label(c, "no-passthrough") == "true",
+		},
+	}
+
+	if spec.HostKey, err = p.material(c, "host-key"); err != nil {
+		return nil, err
+	}
+
+	if spec.Auth.AuthorizedKeys, err = p.material(c, "authorized-keys"); err != nil {
+		return nil, err
+	}
+
+	// private keys are never read from labels, which anyone able to inspect the container can see
+	if file := p.label(c, "private-key-path"); file != "" {
+		host, err := hostPath(c, file)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadFile(host)
+		if err != nil {
+			return nil, err
+		}
+
+		spec.Auth.Type = upstream.AuthTypePrivateKey
+		spec.Auth.PrivateKey = string(data)
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) lookup(user string) (*upstream.PipeSpec, error) {
+	v, err := p.cache.Get(user, "", func() (interface{}, error) {
+		c, err := p.findContainer(user)
+		if err != nil {
+			return nil, err
+		}
+
+		spec, err := p.pipeSpec(c)
+		if err != nil {
+			return nil, fmt.Errorf("container %v: %v", c, err)
+		}
+
+		return spec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*upstream.PipeSpec), nil
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	spec, err := p.lookup(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := spec.AuthPipe(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": spec.Address, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v]", user, a.User, spec.Address)
+
+	c, err := upstream.DialForSSH(spec.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
+
+// Return pipes of running labelled containers, those without ip are skipped
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	cs, err := p.containers()
+	if err != nil {
+		return nil, err
+	}
+
+	var pipes []upstream.Pipe
+
+	for i := range cs {
+		c := &cs[i]
+
+		addr, err := p.address(c)
+		if err != nil {
+			p.logger.Debugf("skip %v", err)
+			continue
+		}
+
+		host, port, err := upstream.SplitHostPortForSSH(addr)
+		if err != nil {
+			continue
+		}
+
+		for _, user := range p.usernames(c) {
+			mapped := p.label(c, "mapped-user")
+			if mapped == "" {
+				mapped = user
+			}
+
+			pipes = append(pipes, upstream.Pipe{
+				Username:         user,
+				UpstreamUsername: mapped,
+				Host:             host,
+				Port:             port,
+				Source:           "container " + c.String(),
+			})
+		}
+	}
+
+	return pipes, nil
+}
@@ -0,0 +1,293 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+// engine is a fake docker engine api serving containers on a unix socket
+type engine struct {
+	l    net.Listener
+	dir  string
+	srv  *http.Server
+	mu   sync.Mutex
+	cs   []map[string]interface{}
+	hits int
+}
+
+func newEngine(t *testing.T) *engine {
+	dir, err := ioutil.TempDir("", "sshpiperd_docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &engine{l: l, dir: dir}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+apiVersion+"/_ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/"+apiVersion+"/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		e.hits++
+
+		cs := []map[string]interface{}{}
+		for _, c := range e.cs {
+			if _, ok := c["Labels"].(map[string]string)[filters["label"][0]]; ok {
+				cs = append(cs, c)
+			}
+		}
+
+		json.NewEncoder(w).Encode(cs)
+	})
+
+	e.srv = &http.Server{Handler: mux}
+	go e.srv.Serve(l)
+
+	return e
+}
+
+func (e *engine) host() string {
+	return "unix://" + e.l.Addr().String()
+}
+
+func (e *engine) close() {
+	e.srv.Close()
+	os.RemoveAll(e.dir)
+}
+
+func (e *engine) run(name string, labels map[string]string, networks map[string]string, mounts map[string]string) {
+	ns := make(map[string]interface{})
+	for n, ip := range networks {
+		ns[n] = map[string]string{"IPAddress": ip}
+	}
+
+	var ms []map[string]string
+	for dest, src := range mounts {
+		ms = append(ms, map[string]string{"Type": "bind", "Source": src, "Destination": dest})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.cs = append(e.cs, map[string]interface{}{
+		"Id":              strings.Repeat(name, 64/len(name)+1)[:64],
+		"Names":           []string{"/" + name},
+		"State":           "running",
+		"Labels":          labels,
+		"NetworkSettings": map[string]interface{}{"Networks": ns},
+		"Mounts":          ms,
+	})
+}
+
+func newTestPlugin(t *testing.T, e *engine) *plugin {
+	p := &plugin{}
+	p.Config.Host = e.host()
+	p.Config.LabelPrefix = "sshpiper."
+	p.Config.Timeout = 5 * time.Second
+
+	upstreamtest.Init(t, p)
+
+	return p
+}
+
+func TestFindUpstream(t *testing.T) {
+	up := upstreamtest.Listen(t)
+	defer up.Close()
+
+	_, port, _ := net.SplitHostPort(up.Addr().String())
+
+	e := newEngine(t)
+	defer e.close()
+
+	// home of alice on host mounted to the container
+	home := path.Join(e.dir, "alice")
+	if err := os.MkdirAll(path.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(home, ".ssh", "authorized_keys"), ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "rsa")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(home, ".ssh", "id_ed25519"), testdata.PEMBytes["ed25519"], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e.run("alice-box", map[string]string{
+		"sshpiper.username":             "alice",
+		"sshpiper.port":                 port,
+		"sshpiper.mapped-user":          "root",
+		"sshpiper.host-key":             string(ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "ecdsa"))),
+		"sshpiper.authorized-keys-path": "/home/alice/.ssh/authorized_keys",
+		"sshpiper.private-key-path":     "/home/alice/.ssh/id_ed25519",
+	}, map[string]string{"bridge": "", "build": "127.0.0.1"}, map[string]string{"/home/alice": home, "/": "/nonexistent"})
+
+	e.run("bob-box", map[string]string{
+		"sshpiper.username":        "bob, carol",
+		"sshpiper.port":            port,
+		"sshpiper.network":         "build",
+		"sshpiper.ignore-host-key": "true",
+	}, map[string]string{"bridge": "172.17.0.3", "build": "127.0.0.1"}, nil)
+
+	e.run("carol-box", map[string]string{"sshpiper.username": "carol"}, map[string]string{"bridge": "172.17.0.4"}, nil)
+	e.run("unlabelled", map[string]string{"other": "x"}, map[string]string{"bridge": "172.17.0.5"}, nil)
+
+	p := newTestPlugin(t, e)
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream of alice failed %v", err)
+	}
+	c.Close()
+
+	if pipe.User != "root" {
+		t.Errorf("unexpected mapped user %v", pipe.User)
+	}
+
+	if err := pipe.UpstreamHostKeyCallback("", nil, upstreamtest.PublicKey(t, "ecdsa")); err != nil {
+		t.Errorf("host key from label should be accepted %v", err)
+	}
+
+	if err := pipe.UpstreamHostKeyCallback("", nil, upstreamtest.PublicKey(t, "rsa")); err == nil {
+		t.Errorf("other host key should be rejected")
+	}
+
+	if typ, method, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "rsa")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("mounted authorized key should be mapped to mounted private key")
+	}
+
+	c, pipe, err = h(upstreamtest.Conn{Username: "bob"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream of bob failed %v", err)
+	}
+	c.Close()
+
+	if pipe.User != "bob" {
+		t.Errorf("bob should keep username, got %v", pipe.User)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "carol"}, nil); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("carol should be ambiguous %v", err)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "mallory"}, nil); !upstream.IsNotFound(err) {
+		t.Errorf("mallory should not be found %v", err)
+	}
+
+	pipes, err := p.ListPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 4 {
+		t.Errorf("unexpected pipes %v", pipes)
+	}
+
+	for _, pipe := range pipes {
+		if pipe.Username == "carol" && pipe.Source == "container bob-box" && pipe.Host != "127.0.0.1" {
+			t.Errorf("ip should be taken from network label %v", pipe)
+		}
+	}
+
+	e.close()
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("should not be healthy when engine is down")
+	}
+}
+
+func TestCache(t *testing.T) {
+	e := newEngine(t)
+	defer e.close()
+
+	e.run("alice-box", map[string]string{"sshpiper.username": "alice", "sshpiper.ignore-host-key": "true"}, map[string]string{"bridge": "172.17.0.2"}, nil)
+
+	p := newTestPlugin(t, e)
+	p.UseCache(upstream.NewCache(upstream.CacheOptions{TTL: time.Hour}))
+
+	for i := 0; i < 3; i++ {
+		spec, err := p.lookup("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spec.Address != "172.17.0.2:22" {
+			t.Errorf("unexpected address %v", spec.Address)
+		}
+	}
+
+	if e.hits != 1 {
+		t.Errorf("lookups should be cached, engine hit %v times", e.hits)
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	c := &container{Names: []string{"/box"}, Mounts: []mount{
+		{Source: "/srv/home", Destination: "/home"},
+		{Source: "/srv/alice", Destination: "/home/alice/"},
+	}}
+
+	for in, expected := range map[string]string{
+		"/home/bob/.ssh/id_rsa":            "/srv/home/bob/.ssh/id_rsa",
+		"/home/alice/.ssh/authorized_keys": "/srv/alice/.ssh/authorized_keys",
+		"/home/alice/../bob/key":           "/srv/home/bob/key",
+		"/home":                            "/srv/home",
+	} {
+		out, err := hostPath(c, in)
+		if err != nil || out != expected {
+			t.Errorf("host path of %v expect %v got %v %v", in, expected, out, err)
+		}
+	}
+
+	for _, in := range []string{"/etc/passwd", "/homeless/key"} {
+		if _, err := hostPath(c, in); err == nil {
+			t.Errorf("%v should not be mapped", in)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	for _, host := range []string{"npipe:////./pipe/docker_engine", "unix://", "::bad"} {
+		if _, _, err := transport(host); err == nil {
+			t.Errorf("%v should be rejected", host)
+		}
+	}
+
+	if _, base, err := transport("tcp://127.0.0.1:2375"); err != nil || base != "http://127.0.0.1:2375" {
+		t.Errorf("unexpected base %v %v", base, err)
+	}
+}
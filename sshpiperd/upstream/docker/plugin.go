@@ -0,0 +1,123 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type plugin struct {
+	Config struct {
+		Host        string        `long:"upstream-docker-host" description:"Docker Engine API address, unix:///path/to/docker.sock or tcp://host:port" default:"unix:///var/run/docker.sock" env:"SSHPIPERD_UPSTREAM_DOCKER_HOST" ini-name:"upstream-docker-host"`
+		LabelPrefix string        `long:"upstream-docker-label-prefix" description:"Prefix of labels of containers, e.g. sshpiper.username" default:"sshpiper." env:"SSHPIPERD_UPSTREAM_DOCKER_LABEL_PREFIX" ini-name:"upstream-docker-label-prefix"`
+		Network     string        `long:"upstream-docker-network" description:"Network to take container ip from, overridden by network label. The first network having an ip if empty" env:"SSHPIPERD_UPSTREAM_DOCKER_NETWORK" ini-name:"upstream-docker-network"`
+		Timeout     time.Duration `long:"upstream-docker-timeout" description:"Timeout of docker api calls" default:"5s" env:"SSHPIPERD_UPSTREAM_DOCKER_TIMEOUT" ini-name:"upstream-docker-timeout"`
+	}
+
+	logger logging.Logger
+	client *http.Client
+	base   string
+	cache  *upstream.Cache
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "docker"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+// Use the daemon wide cache
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.cache = cache
+}
+
+// transport dials the docker host regardless of the host in request url
+func transport(host string) (*http.Transport, string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("bad docker host %v: %v", host, err)
+	}
+
+	var network, addr string
+
+	switch u.Scheme {
+	case "unix":
+		network, addr = "unix", u.Path
+	case "tcp", "http":
+		network, addr = "tcp", u.Host
+	default:
+		return nil, "", fmt.Errorf("unsupported docker host %v, expect unix:// or tcp://", host)
+	}
+
+	if addr == "" {
+		return nil, "", fmt.Errorf("bad docker host %v: empty address", host)
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	base := "http://docker"
+	if network == "tcp" {
+		base = "http://" + addr
+	}
+
+	return t, base, nil
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	t, base, err := transport(p.Config.Host)
+	if err != nil {
+		return err
+	}
+
+	p.client = &http.Client{
+		Transport: t,
+		Timeout:   p.Config.Timeout,
+	}
+	p.base = base
+
+	logger.Printf("upstream provider: docker from [%v] initializing", p.Config.Host)
+
+	return nil
+}
+
+// Docker engine must answer ping
+func (p *plugin) HealthCheck() error {
+	return p.ping()
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+// Pipes are managed by labels of containers
+
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return fmt.Errorf("pipes are managed by labels of containers, not supported by docker driver")
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	return fmt.Errorf("pipes are managed by labels of containers, not supported by docker driver")
+}
+
+func init() {
+	upstream.Register("docker", &plugin{})
+}
@@ -0,0 +1,156 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// max bytes of stderr kept for error message
+const maxStderr = 1024
+
+// cappedBuffer stops taking data after max bytes
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		b.overflow = true
+		b.buf.Write(p[:b.max-b.buf.Len()])
+		return 0, fmt.Errorf("output exceeds %v bytes", b.max)
+	}
+
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// environment variables passed to the command from sshpiperd, others, e.g. SSHPIPERD_* options holding passwords, are not
+var envAllowlist = []string{"PATH", "HOME", "USER", "LANG", "TZ", "TMPDIR"}
+
+func env(req *upstream.LookupRequest) []string {
+	var e []string
+
+	for _, name := range envAllowlist {
+		if v, ok := os.LookupEnv(name); ok {
+			e = append(e, name+"="+v)
+		}
+	}
+
+	e = append(e,
+		"SSHPIPERD_USER="+req.User,
+		"SSHPIPERD_REMOTE_ADDR="+req.RemoteAddr,
+		"SSHPIPERD_REMOTE_IP="+req.RemoteIP,
+		"SSHPIPERD_LOCAL_ADDR="+req.LocalAddr,
+		"SSHPIPERD_CLIENT_VERSION="+req.ClientVersion,
+	)
+
+	if req.Challenger != nil {
+		e = append(e,
+			"SSHPIPERD_CHALLENGER="+req.Challenger.Name,
+			"SSHPIPERD_CHALLENGED_USER="+req.Challenger.Username,
+		)
+	}
+
+	return e
+}
+
+func (p *plugin) run(req *upstream.LookupRequest) (*upstream.PipeSpec, error) {
+	input, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(p.Config.Command, p.Config.Args...)
+	setProcessGroup(cmd)
+
+	stdout := &cappedBuffer{max: p.Config.MaxOutput}
+	stderr := &cappedBuffer{max: maxStderr}
+
+	cmd.Env = env(req)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("command %v failed for [%v]: %v", p.Config.Command, req.User, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(p.Config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		// Wait returns only after children holding stdout exit, they are killed with the group and reaped in background
+		killProcessGroup(cmd)
+		return nil, fmt.Errorf("command %v timed out after %v", p.Config.Command, p.Config.Timeout)
+	}
+
+	if stdout.overflow {
+		return nil, fmt.Errorf("output of command %v exceeds %v bytes", p.Config.Command, p.Config.MaxOutput)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("command %v failed for [%v]: %v %v", p.Config.Command, req.User, err, string(bytes.TrimSpace(stderr.Bytes())))
+	}
+
+	spec := &upstream.PipeSpec{}
+	if err := json.Unmarshal(stdout.Bytes(), spec); err != nil {
+		return nil, fmt.Errorf("bad output of command %v: %v", p.Config.Command, err)
+	}
+
+	if spec.Address == "" {
+		return nil, fmt.Errorf("bad output of command %v: empty address", p.Config.Command)
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) lookup(req *upstream.LookupRequest) (*upstream.PipeSpec, error) {
+	return p.cache.GetSpec(req, func() (*upstream.PipeSpec, error) {
+		return p.run(req)
+	})
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	spec, err := p.lookup(upstream.NewLookupRequest(conn, challengeContext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := spec.AuthPipe(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": spec.Address, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v]", user, a.User, spec.Address)
+
+	c, err := upstream.DialForSSH(spec.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
@@ -0,0 +1,156 @@
+package exec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+func newTestPlugin(t *testing.T, script string, config func(p *plugin)) (*plugin, func()) {
+	dir, err := ioutil.TempDir("", "sshpiperd_exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := filepath.Join(dir, "route.sh")
+	if err := ioutil.WriteFile(cmd, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &plugin{}
+	p.Config.Command = cmd
+	p.Config.Timeout = 5 * time.Second
+	p.Config.MaxOutput = 65536
+
+	if config != nil {
+		config(p)
+	}
+
+	upstreamtest.Init(t, p)
+
+	return p, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFindUpstream(t *testing.T) {
+	l := upstreamtest.Listen(t)
+	defer l.Close()
+
+	os.Setenv("SSHPIPERD_UPSTREAM_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("SSHPIPERD_UPSTREAM_TEST_PASSWORD")
+
+	// echo stdin back to stderr when user is unknown
+	p, cleanup := newTestPlugin(t, `
+if [ "$SSHPIPERD_USER" != "alice" ] || [ "$SSHPIPERD_REMOTE_IP" != "10.0.0.1" ]; then
+	cat >&2
+	exit 1
+fi
+
+grep -q '"client_version":"SSH-2.0-test"' || exit 2
+[ -z "$SSHPIPERD_UPSTREAM_TEST_PASSWORD" ] || exit 3
+
+echo "{\"address\": \"$1\", \"user\": \"bob\", \"ignore_host_key\": true, \"auth\": {\"type\": \"password\", \"password\": \"secret\", \"downstream_password\": \"pass\"}}"
+`, func(p *plugin) {
+		p.Config.Args = []string{l.Addr().String()}
+	})
+	defer cleanup()
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+
+	if c.RemoteAddr().String() != l.Addr().String() || pipe.User != "bob" {
+		t.Errorf("unexpected pipe %v %v", c.RemoteAddr(), pipe.User)
+	}
+
+	if typ, method, _ := pipe.PasswordCallback(nil, []byte("pass")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("password should be mapped")
+	}
+
+	_, _, err = h(upstreamtest.Conn{Username: "eve"}, nil)
+	if err == nil {
+		t.Fatalf("eve should not be found")
+	}
+
+	if !strings.Contains(err.Error(), `"user":"eve"`) {
+		t.Errorf("stderr should be in error %v", err)
+	}
+}
+
+func TestTimeoutAndMaxOutput(t *testing.T) {
+	// without exec, sleep is a child of the shell holding stdout
+	for _, script := range []string{"exec sleep 10", "sleep 10; echo {}"} {
+		p, cleanup := newTestPlugin(t, script, func(p *plugin) {
+			p.Config.Timeout = 100 * time.Millisecond
+		})
+		defer cleanup()
+
+		start := time.Now()
+		if _, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice"}, nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("%v should time out %v", script, err)
+		}
+
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("%v should be killed", script)
+		}
+	}
+
+	p, cleanup := newTestPlugin(t, `head -c 2048 /dev/zero`, func(p *plugin) {
+		p.Config.MaxOutput = 1024
+	})
+	defer cleanup()
+
+	if _, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice"}, nil); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("should fail with too much output %v", err)
+	}
+
+	p, cleanup = newTestPlugin(t, `echo '{"address": ""}'`, nil)
+	defer cleanup()
+
+	if _, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice"}, nil); err == nil {
+		t.Errorf("should fail with empty address")
+	}
+}
+
+func TestCache(t *testing.T) {
+	l := upstreamtest.Listen(t)
+	defer l.Close()
+
+	p, cleanup := newTestPlugin(t, `
+echo run >> "$0.log"
+echo "{\"address\": \"$1\", \"ignore_host_key\": true}"
+`, func(p *plugin) {
+		p.Config.Args = []string{l.Addr().String()}
+		p.Config.CacheTTL = time.Hour
+	})
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		c, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice"}, nil)
+		if err != nil {
+			t.Fatalf("find upstream failed %v", err)
+		}
+		c.Close()
+	}
+
+	log, err := ioutil.ReadFile(p.Config.Command + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(string(log), "run"); n != 1 {
+		t.Errorf("command should run once, got %v", n)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// the command runs in its own process group, so children it starts are killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,13 @@
+package exec
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// children of the command are not killed on windows
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
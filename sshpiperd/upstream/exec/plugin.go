@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type plugin struct {
+	Config struct {
+		Command   string        `long:"upstream-exec-command" description:"Command which prints upstream of the downstream user in json" env:"SSHPIPERD_UPSTREAM_EXEC_COMMAND" ini-name:"upstream-exec-command"`
+		Args      []string      `long:"upstream-exec-arg" description:"Argument passed to the command, can be repeated" env:"SSHPIPERD_UPSTREAM_EXEC_ARGS" env-delim:"," ini-name:"upstream-exec-arg"`
+		Timeout   time.Duration `long:"upstream-exec-timeout" description:"Kill the command if it does not exit in time" default:"5s" env:"SSHPIPERD_UPSTREAM_EXEC_TIMEOUT" ini-name:"upstream-exec-timeout"`
+		MaxOutput int           `long:"upstream-exec-max-output" description:"Max bytes of stdout, the command fails if it prints more" default:"65536" env:"SSHPIPERD_UPSTREAM_EXEC_MAX_OUTPUT" ini-name:"upstream-exec-max-output"`
+		CacheTTL  time.Duration `long:"upstream-exec-cache-ttl" description:"Cache successful outputs for this long, 0 to disable" default:"0" env:"SSHPIPERD_UPSTREAM_EXEC_CACHE_TTL" ini-name:"upstream-exec-cache-ttl"`
+	}
+
+	logger logging.Logger
+	cache  *upstream.Cache
+	shared *upstream.Cache
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "exec"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+// Use the daemon wide cache unless own cache ttl is set
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.shared = cache
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	if p.Config.Command == "" {
+		return fmt.Errorf("upstream-exec-command is required")
+	}
+
+	path, err := exec.LookPath(p.Config.Command)
+	if err != nil {
+		return err
+	}
+
+	p.Config.Command = path
+	p.cache = p.shared
+	if p.Config.CacheTTL > 0 {
+		p.cache = upstream.NewCache(upstream.CacheOptions{TTL: p.Config.CacheTTL})
+	}
+
+	logger.Printf("upstream provider: exec [%v] initializing", p.Config.Command)
+
+	return nil
+}
+
+// The command must still be executable
+func (p *plugin) HealthCheck() error {
+	_, err := exec.LookPath(p.Config.Command)
+	return err
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+// Pipes are managed by the command
+
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	return nil, fmt.Errorf("pipes are managed by %v, not supported by exec driver", p.Config.Command)
+}
+
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return fmt.Errorf("pipes are managed by %v, not supported by exec driver", p.Config.Command)
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	return fmt.Errorf("pipes are managed by %v, not supported by exec driver", p.Config.Command)
+}
+
+func init() {
+	upstream.Register("exec", &plugin{})
+}
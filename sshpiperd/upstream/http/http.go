@@ -0,0 +1,133 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// max size of response body
+const maxResponseSize = 1 << 20
+
+// statusError is a non 2xx response, 5xx is retried
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad http status code %v: %v", e.code, e.body)
+}
+
+func (e *statusError) retryable() bool {
+	return e.code >= 500
+}
+
+func (p *plugin) post(body []byte) (*upstream.PipeSpec, error) {
+	req, err := http.NewRequest("POST", p.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range p.headers {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &statusError{resp.StatusCode, string(bytes.TrimSpace(data))}
+	}
+
+	spec := &upstream.PipeSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("bad response from %v: %v", p.Config.URL, err)
+	}
+
+	if spec.Address == "" {
+		return nil, fmt.Errorf("bad response from %v: empty address", p.Config.URL)
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) postWithRetry(body []byte) (*upstream.PipeSpec, error) {
+	for i := 0; ; i++ {
+		spec, err := p.post(body)
+		if err == nil {
+			return spec, nil
+		}
+
+		if e, ok := err.(*statusError); ok && !e.retryable() {
+			return nil, err
+		}
+
+		if i >= p.Config.Retries {
+			return nil, err
+		}
+
+		p.logger.Debugf("request to %v failed, retrying: %v", p.Config.URL, err)
+		time.Sleep(p.Config.RetryInterval)
+	}
+}
+
+func (p *plugin) lookup(req *upstream.LookupRequest) (*upstream.PipeSpec, error) {
+	body, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.cache.GetSpec(req, func() (*upstream.PipeSpec, error) {
+		spec, err := p.postWithRetry(body)
+		if e, ok := err.(*statusError); ok && e.code == http.StatusNotFound {
+			return nil, &upstream.NotFoundError{User: req.User}
+		}
+
+		return spec, err
+	})
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	spec, err := p.lookup(upstream.NewLookupRequest(conn, challengeContext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := spec.AuthPipe(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": spec.Address, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v]", user, a.User, spec.Address)
+
+	c, err := upstream.DialForSSH(spec.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
@@ -0,0 +1,279 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+func newTestPlugin(t *testing.T, url string, config func(p *plugin)) *plugin {
+	p := &plugin{}
+	p.Config.URL = url
+	p.Config.Timeout = time.Second
+	p.Config.RetryInterval = time.Millisecond
+
+	if config != nil {
+		config(p)
+	}
+
+	upstreamtest.Init(t, p)
+
+	return p
+}
+
+func TestFindUpstream(t *testing.T) {
+	l := upstreamtest.Listen(t)
+	defer l.Close()
+
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req upstream.LookupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.User != "alice" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if req.RemoteIP != "10.0.0.1" || req.LocalAddr != "127.0.0.1:2222" || req.ClientVersion != "SSH-2.0-test" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(upstream.PipeSpec{
+			Address:       l.Addr().String(),
+			User:          "bob",
+			IgnoreHostKey: true,
+			Auth: upstream.AuthSpec{
+				Type:               upstream.AuthTypePassword,
+				Password:           "secret",
+				DownstreamPassword: "pass",
+			},
+		})
+	}))
+	defer srv.Close()
+
+	p := newTestPlugin(t, srv.URL, func(p *plugin) {
+		p.Config.Headers = []string{"Authorization: Bearer token"}
+	})
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice", Port: 1}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+
+	if c.RemoteAddr().String() != l.Addr().String() || pipe.User != "bob" {
+		t.Errorf("unexpected pipe %v %v", c.RemoteAddr(), pipe.User)
+	}
+
+	if typ, method, _ := pipe.PasswordCallback(nil, []byte("pass")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("password should be mapped")
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "eve", Port: 1}, nil); err == nil || err.Error() != "username [eve] not found" {
+		t.Errorf("eve should not be found %v", err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expect 2 requests, 4xx should not be retried, got %v", n)
+	}
+}
+
+func TestRetryAndCache(t *testing.T) {
+	l := upstreamtest.Listen(t)
+	defer l.Close()
+
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(upstream.PipeSpec{
+			Address:       l.Addr().String(),
+			IgnoreHostKey: true,
+		})
+	}))
+	defer srv.Close()
+
+	p := newTestPlugin(t, srv.URL, func(p *plugin) {
+		p.Config.Retries = 1
+		p.Config.CacheTTL = time.Hour
+	})
+
+	h := p.GetHandler()
+
+	for port := 1; port <= 3; port++ {
+		c, pipe, err := h(upstreamtest.Conn{Username: "alice", Port: port}, nil)
+		if err != nil {
+			t.Fatalf("find upstream failed %v", err)
+		}
+		c.Close()
+
+		if pipe.User != "alice" {
+			t.Errorf("downstream user should be used %v", pipe.User)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expect 1 retry and cached afterwards, got %v requests", n)
+	}
+
+	p.Config.Retries = 0
+	atomic.StoreInt32(&requests, 0)
+
+	if _, _, err := h(upstreamtest.Conn{Username: "bob", Port: 1}, nil); err == nil {
+		t.Errorf("should fail without retry")
+	}
+}
+
+func writeCert(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	l := upstreamtest.Listen(t)
+	defer l.Close()
+
+	dir, err := ioutil.TempDir("", "sshpiperd_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, clientCert := writeCert(t, dir, "client")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(upstream.PipeSpec{
+			Address:       l.Addr().String(),
+			IgnoreHostKey: true,
+		})
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// no client cert
+	p := newTestPlugin(t, srv.URL, func(p *plugin) {
+		p.Config.CAFile = caFile
+	})
+
+	if _, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice", Port: 1}, nil); err == nil {
+		t.Errorf("should fail without client cert")
+	}
+
+	p = newTestPlugin(t, srv.URL, func(p *plugin) {
+		p.Config.CAFile = caFile
+		p.Config.CertFile = certFile
+		p.Config.KeyFile = keyFile
+	})
+
+	c, _, err := p.GetHandler()(upstreamtest.Conn{Username: "alice", Port: 1}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+}
+
+func TestInit(t *testing.T) {
+	p := &plugin{}
+	if err := p.Init(logging.Discard()); err == nil {
+		t.Errorf("should fail without url")
+	}
+
+	p.Config.URL = "http://127.0.0.1"
+	p.Config.Headers = []string{"bad header"}
+	if err := p.Init(logging.Discard()); err == nil {
+		t.Errorf("should fail with bad header")
+	}
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type plugin struct {
+	Config struct {
+		URL           string        `long:"upstream-http-url" description:"Url to POST downstream connection info to, the json response tells the upstream" env:"SSHPIPERD_UPSTREAM_HTTP_URL" ini-name:"upstream-http-url"`
+		Headers       []string      `long:"upstream-http-header" description:"Extra http header sent with requests, e.g. 'Authorization: Bearer xxx', can be repeated" env:"SSHPIPERD_UPSTREAM_HTTP_HEADERS" env-delim:"," ini-name:"upstream-http-header"`
+		Timeout       time.Duration `long:"upstream-http-timeout" description:"Timeout of each request" default:"5s" env:"SSHPIPERD_UPSTREAM_HTTP_TIMEOUT" ini-name:"upstream-http-timeout"`
+		Retries       int           `long:"upstream-http-retries" description:"Retry this many times on network errors and 5xx responses" default:"2" env:"SSHPIPERD_UPSTREAM_HTTP_RETRIES" ini-name:"upstream-http-retries"`
+		RetryInterval time.Duration `long:"upstream-http-retry-interval" description:"Time to wait before retrying" default:"200ms" env:"SSHPIPERD_UPSTREAM_HTTP_RETRY_INTERVAL" ini-name:"upstream-http-retry-interval"`
+		CacheTTL      time.Duration `long:"upstream-http-cache-ttl" description:"Cache successful responses for this long, 0 to disable" default:"0" env:"SSHPIPERD_UPSTREAM_HTTP_CACHE_TTL" ini-name:"upstream-http-cache-ttl"`
+
+		CAFile      string `long:"upstream-http-tls-ca" description:"CA bundle to verify the server, system CAs are used if empty" env:"SSHPIPERD_UPSTREAM_HTTP_TLS_CA" ini-name:"upstream-http-tls-ca"`
+		CertFile    string `long:"upstream-http-tls-cert" description:"Client certificate for mutual tls" env:"SSHPIPERD_UPSTREAM_HTTP_TLS_CERT" ini-name:"upstream-http-tls-cert"`
+		KeyFile     string `long:"upstream-http-tls-key" description:"Private key of client certificate" env:"SSHPIPERD_UPSTREAM_HTTP_TLS_KEY" ini-name:"upstream-http-tls-key"`
+		TLSInsecure bool   `long:"upstream-http-tls-insecure" description:"Do not verify the server certificate" env:"SSHPIPERD_UPSTREAM_HTTP_TLS_INSECURE" ini-name:"upstream-http-tls-insecure"`
+	}
+
+	logger  logging.Logger
+	client  *http.Client
+	headers http.Header
+	cache   *upstream.Cache
+	shared  *upstream.Cache
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "http"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+func (p *plugin) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: p.Config.TLSInsecure,
+	}
+
+	if p.Config.CAFile != "" {
+		pem, err := ioutil.ReadFile(p.Config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", p.Config.CAFile)
+		}
+	}
+
+	if p.Config.CertFile != "" || p.Config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.Config.CertFile, p.Config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// Use the daemon wide cache unless own cache ttl is set
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.shared = cache
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	if p.Config.URL == "" {
+		return fmt.Errorf("upstream-http-url is required")
+	}
+
+	p.headers = make(http.Header)
+	for _, h := range p.Config.Headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad http header %q, expect 'Name: value'", h)
+		}
+
+		p.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	p.client = &http.Client{
+		Transport: transport,
+		Timeout:   p.Config.Timeout,
+	}
+
+	p.cache = p.shared
+	if p.Config.CacheTTL > 0 {
+		p.cache = upstream.NewCache(upstream.CacheOptions{TTL: p.Config.CacheTTL})
+	}
+
+	logger.Printf("upstream provider: http from [%v] initializing", p.Config.URL)
+
+	return nil
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+// Pipes are managed by the http service
+
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	return nil, fmt.Errorf("pipes are managed by %v, not supported by http driver", p.Config.URL)
+}
+
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return fmt.Errorf("pipes are managed by %v, not supported by http driver", p.Config.URL)
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	return fmt.Errorf("pipes are managed by %v, not supported by http driver", p.Config.URL)
+}
+
+func init() {
+	upstream.Register("http", &plugin{})
+}
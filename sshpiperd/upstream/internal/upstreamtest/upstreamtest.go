@@ -0,0 +1,86 @@
+// Package upstreamtest provides helpers shared by tests of upstream drivers
+package upstreamtest
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/registry"
+)
+
+// Conn is the meta of a downstream connected from 10.0.0.1 to 127.0.0.1:2222
+// methods not overridden panic
+type Conn struct {
+	ssh.ConnMetadata
+
+	Username string
+
+	// source port, 51234 if 0
+	Port int
+}
+
+// User returns Username
+func (c Conn) User() string {
+	return c.Username
+}
+
+// ClientVersion returns SSH-2.0-test
+func (Conn) ClientVersion() []byte {
+	return []byte("SSH-2.0-test")
+}
+
+// RemoteAddr returns 10.0.0.1 with Port
+func (c Conn) RemoteAddr() net.Addr {
+	port := c.Port
+	if port == 0 {
+		port = 51234
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}
+}
+
+// LocalAddr returns 127.0.0.1:2222
+func (Conn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+}
+
+// Listen starts a fake upstream on 127.0.0.1 closing connections once accepted
+func Listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cant create fake server: %v", err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	return l
+}
+
+// PublicKey returns the public key of name in golang.org/x/crypto/ssh/testdata, e.g. rsa
+func PublicKey(t *testing.T, name string) ssh.PublicKey {
+	signer, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer.PublicKey()
+}
+
+// Init inits the driver with a discarding logger, fails the test on error
+func Init(t *testing.T, p registry.Plugin) {
+	if err := p.Init(logging.Discard()); err != nil {
+		t.Fatal(err)
+	}
+}
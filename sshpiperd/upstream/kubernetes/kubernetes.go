@@ -0,0 +1,347 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+const (
+	group            = "sshpiper.tg123.github.io"
+	annotationPrefix = group + "/"
+	usernameIndex    = "username"
+
+	// default keys in secrets
+	defaultHostKeyKey        = "host_key"
+	defaultAuthorizedKeysKey = "authorized_keys"
+	defaultPrivateKeyKey     = corev1.SSHAuthPrivateKey
+)
+
+var sshPipeResource = schema.GroupVersionResource{Group: group, Version: "v1alpha1", Resource: "sshpipes"}
+
+// secretRef is a key of secret in the same namespace
+type secretRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+}
+
+type pipeTarget struct {
+	// one of service, pod and address
+	Service string `json:"service,omitempty"`
+	Pod     string `json:"pod,omitempty"`
+	Address string `json:"address,omitempty"`
+
+	// 22 if empty
+	Port int `json:"port,omitempty"`
+}
+
+// sshPipeSpec is spec of SshPipe, annotated services and pods are converted to it
+type sshPipeSpec struct {
+	// downstream usernames, name of SshPipe if empty
+	Usernames []string `json:"usernames,omitempty"`
+
+	Target     pipeTarget `json:"target"`
+	MappedUser string     `json:"mappedUser,omitempty"`
+
+	// upstream host key in authorized keys format, HostKeySecret takes precedence
+	HostKey       string     `json:"hostKey,omitempty"`
+	HostKeySecret *secretRef `json:"hostKeySecret,omitempty"`
+	IgnoreHostKey bool       `json:"ignoreHostKey,omitempty"`
+
+	// downstream public keys in authorized keys are mapped to the private key
+	AuthorizedKeysSecret *secretRef `json:"authorizedKeysSecret,omitempty"`
+	PrivateKeySecret     *secretRef `json:"privateKeySecret,omitempty"`
+	NoPassthrough        bool       `json:"noPassthrough,omitempty"`
+}
+
+// route is a sshPipeSpec with where it is from
+type route struct {
+	namespace string
+	name      string
+	source    string
+	spec      sshPipeSpec
+}
+
+func (r *route) String() string {
+	return fmt.Sprintf("%v %v/%v", r.source, r.namespace, r.name)
+}
+
+// parseSecretRef parses name or name/key
+func parseSecretRef(s string) *secretRef {
+	if s == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	ref := &secretRef{Name: parts[0]}
+
+	if len(parts) == 2 {
+		ref.Key = parts[1]
+	}
+
+	return ref
+}
+
+// annotatedSpec converts annotations of services and pods to spec
+func annotatedSpec(annotations map[string]string) (sshPipeSpec, error) {
+	a := func(name string) string {
+		return annotations[annotationPrefix+name]
+	}
+
+	spec := sshPipeSpec{
+		MappedUser:           a("mapped-user"),
+		HostKeySecret:        parseSecretRef(a("host-key-secret")),
+		IgnoreHostKey:        a("ignore-host-key") == "true",
+		AuthorizedKeysSecret: parseSecretRef(a("authorized-keys-secret")),
+		PrivateKeySecret:     parseSecretRef(a("private-key-secret")),
+		NoPassthrough:        a("no-passthrough") == "true",
+	}
+
+	for _, u := range strings.Split(a("username"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			spec.Usernames = append(spec.Usernames, u)
+		}
+	}
+
+	if port := a("port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return spec, fmt.Errorf("bad port annotation %q", port)
+		}
+
+		spec.Target.Port = n
+	}
+
+	return spec, nil
+}
+
+// routeOf converts objects in informers to route
+func routeOf(obj interface{}) (*route, error) {
+	switch o := obj.(type) {
+	case *unstructured.Unstructured:
+		r := &route{namespace: o.GetNamespace(), name: o.GetName(), source: sourceSSHPipe}
+
+		spec, _, err := unstructured.NestedMap(o.Object, "spec")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &r.spec); err != nil {
+			return nil, fmt.Errorf("bad spec of %v: %v", r, err)
+		}
+
+		if len(r.spec.Usernames) == 0 {
+			r.spec.Usernames = []string{o.GetName()}
+		}
+
+		return r, nil
+
+	case *corev1.Service:
+		spec, err := annotatedSpec(o.Annotations)
+		if err != nil {
+			return nil, err
+		}
+
+		spec.Target.Service = o.Name
+
+		return &route{o.Namespace, o.Name, sourceService, spec}, nil
+
+	case *corev1.Pod:
+		spec, err := annotatedSpec(o.Annotations)
+		if err != nil {
+			return nil, err
+		}
+
+		spec.Target.Pod = o.Name
+		spec.Target.Address = o.Status.PodIP
+
+		return &route{o.Namespace, o.Name, sourcePod, spec}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected object %T", obj)
+}
+
+// usernamesOf is the index func of informers
+func usernamesOf(obj interface{}) ([]string, error) {
+	r, err := routeOf(obj)
+	if err != nil {
+		// broken objects are not indexed rather than failing the informer
+		return nil, nil
+	}
+
+	return r.spec.Usernames, nil
+}
+
+// findRoute returns the route of user from the first source having it
+func (p *plugin) findRoute(user string) (*route, error) {
+	w := p.current()
+
+	for _, source := range w.sources {
+		objs, err := w.informers[source].GetIndexer().ByIndex(usernameIndex, user)
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(objs) {
+		case 0:
+			continue
+		case 1:
+			return routeOf(objs[0])
+		default:
+			var names []string
+			for _, obj := range objs {
+				if r, err := routeOf(obj); err == nil {
+					names = append(names, r.String())
+				}
+			}
+
+			return nil, fmt.Errorf("username [%v] is ambiguous: %v", user, strings.Join(names, ", "))
+		}
+	}
+
+	return nil, &upstream.NotFoundError{User: user}
+}
+
+func (p *plugin) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.Config.Timeout)
+}
+
+// address resolves target of route to host:port
+func (p *plugin) address(r *route) (string, error) {
+	t := r.spec.Target
+
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+
+	host := t.Address
+
+	switch {
+	case host != "":
+	case t.Service != "":
+		host = fmt.Sprintf("%v.%v.svc", t.Service, r.namespace)
+	case t.Pod != "":
+		ctx, cancel := p.context()
+		defer cancel()
+
+		pod, err := p.current().client.CoreV1().Pods(r.namespace).Get(ctx, t.Pod, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		host = pod.Status.PodIP
+	default:
+		return "", fmt.Errorf("no target in %v", r)
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("target of %v has no address yet", r)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+func (p *plugin) readSecret(namespace string, ref *secretRef, defaultKey string) (string, error) {
+	if ref == nil {
+		return "", nil
+	}
+
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	secret, err := p.current().client.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	data, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key %v not found in secret %v/%v", key, namespace, ref.Name)
+	}
+
+	return string(data), nil
+}
+
+// pipeSpec resolves route to upstream.PipeSpec, secrets are read on every call
+func (p *plugin) pipeSpec(r *route) (*upstream.PipeSpec, error) {
+	addr, err := p.address(r)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &upstream.PipeSpec{
+		Address:       addr,
+		User:          r.spec.MappedUser,
+		HostKey:       r.spec.HostKey,
+		IgnoreHostKey: r.spec.IgnoreHostKey,
+		Auth: upstream.AuthSpec{
+			NoPassthrough: r.spec.NoPassthrough,
+		},
+	}
+
+	if r.spec.HostKeySecret != nil {
+		if spec.HostKey, err = p.readSecret(r.namespace, r.spec.HostKeySecret, defaultHostKeyKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if spec.Auth.AuthorizedKeys, err = p.readSecret(r.namespace, r.spec.AuthorizedKeysSecret, defaultAuthorizedKeysKey); err != nil {
+		return nil, err
+	}
+
+	if spec.Auth.PrivateKey, err = p.readSecret(r.namespace, r.spec.PrivateKeySecret, defaultPrivateKeyKey); err != nil {
+		return nil, err
+	}
+
+	if spec.Auth.PrivateKey != "" {
+		spec.Auth.Type = upstream.AuthTypePrivateKey
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	r, err := p.findRoute(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec, err := p.pipeSpec(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", r, err)
+	}
+
+	a, err := spec.AuthPipe(user)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", r, err)
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": spec.Address, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v] by %v", user, a.User, spec.Address, r)
+
+	c, err := upstream.DialForSSH(spec.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
@@ -0,0 +1,297 @@
+package kubernetes
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+func sshPipe(namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": sshPipeResource.GroupVersion().String(),
+			"kind":       "SshPipe",
+			"spec":       spec,
+		},
+	}
+
+	u.SetNamespace(namespace)
+	u.SetName(name)
+
+	return u
+}
+
+func newTestPlugin(t *testing.T, objs []runtime.Object, crs ...runtime.Object) *plugin {
+	p := &plugin{}
+	p.Config.Sources = []string{sourceSSHPipe, sourceService, sourcePod}
+	p.Config.LabelSelector = "sshpiper=true"
+	p.Config.Timeout = 5 * time.Second
+	p.logger = logging.Discard()
+
+	if err := p.start(fake.NewSimpleClientset(objs...), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), crs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestFindUpstream(t *testing.T) {
+	up := upstreamtest.Listen(t)
+	defer up.Close()
+
+	host, port, _ := net.SplitHostPort(up.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	selected := map[string]string{"sshpiper": "true"}
+
+	p := newTestPlugin(t, []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "alice-keys"},
+			Data: map[string][]byte{
+				"host_key":               ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "ecdsa")),
+				"authorized_keys":        ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "rsa")),
+				corev1.SSHAuthPrivateKey: testdata.PEMBytes["ed25519"],
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "dev",
+				Name:      "bob-workspace",
+				Labels:    selected,
+				Annotations: map[string]string{
+					annotationPrefix + "username":        "bob, carol",
+					annotationPrefix + "port":            port,
+					annotationPrefix + "mapped-user":     "root",
+					annotationPrefix + "ignore-host-key": "true",
+				},
+			},
+			Status: corev1.PodStatus{PodIP: host},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "dev",
+				Name:        "dave-svc",
+				Labels:      selected,
+				Annotations: map[string]string{annotationPrefix + "username": "dave"},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "dev",
+				Name:        "carol-svc",
+				Labels:      selected,
+				Annotations: map[string]string{annotationPrefix + "username": "carol"},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "dev",
+				Name:        "frank-svc",
+				Annotations: map[string]string{annotationPrefix + "username": "frank"},
+			},
+		},
+	},
+		sshPipe("dev", "alice", map[string]interface{}{
+			"target": map[string]interface{}{
+				"address": host,
+				"port":    int64(portNum),
+			},
+			"mappedUser":           "admin",
+			"hostKeySecret":        map[string]interface{}{"name": "alice-keys"},
+			"authorizedKeysSecret": map[string]interface{}{"name": "alice-keys"},
+			"privateKeySecret":     map[string]interface{}{"name": "alice-keys"},
+		}),
+		sshPipe("dev", "eve-1", map[string]interface{}{"usernames": []interface{}{"eve"}, "target": map[string]interface{}{"address": host}}),
+		sshPipe("prod", "eve-2", map[string]interface{}{"usernames": []interface{}{"eve"}, "target": map[string]interface{}{"address": host}}),
+	)
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream of alice failed %v", err)
+	}
+	c.Close()
+
+	if pipe.User != "admin" {
+		t.Errorf("unexpected mapped user %v", pipe.User)
+	}
+
+	if err := pipe.UpstreamHostKeyCallback("", nil, upstreamtest.PublicKey(t, "ecdsa")); err != nil {
+		t.Errorf("host key from secret should be accepted %v", err)
+	}
+
+	if err := pipe.UpstreamHostKeyCallback("", nil, upstreamtest.PublicKey(t, "rsa")); err == nil {
+		t.Errorf("other host key should be rejected")
+	}
+
+	if typ, method, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "rsa")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("authorized key should be mapped to private key")
+	}
+
+	c, pipe, err = h(upstreamtest.Conn{Username: "bob"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream of bob failed %v", err)
+	}
+	c.Close()
+
+	if pipe.User != "root" {
+		t.Errorf("bob should be mapped by pod annotation, got %v", pipe.User)
+	}
+
+	// service is looked up before pod
+	if r, err := p.findRoute("carol"); err != nil || r.source != sourceService {
+		t.Errorf("carol should be routed to service %v %v", r, err)
+	}
+
+	r, err := p.findRoute("dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr, _ := p.address(r); addr != "dave-svc.dev.svc:22" {
+		t.Errorf("unexpected service address %v", addr)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "eve"}, nil); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("eve should be ambiguous %v", err)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "mallory"}, nil); !upstream.IsNotFound(err) {
+		t.Errorf("mallory should not be found %v", err)
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "frank"}, nil); !upstream.IsNotFound(err) {
+		t.Errorf("frank not matching label selector should not be found %v", err)
+	}
+}
+
+func TestPipeManager(t *testing.T) {
+	p := newTestPlugin(t, nil)
+	p.Config.Namespace = ""
+
+	hostKey := string(ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "ecdsa")))
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", UpstreamUsername: "root", Host: "10.0.0.2", Port: 2222}); err == nil {
+		t.Errorf("create pipe without host key should fail")
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", UpstreamUsername: "root", Host: "10.0.0.2", Port: 2222, HostKey: hostKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := p.current().dynamic.Resource(sshPipeResource).Namespace("default").Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("sshpipe should be created %v", err)
+	}
+
+	r, err := routeOf(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.spec.Target.Address != "10.0.0.2" || r.spec.Target.Port != 2222 || r.spec.MappedUser != "root" || r.spec.HostKey != hostKey || r.spec.IgnoreHostKey {
+		t.Errorf("unexpected spec %v", r.spec)
+	}
+
+	spec, err := p.pipeSpec(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.HostKey != hostKey {
+		t.Errorf("host key of sshpipe should be used %v", spec.HostKey)
+	}
+
+	wait := func(cond func([]upstream.Pipe) bool) []upstream.Pipe {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			pipes, err := p.ListPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cond(pipes) {
+				return pipes
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected pipes %v", pipes)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	pipes := wait(func(pipes []upstream.Pipe) bool { return len(pipes) == 1 })
+
+	if pipes[0].Username != "alice" || pipes[0].UpstreamUsername != "root" || pipes[0].Host != "10.0.0.2" || pipes[0].Port != 2222 {
+		t.Errorf("unexpected pipe %v", pipes[0])
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", Host: "10.0.0.3", Port: 22, IgnoreHostKey: true}); err == nil {
+		t.Errorf("create existing pipe should fail")
+	}
+
+	if err := p.RemovePipe("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	wait(func(pipes []upstream.Pipe) bool { return len(pipes) == 0 })
+}
+
+func TestStart(t *testing.T) {
+	p := &plugin{}
+	p.Config.Sources = []string{"deployment"}
+	p.Config.Timeout = time.Second
+
+	if err := p.start(fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())); err == nil {
+		t.Errorf("unknown source should fail")
+	}
+
+	p.Config.Sources = []string{sourceSSHPipe, sourcePod}
+
+	if err := p.start(fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())); err == nil {
+		t.Errorf("pod source without namespace or label selector should fail")
+	}
+
+	p.Config.Namespace = "dev"
+
+	if err := p.start(fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())); err != nil {
+		t.Errorf("pod source in namespace should be watched %v", err)
+	}
+
+	p.Config.Sources = nil
+	p.Config.Namespace = ""
+
+	if err := p.start(fake.NewSimpleClientset(), dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.current().informers[sourceSSHPipe]; !ok || len(p.current().informers) != 1 {
+		t.Errorf("only sshpipe should be watched by default %v", p.current().informers)
+	}
+
+	close(p.current().stop)
+}
@@ -0,0 +1,153 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// Return pipes of all sources, those without address are skipped
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	var pipes []upstream.Pipe
+
+	w := p.current()
+
+	for _, source := range w.sources {
+		for _, obj := range w.informers[source].GetStore().List() {
+			r, err := routeOf(obj)
+			if err != nil {
+				p.logger.Debugf("skip %v", err)
+				continue
+			}
+
+			addr, err := p.address(r)
+			if err != nil {
+				p.logger.Debugf("skip %v", err)
+				continue
+			}
+
+			host, port, err := upstream.SplitHostPortForSSH(addr)
+			if err != nil {
+				continue
+			}
+
+			for _, user := range r.spec.Usernames {
+				mapped := r.spec.MappedUser
+				if mapped == "" {
+					mapped = user
+				}
+
+				pipes = append(pipes, upstream.Pipe{
+					Username:         user,
+					UpstreamUsername: mapped,
+					Host:             host,
+					Port:             port,
+					Source:           r.String(),
+				})
+			}
+		}
+	}
+
+	return pipes, nil
+}
+
+func (p *plugin) writeNamespace() string {
+	if p.Config.Namespace == "" {
+		return metav1.NamespaceDefault
+	}
+
+	return p.Config.Namespace
+}
+
+// Create a SshPipe passing through auth, the upstream host key is required unless ignored
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	if r, err := p.findRoute(opt.Username); err == nil {
+		return fmt.Errorf("username [%v] already exists in %v", opt.Username, r)
+	}
+
+	spec := map[string]interface{}{
+		"usernames": []interface{}{opt.Username},
+		"target": map[string]interface{}{
+			"address": opt.Host,
+			"port":    int64(opt.Port),
+		},
+		"mappedUser": opt.UpstreamUsername,
+	}
+
+	switch {
+	case opt.HostKey != "":
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opt.HostKey)); err != nil {
+			return err
+		}
+
+		spec["hostKey"] = opt.HostKey
+	case opt.IgnoreHostKey:
+		spec["ignoreHostKey"] = true
+	default:
+		return fmt.Errorf("upstream host key of [%v] is required, set --ignore-host-key to skip verification", opt.Username)
+	}
+
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": sshPipeResource.GroupVersion().String(),
+			"kind":       "SshPipe",
+			"spec":       spec,
+		},
+	}
+
+	if len(validation.IsDNS1123Subdomain(opt.Username)) == 0 {
+		obj.SetName(opt.Username)
+	} else {
+		obj.SetGenerateName("sshpipe-")
+	}
+
+	ctx, cancel := p.context()
+	defer cancel()
+
+	_, err := p.current().dynamic.Resource(sshPipeResource).Namespace(p.writeNamespace()).Create(ctx, obj, metav1.CreateOptions{})
+	return err
+}
+
+// Remove SshPipes of the username, annotated services and pods are not touched
+func (p *plugin) RemovePipe(name string) error {
+	w := p.current()
+
+	inf, ok := w.informers[sourceSSHPipe]
+	if !ok {
+		return fmt.Errorf("%v is not in upstream-kubernetes-source", sourceSSHPipe)
+	}
+
+	objs, err := inf.GetIndexer().ByIndex(usernameIndex, name)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		u := obj.(*unstructured.Unstructured)
+
+		r, err := routeOf(u)
+		if err != nil {
+			return err
+		}
+
+		if len(r.spec.Usernames) > 1 {
+			return fmt.Errorf("%v is shared by usernames %v, edit it instead", r, strings.Join(r.spec.Usernames, ","))
+		}
+
+		ctx, cancel := p.context()
+		err = w.dynamic.Resource(sshPipeResource).Namespace(u.GetNamespace()).Delete(ctx, u.GetName(), metav1.DeleteOptions{})
+		cancel()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// sources of routes, in lookup order
+const (
+	sourceSSHPipe = "sshpipe"
+	sourceService = "service"
+	sourcePod     = "pod"
+)
+
+type plugin struct {
+	Config struct {
+		Kubeconfig    string        `long:"upstream-kubernetes-kubeconfig" description:"Kubeconfig file, in-cluster config is used if empty" env:"SSHPIPERD_UPSTREAM_KUBERNETES_KUBECONFIG" ini-name:"upstream-kubernetes-kubeconfig"`
+		Namespace     string        `long:"upstream-kubernetes-namespace" description:"Namespace to watch, all namespaces if empty. SshPipes are created in default namespace if empty" env:"SSHPIPERD_UPSTREAM_KUBERNETES_NAMESPACE" ini-name:"upstream-kubernetes-namespace"`
+		Sources       []string      `long:"upstream-kubernetes-source" description:"Resources to find routes, sshpipe for SshPipe custom resources, service and pod for annotated ones, can be repeated, sshpipe if not set" env:"SSHPIPERD_UPSTREAM_KUBERNETES_SOURCES" env-delim:"," ini-name:"upstream-kubernetes-source"`
+		LabelSelector string        `long:"upstream-kubernetes-label-selector" description:"Only watch services and pods matching the selector, e.g. sshpiper=true" env:"SSHPIPERD_UPSTREAM_KUBERNETES_LABEL_SELECTOR" ini-name:"upstream-kubernetes-label-selector"`
+		Resync        time.Duration `long:"upstream-kubernetes-resync" description:"Resync period of informers" default:"10m" env:"SSHPIPERD_UPSTREAM_KUBERNETES_RESYNC" ini-name:"upstream-kubernetes-resync"`
+		Timeout       time.Duration `long:"upstream-kubernetes-timeout" description:"Timeout of initial sync and api calls" default:"30s" env:"SSHPIPERD_UPSTREAM_KUBERNETES_TIMEOUT" ini-name:"upstream-kubernetes-timeout"`
+	}
+
+	logger logging.Logger
+
+	mu    sync.RWMutex
+	watch *watch
+}
+
+// watch is clients and informers of an Init, replaced as a whole by next Init
+type watch struct {
+	client  k8s.Interface
+	dynamic dynamic.Interface
+
+	// sources in lookup order and their username indexed informers
+	sources   []string
+	informers map[string]cache.SharedIndexInformer
+	stop      chan struct{}
+}
+
+// current returns the watch of last Init, nil if not initialized
+func (p *plugin) current() *watch {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.watch
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "kubernetes"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+func (p *plugin) restConfig() (*rest.Config, error) {
+	if p.Config.Kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", p.Config.Kubeconfig)
+	}
+
+	return rest.InClusterConfig()
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+// informers of previous Init are stopped after new ones are synced
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	config, err := p.restConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := k8s.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("upstream provider: kubernetes from %v initializing", config.Host)
+
+	return p.start(client, dyn)
+}
+
+// sources to watch in lookup order, sshpipe only if not set
+func (p *plugin) sources() []string {
+	if len(p.Config.Sources) == 0 {
+		return []string{sourceSSHPipe}
+	}
+
+	return p.Config.Sources
+}
+
+// start watches sources with clients and waits for initial sync
+// informers of previous start are stopped after the new ones are synced
+func (p *plugin) start(client k8s.Interface, dyn dynamic.Interface) error {
+	tweak := func(o *metav1.ListOptions) {
+		o.LabelSelector = p.Config.LabelSelector
+	}
+
+	typed := informers.NewSharedInformerFactoryWithOptions(client, p.Config.Resync, informers.WithNamespace(p.Config.Namespace), informers.WithTweakListOptions(tweak))
+	crs := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dyn, p.Config.Resync, p.Config.Namespace, nil)
+
+	sources := p.sources()
+	infs := make(map[string]cache.SharedIndexInformer)
+
+	for _, source := range sources {
+		var inf cache.SharedIndexInformer
+
+		switch source {
+		case sourceSSHPipe:
+			inf = crs.ForResource(sshPipeResource).Informer()
+		case sourceService, sourcePod:
+			// anyone able to annotate a workload could route users to it
+			if p.Config.Namespace == "" && p.Config.LabelSelector == "" {
+				return fmt.Errorf("kubernetes source %v requires upstream-kubernetes-namespace or upstream-kubernetes-label-selector", source)
+			}
+
+			if source == sourceService {
+				inf = typed.Core().V1().Services().Informer()
+			} else {
+				inf = typed.Core().V1().Pods().Informer()
+			}
+		default:
+			return fmt.Errorf("unknown kubernetes source %v, expect %v, %v or %v", source, sourceSSHPipe, sourceService, sourcePod)
+		}
+
+		if err := inf.AddIndexers(cache.Indexers{usernameIndex: usernamesOf}); err != nil {
+			return err
+		}
+
+		infs[source] = inf
+	}
+
+	w := &watch{
+		client:    client,
+		dynamic:   dyn,
+		sources:   sources,
+		informers: infs,
+		stop:      make(chan struct{}),
+	}
+
+	typed.Start(w.stop)
+	crs.Start(w.stop)
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(p.Config.Timeout, func() { close(timeout) })
+	defer timer.Stop()
+
+	for source, inf := range infs {
+		if !cache.WaitForCacheSync(timeout, inf.HasSynced) {
+			close(w.stop)
+			return fmt.Errorf("timed out waiting for %v to sync", source)
+		}
+	}
+
+	p.mu.Lock()
+	old := p.watch
+	p.watch = w
+	p.mu.Unlock()
+
+	if old != nil {
+		close(old.stop)
+	}
+
+	return nil
+}
+
+// All informers must be synced
+func (p *plugin) HealthCheck() error {
+	w := p.current()
+	if w == nil {
+		return fmt.Errorf("kubernetes is not initialized")
+	}
+
+	for source, inf := range w.informers {
+		if !inf.HasSynced() {
+			return fmt.Errorf("%v is not synced", source)
+		}
+	}
+
+	return nil
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+func init() {
+	upstream.Register("kubernetes", &plugin{})
+}
@@ -0,0 +1,153 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+func (b *backend) lookup(user string) (*upstream.PipeSpec, error) {
+	key := b.opts.prefix + user
+
+	data, err := b.store.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, &upstream.NotFoundError{User: user}
+	}
+
+	spec := &upstream.PipeSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("bad record %v: %v", key, err)
+	}
+
+	if spec.Address == "" {
+		return nil, fmt.Errorf("bad record %v: empty address", key)
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	v, err := p.cache.Get(user, "", func() (interface{}, error) {
+		return p.current().lookup(user)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec := v.(*upstream.PipeSpec)
+
+	a, err := spec.AuthPipe(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": spec.Address, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v]", user, a.User, spec.Address)
+
+	c, err := upstream.DialForSSH(spec.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
+
+// Return all pipes under prefix, broken records are skipped
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	b := p.current()
+
+	keys, err := b.store.keys(b.opts.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipes []upstream.Pipe
+
+	for _, key := range keys {
+		user := key[len(b.opts.prefix):]
+
+		spec, err := b.lookup(user)
+		if err != nil {
+			p.logger.Debugf("skip %v: %v", key, err)
+			continue
+		}
+
+		host, port, err := upstream.SplitHostPortForSSH(spec.Address)
+		if err != nil {
+			continue
+		}
+
+		mapped := spec.User
+		if mapped == "" {
+			mapped = user
+		}
+
+		pipes = append(pipes, upstream.Pipe{
+			Username:         user,
+			UpstreamUsername: mapped,
+			Host:             host,
+			Port:             port,
+		})
+	}
+
+	return pipes, nil
+}
+
+// Create a record passing through auth, the upstream host key is required unless ignored
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	spec := upstream.PipeSpec{
+		Address: net.JoinHostPort(opt.Host, fmt.Sprint(opt.Port)),
+		User:    opt.UpstreamUsername,
+		HostKey: opt.HostKey,
+		Auth: upstream.AuthSpec{
+			Type: upstream.AuthTypePassThrough,
+		},
+	}
+
+	if spec.HostKey == "" {
+		if !opt.IgnoreHostKey {
+			return fmt.Errorf("upstream host key of [%v] is required, set --ignore-host-key to skip verification", opt.Username)
+		}
+
+		spec.IgnoreHostKey = true
+	}
+
+	if _, err := spec.HostKeyCallback(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	b := p.current()
+
+	ok, err := b.store.setNX(b.opts.prefix+opt.Username, data)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("username [%v] already exists", opt.Username)
+	}
+
+	p.cache.Invalidate(opt.Username)
+	return nil
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	defer p.cache.Invalidate(name)
+	b := p.current()
+	return b.store.del(b.opts.prefix + name)
+}
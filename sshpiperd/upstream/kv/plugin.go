@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// store is a key value backend holding json of upstream.PipeSpec at prefix+username
+type store interface {
+
+	// get returns nil if key does not exist
+	get(key string) ([]byte, error)
+
+	// setNX sets value if key does not exist
+	setNX(key string, value []byte) (bool, error)
+
+	del(key string) error
+
+	// keys returns all keys starting with prefix
+	keys(prefix string) ([]string, error)
+
+	// watch calls onChange with changed keys starting with prefix until stop is closed
+	// key is empty if changes may have been missed, e.g. reconnected
+	watch(prefix string, onChange func(key string), stop <-chan struct{})
+
+	ping() error
+	close() error
+}
+
+type storeOptions struct {
+	prefix string
+	watch  bool
+}
+
+type createstore interface {
+	GetName() string
+	create() (store, error)
+	options() storeOptions
+}
+
+// backend is a store with its options, replaced as a whole by Init
+type backend struct {
+	store store
+	opts  storeOptions
+	stop  chan struct{}
+}
+
+type plugin struct {
+	createstore
+
+	logger logging.Logger
+	cache  *upstream.Cache
+
+	mu      sync.RWMutex
+	backend *backend
+}
+
+// Lookups are cached, entries are invalidated by watching the store if enabled
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.cache = cache
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+// store of previous Init is closed after the new one is in use
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	s, err := p.create()
+	if err != nil {
+		return err
+	}
+
+	b := &backend{
+		store: s,
+		opts:  p.options(),
+		stop:  make(chan struct{}),
+	}
+
+	if b.opts.watch {
+		go s.watch(b.opts.prefix, func(key string) { p.invalidate(b, key) }, b.stop)
+	}
+
+	p.mu.Lock()
+	old := p.backend
+	p.backend = b
+	p.mu.Unlock()
+
+	if old != nil {
+		close(old.stop)
+		old.store.close()
+	}
+
+	logger.Printf("upstream provider: %v with prefix [%v] initializing", p.GetName(), b.opts.prefix)
+
+	return nil
+}
+
+// current returns the backend of last Init, nil if not initialized
+func (p *plugin) current() *backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.backend
+}
+
+func (p *plugin) invalidate(b *backend, key string) {
+	if key == "" {
+		p.cache.Purge()
+		return
+	}
+
+	p.logger.Debugf("%v changed, invalidating cache", key)
+	p.cache.Invalidate(strings.TrimPrefix(key, b.opts.prefix))
+}
+
+// The store must be reachable
+func (p *plugin) HealthCheck() error {
+	b := p.current()
+	if b == nil {
+		return fmt.Errorf("%v is not initialized", p.GetName())
+	}
+
+	return b.store.ping()
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
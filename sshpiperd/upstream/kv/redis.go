@@ -0,0 +1,238 @@
+package kv
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type redisplugin struct {
+	plugin
+
+	Config struct {
+		URL         string        `long:"upstream-redis-url" default:"redis://127.0.0.1:6379/0" description:"Redis server, redis://[:password@]host:port/db or rediss:// for tls" env:"SSHPIPERD_UPSTREAM_REDIS_URL" ini-name:"upstream-redis-url"`
+		TLSInsecure bool          `long:"upstream-redis-tls-insecure" description:"Do not verify the server certificate of rediss://" env:"SSHPIPERD_UPSTREAM_REDIS_TLS_INSECURE" ini-name:"upstream-redis-tls-insecure"`
+		Timeout     time.Duration `long:"upstream-redis-timeout" default:"5s" description:"Timeout of redis operations" env:"SSHPIPERD_UPSTREAM_REDIS_TIMEOUT" ini-name:"upstream-redis-timeout"`
+		Prefix      string        `long:"upstream-redis-prefix" default:"sshpiper/" description:"Prefix of keys, the record of a user is at prefix+username" env:"SSHPIPERD_UPSTREAM_REDIS_PREFIX" ini-name:"upstream-redis-prefix"`
+		Watch       bool          `long:"upstream-redis-watch" description:"Invalidate upstream cache by keyspace notifications, notify-keyspace-events of the server must contain K, g and $, e.g. Kg$" env:"SSHPIPERD_UPSTREAM_REDIS_WATCH" ini-name:"upstream-redis-watch"`
+	}
+}
+
+func (p *redisplugin) create() (store, error) {
+	u, err := url.Parse(p.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	db := strings.TrimPrefix(u.Path, "/")
+	if db == "" {
+		db = "0"
+	}
+
+	dial := func(timeout time.Duration) (redis.Conn, error) {
+		return redis.DialURL(p.Config.URL,
+			redis.DialConnectTimeout(p.Config.Timeout),
+			redis.DialReadTimeout(timeout),
+			redis.DialWriteTimeout(p.Config.Timeout),
+			redis.DialTLSSkipVerify(p.Config.TLSInsecure),
+		)
+	}
+
+	return &redisStore{
+		pool: &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return dial(p.Config.Timeout)
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+
+				_, err := c.Do("PING")
+				return err
+			},
+			MaxIdle:     4,
+			IdleTimeout: 5 * time.Minute,
+		},
+		db: db,
+		dial: func() (redis.Conn, error) {
+			// subscription blocks until next event
+			return dial(0)
+		},
+	}, nil
+}
+
+func (p *redisplugin) options() storeOptions {
+	return storeOptions{
+		prefix: p.Config.Prefix,
+		watch:  p.Config.Watch,
+	}
+}
+
+func (*redisplugin) GetName() string {
+	return "redis"
+}
+
+func (p *redisplugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+func init() {
+	p := &redisplugin{}
+	p.createstore = p
+	upstream.Register("redis", p)
+}
+
+type redisStore struct {
+	pool *redis.Pool
+	db   string
+	dial func() (redis.Conn, error)
+}
+
+// globEscape escapes special chars of redis glob pattern
+func globEscape(s string) string {
+	var b strings.Builder
+
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteRune('\\')
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+func (s *redisStore) get(key string) ([]byte, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	data, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+func (s *redisStore) setNX(key string, value []byte) (bool, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	_, err := redis.String(c.Do("SET", key, value, "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *redisStore) del(key string) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("DEL", key)
+	return err
+}
+
+func (s *redisStore) keys(prefix string) ([]string, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	var keys []string
+	cursor := "0"
+
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", globEscape(prefix)+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) != 2 {
+			return nil, fmt.Errorf("unexpected scan reply of %v values", len(values))
+		}
+
+		cursor, err = redis.String(values[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		batch, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, batch...)
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// watch subscribes keyspace notifications and resubscribes after connection lost
+func (s *redisStore) watch(prefix string, onChange func(key string), stop <-chan struct{}) {
+	channel := fmt.Sprintf("__keyspace@%v__:", s.db)
+
+	for {
+		c, err := s.dial()
+		if err == nil {
+			s.subscribe(redis.PubSubConn{Conn: c}, channel, prefix, onChange, stop)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *redisStore) subscribe(psc redis.PubSubConn, channel, prefix string, onChange func(key string), stop <-chan struct{}) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+
+		// unblock Receive
+		psc.Close()
+	}()
+
+	if err := psc.PSubscribe(globEscape(channel+prefix) + "*"); err != nil {
+		return
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			onChange(strings.TrimPrefix(v.Channel, channel))
+		case redis.Subscription:
+			// events between connections are lost
+			onChange("")
+		case error:
+			return
+		}
+	}
+}
+
+func (s *redisStore) ping() error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("PING")
+	return err
+}
+
+func (s *redisStore) close() error {
+	return s.pool.Close()
+}
@@ -0,0 +1,404 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is a minimal redis server which supports commands used by redisStore
+// and publishes keyspace notifications of SET and DEL
+type testServer struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	data  map[string]string
+	subs  map[net.Conn]string
+	conns map[net.Conn]bool
+}
+
+func newTestServer(t *testing.T) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{l: l, data: make(map[string]string), subs: make(map[net.Conn]string), conns: make(map[net.Conn]bool)}
+	go s.serve()
+
+	return s
+}
+
+func (s *testServer) url() string {
+	return "redis://" + s.l.Addr().String()
+}
+
+func (s *testServer) close() {
+	s.l.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		go s.handle(c)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%v\r\n%v\r\n", len(s), s)
+}
+
+func array(items ...string) string {
+	return fmt.Sprintf("*%v\r\n%v", len(items), strings.Join(items, ""))
+}
+
+// globPrefix converts pattern of escaped prefix followed by * to the prefix
+func globPrefix(pattern string) string {
+	return strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`, `\^`, `^`).Replace(strings.TrimSuffix(pattern, "*"))
+}
+
+// set updates data and notifies subscribers, value is deleted if nil
+func (s *testServer) set(key string, value *string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event := "del"
+	if value != nil {
+		event = "set"
+		s.data[key] = *value
+	} else {
+		delete(s.data, key)
+	}
+
+	channel := "__keyspace@0__:" + key
+	for c, pattern := range s.subs {
+		if strings.HasPrefix(channel, globPrefix(pattern)) {
+			c.Write([]byte(array(bulk("pmessage"), bulk(pattern), bulk(channel), bulk(event))))
+		}
+	}
+}
+
+func (s *testServer) handle(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			reply = "+PONG\r\n"
+		case "SELECT":
+			reply = "+OK\r\n"
+		case "GET":
+			s.mu.Lock()
+			v, ok := s.data[args[1]]
+			s.mu.Unlock()
+
+			reply = "$-1\r\n"
+			if ok {
+				reply = bulk(v)
+			}
+		case "SET":
+			s.mu.Lock()
+			_, exists := s.data[args[1]]
+			s.mu.Unlock()
+
+			reply = "$-1\r\n"
+			if !exists || len(args) < 4 {
+				s.set(args[1], &args[2])
+				reply = "+OK\r\n"
+			}
+		case "DEL":
+			s.set(args[1], nil)
+			reply = ":1\r\n"
+		case "SCAN":
+			prefix := globPrefix(args[3])
+
+			var keys []string
+			s.mu.Lock()
+			for k := range s.data {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, bulk(k))
+				}
+			}
+			s.mu.Unlock()
+
+			reply = array(bulk("0"), array(keys...))
+		case "PSUBSCRIBE":
+			s.mu.Lock()
+			s.subs[c] = args[1]
+			s.mu.Unlock()
+
+			reply = array(bulk("psubscribe"), bulk(args[1]), ":1\r\n")
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+
+		s.mu.Lock()
+		c.Write([]byte(reply))
+		s.mu.Unlock()
+	}
+}
+
+func newTestPlugin(t *testing.T, srv *testServer) *redisplugin {
+	p := &redisplugin{}
+	p.createstore = p
+	p.Config.URL = srv.url()
+	p.Config.Timeout = 5 * time.Second
+	p.Config.Prefix = "sshpiper/"
+	p.Config.Watch = true
+
+	p.UseCache(upstream.NewCache(upstream.CacheOptions{TTL: time.Hour, NegativeTTL: time.Hour}))
+
+	upstreamtest.Init(t, p)
+
+	return p
+}
+
+func mappedUser(t *testing.T, h upstream.Handler, user string) (string, error) {
+	c, pipe, err := h(upstreamtest.Conn{Username: user}, nil)
+	if err != nil {
+		return "", err
+	}
+	c.Close()
+
+	return pipe.User, nil
+}
+
+func TestFindUpstream(t *testing.T) {
+	up := upstreamtest.Listen(t)
+	defer up.Close()
+
+	srv := newTestServer(t)
+	defer srv.close()
+
+	p := newTestPlugin(t, srv)
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	h := p.GetHandler()
+
+	if _, err := mappedUser(t, h, "alice"); !upstream.IsNotFound(err) {
+		t.Errorf("alice should not be found %v", err)
+	}
+
+	record := func(user string) *string {
+		data, _ := json.Marshal(upstream.PipeSpec{
+			Address:       up.Addr().String(),
+			User:          user,
+			IgnoreHostKey: true,
+		})
+
+		s := string(data)
+		return &s
+	}
+
+	srv.set("sshpiper/alice", record("bob"))
+
+	waitMapped := func(expect string) {
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			user, err := mappedUser(t, h, "alice")
+			if err == nil && user == expect {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("expect alice mapped to %v, got %v %v", expect, user, err)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// cached not found is invalidated by watch
+	waitMapped("bob")
+
+	srv.set("sshpiper/alice", record("carol"))
+	waitMapped("carol")
+
+	srv.set("sshpiper/alice", nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := mappedUser(t, h, "alice"); upstream.IsNotFound(err) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("removed alice should not be found")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bad := "{"
+	srv.set("sshpiper/eve", &bad)
+
+	if _, err := mappedUser(t, h, "eve"); err == nil {
+		t.Errorf("bad record should fail")
+	}
+
+	srv.close()
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("should not be healthy when server is down")
+	}
+}
+
+func TestPipeManager(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.close()
+
+	p := newTestPlugin(t, srv)
+
+	hostKey := string(ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "ed25519")))
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "carol", Host: "10.0.0.2", Port: 2222}); err == nil {
+		t.Errorf("create pipe without host key should fail")
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "carol", Host: "10.0.0.2", Port: 2222, HostKey: "invalid"}); err == nil {
+		t.Errorf("create pipe with invalid host key should fail")
+	}
+
+	for _, opt := range []upstream.CreatePipeOption{
+		{Username: "alice", HostKey: hostKey},
+		{Username: "bob", IgnoreHostKey: true},
+	} {
+		opt.UpstreamUsername, opt.Host, opt.Port = opt.Username+"_up", "10.0.0.2", 2222
+		if err := p.CreatePipe(opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var alice upstream.PipeSpec
+	if err := json.Unmarshal([]byte(srv.data["sshpiper/alice"]), &alice); err != nil {
+		t.Fatal(err)
+	}
+
+	if alice.HostKey != hostKey || alice.IgnoreHostKey {
+		t.Errorf("host key of alice should be kept %v", alice)
+	}
+
+	if err := p.CreatePipe(upstream.CreatePipeOption{Username: "alice", Host: "10.0.0.3", Port: 22, IgnoreHostKey: true}); err == nil {
+		t.Errorf("create existing pipe should fail")
+	}
+
+	other := "{}"
+	srv.set("other/carol", &other)
+
+	pipes, err := p.ListPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 2 {
+		t.Fatalf("unexpected pipes %v", pipes)
+	}
+
+	for _, pipe := range pipes {
+		if pipe.UpstreamUsername != pipe.Username+"_up" || pipe.Host != "10.0.0.2" || pipe.Port != 2222 {
+			t.Errorf("unexpected pipe %v", pipe)
+		}
+	}
+
+	if err := p.RemovePipe("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	pipes, err = p.ListPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 1 || pipes[0].Username != "bob" {
+		t.Errorf("alice should be removed %v", pipes)
+	}
+}
+
+func TestGlobEscape(t *testing.T) {
+	for in, expected := range map[string]string{
+		"sshpiper/":  "sshpiper/",
+		"a*b?[c]":    `a\*b\?\[c\]`,
+		`back\slash`: `back\\slash`,
+	} {
+		if out := globEscape(in); out != expected {
+			t.Errorf("escape %v expect %v got %v", in, expected, out)
+		}
+
+		if globPrefix(globEscape(in)+"*") != in {
+			t.Errorf("test server should unescape %v", in)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package ldap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// userEntry is the downstream user found in ldap
+type userEntry struct {
+	dn         string
+	host       string
+	mappedUser string
+	keys       []ssh.PublicKey
+}
+
+func (p *plugin) dial() (*ldap.Conn, error) {
+	l, err := ldap.DialURL(p.Config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: p.Config.Timeout}), ldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	l.SetTimeout(p.Config.Timeout)
+
+	if p.Config.StartTLS {
+		if err := l.StartTLS(p.tlsConfig); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (p *plugin) bind(l *ldap.Conn) error {
+	if p.Config.BindDN == "" {
+		return l.UnauthenticatedBind("")
+	}
+
+	return l.Bind(p.Config.BindDN, p.Config.BindPassword)
+}
+
+func (p *plugin) lookupUser(user string) (*userEntry, error) {
+	l, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	if err := p.bind(l); err != nil {
+		return nil, err
+	}
+
+	attrs := []string{p.Config.HostAttr, p.Config.PublicKeyAttr}
+	if p.Config.MappedUserAttr != "" {
+		attrs = append(attrs, p.Config.MappedUserAttr)
+	}
+
+	req := ldap.NewSearchRequest(
+		p.Config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.Config.Timeout.Seconds()), false,
+		strings.Replace(p.Config.UserFilter, "%s", ldap.EscapeFilter(user), -1),
+		attrs,
+		nil,
+	)
+
+	result, err := l.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, fmt.Errorf("more than one entry found for username [%v]", user)
+		}
+
+		return nil, err
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, &upstream.NotFoundError{User: user}
+	case 1:
+	default:
+		return nil, fmt.Errorf("more than one entry found for username [%v]", user)
+	}
+
+	e := result.Entries[0]
+
+	u := &userEntry{
+		dn:         e.DN,
+		host:       e.GetAttributeValue(p.Config.HostAttr),
+		mappedUser: user,
+	}
+
+	if u.host == "" {
+		return nil, fmt.Errorf("no %v in entry %v", p.Config.HostAttr, e.DN)
+	}
+
+	if p.Config.MappedUserAttr != "" {
+		if mapped := e.GetAttributeValue(p.Config.MappedUserAttr); mapped != "" {
+			u.mappedUser = mapped
+		}
+	}
+
+	for _, v := range e.GetAttributeValues(p.Config.PublicKeyAttr) {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v))
+		if err != nil {
+			p.logger.Warnf("parse %v of %v error: %v, skip to next key", p.Config.PublicKeyAttr, e.DN, err)
+			continue
+		}
+
+		u.keys = append(u.keys, key)
+	}
+
+	return u, nil
+}
+
+// verifyPassword binds as the user
+func (p *plugin) verifyPassword(dn string, password []byte) error {
+	// empty password is an unauthenticated bind which always succeeds
+	if len(password) == 0 {
+		return fmt.Errorf("empty password")
+	}
+
+	l, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return l.Bind(dn, string(password))
+}
+
+func (p *plugin) loadPrivateKey(u *userEntry, user string) (ssh.Signer, error) {
+	file := os.Expand(p.Config.PrivateKey, func(placeholderName string) string {
+		switch placeholderName {
+		case "USER":
+			return user
+		case "MAPPED_USER":
+			return u.mappedUser
+		}
+
+		return os.Getenv(placeholderName)
+	})
+
+	privateBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(privateBytes)
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	v, err := p.cache.Get(user, "", func() (interface{}, error) {
+		return p.lookupUser(user)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u := v.(*userEntry)
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+
+	if !p.Config.IgnoreHostKey {
+		hostKeyCallback, err = knownhosts.New(p.Config.KnownHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": u.host, "mapped_user": u.mappedUser}).Infof("mapping user [%v] to [%v@%v]", user, u.mappedUser, u.host)
+
+	c, err := upstream.DialForSSH(u.host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := &ssh.AuthPipe{
+		User: u.mappedUser,
+
+		UpstreamHostKeyCallback: hostKeyCallback,
+	}
+
+	a.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+		keydata := key.Marshal()
+
+		for _, k := range u.keys {
+			if !bytes.Equal(k.Marshal(), keydata) {
+				continue
+			}
+
+			// signature of downstream is bound to its own session, upstream would never accept it
+			if p.Config.PrivateKey == "" {
+				p.logger.WithConn(conn).Warnf("public key of user [%v] matched but upstream-ldap-private-key is not set, public key auth denied", user)
+				return ssh.AuthPipeTypeNone, nil, nil
+			}
+
+			signer, err := p.loadPrivateKey(u, user)
+			if err != nil {
+				p.logger.WithConn(conn).Errorf("mapping private key error: %v, public key auth denied for [%v] from [%v]", err, user, conn.RemoteAddr())
+				return ssh.AuthPipeTypeNone, nil, nil
+			}
+
+			return ssh.AuthPipeTypeMap, ssh.PublicKeys(signer), nil
+		}
+
+		p.logger.WithConn(conn).Warnf("public key auth failed user [%v] from [%v]", user, conn.RemoteAddr())
+
+		// try one
+		return ssh.AuthPipeTypeNone, nil, nil
+	}
+
+	if p.Config.PasswordBind {
+		a.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			if err := p.verifyPassword(u.dn, password); err != nil {
+				p.logger.WithConn(conn).Warnf("password auth failed user [%v] from [%v]: %v", user, conn.RemoteAddr(), err)
+				return ssh.AuthPipeTypeNone, nil, nil
+			}
+
+			signer, err := p.loadPrivateKey(u, user)
+			if err != nil {
+				p.logger.WithConn(conn).Errorf("mapping private key error: %v, password auth denied for [%v] from [%v]", err, user, conn.RemoteAddr())
+				return ssh.AuthPipeTypeNone, nil, nil
+			}
+
+			return ssh.AuthPipeTypeMap, ssh.PublicKeys(signer), nil
+		}
+	}
+
+	return c, a, nil
+}
@@ -0,0 +1,275 @@
+package ldap
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+const (
+	testBindDN       = "cn=admin,dc=example,dc=org"
+	testBindPassword = "adminpass"
+)
+
+type testUser struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// testServer is a minimal ldap server which only supports simple bind and search by uid
+type testServer struct {
+	l     net.Listener
+	users map[string]testUser
+}
+
+func newTestServer(t *testing.T, users map[string]testUser) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{l, users}
+	go s.serve()
+
+	return s
+}
+
+func (s *testServer) url() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(c)
+	}
+}
+
+func ldapResult(id int64, op ber.Tag, code int64) *ber.Packet {
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+
+	return message(id, r)
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+
+	return p
+}
+
+func searchEntry(id int64, u testUser) *ber.Packet {
+	e := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	e.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, u.dn, ""))
+
+	attrs := ber.NewSequence("")
+	for k, vals := range u.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range vals {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+
+	e.AppendChild(attrs)
+
+	return message(id, e)
+}
+
+var uidFilter = regexp.MustCompile(`\(uid=([^)]*)\)`)
+
+func (s *testServer) handle(c net.Conn) {
+	defer c.Close()
+
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil {
+			return
+		}
+
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			code := int64(ldap.LDAPResultInvalidCredentials)
+
+			if dn == testBindDN && password == testBindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+
+			for _, u := range s.users {
+				if u.dn == dn && u.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+
+			c.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+
+			if m := uidFilter.FindStringSubmatch(filter); m != nil {
+				if u, ok := s.users[m[1]]; ok {
+					c.Write(searchEntry(id, u).Bytes())
+				}
+			}
+
+			c.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestFindUpstream(t *testing.T) {
+	upstream := upstreamtest.Listen(t)
+	defer upstream.Close()
+
+	srv := newTestServer(t, map[string]testUser{
+		"alice": {
+			dn:       "uid=alice,ou=people,dc=example,dc=org",
+			password: "alicepass",
+			attrs: map[string][]string{
+				"host":         {upstream.Addr().String()},
+				"sshpiperUser": {"bob"},
+				"sshPublicKey": {"bad key", string(ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "rsa")))},
+			},
+		},
+	})
+	defer srv.l.Close()
+
+	dir, err := ioutil.TempDir("", "sshpiperd_ldap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "bob"), testdata.PEMBytes["ed25519"], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &plugin{}
+	p.Config.URL = srv.url()
+	p.Config.Timeout = 5 * time.Second
+	p.Config.BindDN = testBindDN
+	p.Config.BindPassword = testBindPassword
+	p.Config.BaseDN = "dc=example,dc=org"
+	p.Config.UserFilter = "(&(objectClass=posixAccount)(uid=%s))"
+	p.Config.HostAttr = "host"
+	p.Config.MappedUserAttr = "sshpiperUser"
+	p.Config.PublicKeyAttr = "sshPublicKey"
+	p.Config.PrivateKey = filepath.Join(dir, "$MAPPED_USER")
+	p.Config.PasswordBind = true
+	p.Config.IgnoreHostKey = true
+
+	upstreamtest.Init(t, p)
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice"}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+
+	if c.RemoteAddr().String() != upstream.Addr().String() || pipe.User != "bob" {
+		t.Errorf("unexpected pipe %v %v", c.RemoteAddr(), pipe.User)
+	}
+
+	if typ, method, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "rsa")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("key in sshPublicKey should be mapped")
+	}
+
+	if typ, _, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "ecdsa")); typ != ssh.AuthPipeTypeNone {
+		t.Errorf("other key should not be mapped")
+	}
+
+	p.Config.PrivateKey = ""
+	if typ, _, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "rsa")); typ != ssh.AuthPipeTypeNone {
+		t.Errorf("key should not be passed through without private key")
+	}
+	p.Config.PrivateKey = filepath.Join(dir, "$MAPPED_USER")
+
+	if typ, method, _ := pipe.PasswordCallback(upstreamtest.Conn{Username: "alice"}, []byte("alicepass")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("password should be verified and mapped")
+	}
+
+	for _, password := range []string{"wrong", ""} {
+		if typ, _, _ := pipe.PasswordCallback(upstreamtest.Conn{Username: "alice"}, []byte(password)); typ != ssh.AuthPipeTypeNone {
+			t.Errorf("password %q should not be mapped", password)
+		}
+	}
+
+	for _, user := range []string{"eve", "*", "alice)(uid=*"} {
+		if _, _, err := h(upstreamtest.Conn{Username: user}, nil); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("%v should not be found %v", user, err)
+		}
+	}
+
+	p.Config.BindPassword = "wrong"
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("should not be healthy with wrong bind password")
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "alice"}, nil); err == nil {
+		t.Errorf("should fail with wrong bind password")
+	}
+}
+
+func TestInit(t *testing.T) {
+	p := &plugin{}
+	if err := p.Init(logging.Discard()); err == nil {
+		t.Errorf("should fail without url")
+	}
+
+	p.Config.URL = "ldap://127.0.0.1"
+	if err := p.Init(logging.Discard()); err == nil {
+		t.Errorf("should fail without known hosts")
+	}
+
+	p.Config.IgnoreHostKey = true
+	p.Config.PasswordBind = true
+	if err := p.Init(logging.Discard()); err == nil {
+		t.Errorf("password bind should fail without private key")
+	}
+}
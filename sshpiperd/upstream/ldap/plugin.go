@@ -0,0 +1,125 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+type plugin struct {
+	Config struct {
+		URL          string        `long:"upstream-ldap-url" description:"Ldap server, e.g. ldaps://ldap.example.com" env:"SSHPIPERD_UPSTREAM_LDAP_URL" ini-name:"upstream-ldap-url"`
+		StartTLS     bool          `long:"upstream-ldap-starttls" description:"Upgrade ldap:// connection with StartTLS" env:"SSHPIPERD_UPSTREAM_LDAP_STARTTLS" ini-name:"upstream-ldap-starttls"`
+		TLSCA        string        `long:"upstream-ldap-tls-ca" description:"CA bundle to verify the server, system CAs are used if empty" env:"SSHPIPERD_UPSTREAM_LDAP_TLS_CA" ini-name:"upstream-ldap-tls-ca"`
+		TLSInsecure  bool          `long:"upstream-ldap-tls-insecure" description:"Do not verify the server certificate" env:"SSHPIPERD_UPSTREAM_LDAP_TLS_INSECURE" ini-name:"upstream-ldap-tls-insecure"`
+		Timeout      time.Duration `long:"upstream-ldap-timeout" description:"Timeout of ldap operations" default:"5s" env:"SSHPIPERD_UPSTREAM_LDAP_TIMEOUT" ini-name:"upstream-ldap-timeout"`
+		BindDN       string        `long:"upstream-ldap-bind-dn" description:"DN to bind for searching users, anonymous if empty" env:"SSHPIPERD_UPSTREAM_LDAP_BIND_DN" ini-name:"upstream-ldap-bind-dn"`
+		BindPassword string        `long:"upstream-ldap-bind-password" description:"Password of bind dn" env:"SSHPIPERD_UPSTREAM_LDAP_BIND_PASSWORD" ini-name:"upstream-ldap-bind-password"`
+
+		BaseDN         string `long:"upstream-ldap-base-dn" description:"Base dn to search users" env:"SSHPIPERD_UPSTREAM_LDAP_BASE_DN" ini-name:"upstream-ldap-base-dn"`
+		UserFilter     string `long:"upstream-ldap-user-filter" description:"Filter to find downstream user, %s is replaced by the escaped username" default:"(&(objectClass=posixAccount)(uid=%s))" env:"SSHPIPERD_UPSTREAM_LDAP_USER_FILTER" ini-name:"upstream-ldap-user-filter"`
+		HostAttr       string `long:"upstream-ldap-host-attr" description:"Attribute of upstream host[:port]" default:"host" env:"SSHPIPERD_UPSTREAM_LDAP_HOST_ATTR" ini-name:"upstream-ldap-host-attr"`
+		MappedUserAttr string `long:"upstream-ldap-mapped-user-attr" description:"Attribute of user to login upstream, downstream username is used if empty or missing" env:"SSHPIPERD_UPSTREAM_LDAP_MAPPED_USER_ATTR" ini-name:"upstream-ldap-mapped-user-attr"`
+		PublicKeyAttr  string `long:"upstream-ldap-public-key-attr" description:"Attribute of downstream public keys in authorized_keys format" default:"sshPublicKey" env:"SSHPIPERD_UPSTREAM_LDAP_PUBLIC_KEY_ATTR" ini-name:"upstream-ldap-public-key-attr"`
+
+		PrivateKey    string `long:"upstream-ldap-private-key" description:"Private key to login upstream after downstream is verified, $USER and $MAPPED_USER are expanded, e.g. /var/sshpiper/keys/$MAPPED_USER" env:"SSHPIPERD_UPSTREAM_LDAP_PRIVATE_KEY" ini-name:"upstream-ldap-private-key"`
+		PasswordBind  bool   `long:"upstream-ldap-password-bind" description:"Verify downstream password by binding as the user and map it to the private key" env:"SSHPIPERD_UPSTREAM_LDAP_PASSWORD_BIND" ini-name:"upstream-ldap-password-bind"`
+		KnownHosts    string `long:"upstream-ldap-known-hosts" description:"known_hosts file to verify upstream host keys" env:"SSHPIPERD_UPSTREAM_LDAP_KNOWN_HOSTS" ini-name:"upstream-ldap-known-hosts"`
+		IgnoreHostKey bool   `long:"upstream-ldap-ignore-hostkey" description:"Do not verify upstream host keys" env:"SSHPIPERD_UPSTREAM_LDAP_IGNORE_HOSTKEY" ini-name:"upstream-ldap-ignore-hostkey"`
+	}
+
+	logger    logging.Logger
+	tlsConfig *tls.Config
+	cache     *upstream.Cache
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "ldap"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+// User entries are cached, passwords are always verified by the server
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.cache = cache
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	if p.Config.URL == "" {
+		return fmt.Errorf("upstream-ldap-url is required")
+	}
+
+	if p.Config.KnownHosts == "" && !p.Config.IgnoreHostKey {
+		return fmt.Errorf("upstream-ldap-known-hosts is required unless upstream-ldap-ignore-hostkey")
+	}
+
+	if p.Config.PasswordBind && p.Config.PrivateKey == "" {
+		return fmt.Errorf("upstream-ldap-private-key is required by upstream-ldap-password-bind")
+	}
+
+	p.tlsConfig = &tls.Config{
+		InsecureSkipVerify: p.Config.TLSInsecure,
+	}
+
+	if p.Config.TLSCA != "" {
+		pem, err := ioutil.ReadFile(p.Config.TLSCA)
+		if err != nil {
+			return err
+		}
+
+		p.tlsConfig.RootCAs = x509.NewCertPool()
+		if !p.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %v", p.Config.TLSCA)
+		}
+	}
+
+	logger.Printf("upstream provider: ldap from [%v] initializing", p.Config.URL)
+
+	return nil
+}
+
+// The ldap server must be reachable and bind dn must be accepted
+func (p *plugin) HealthCheck() error {
+	l, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return p.bind(l)
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+// Pipes are managed in ldap
+
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	return nil, fmt.Errorf("pipes are managed in %v, not supported by ldap driver", p.Config.URL)
+}
+
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return fmt.Errorf("pipes are managed in %v, not supported by ldap driver", p.Config.URL)
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	return fmt.Errorf("pipes are managed in %v, not supported by ldap driver", p.Config.URL)
+}
+
+func init() {
+	upstream.Register("ldap", &plugin{})
+}
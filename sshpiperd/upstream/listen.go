@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"net"
+	"strings"
+)
+
+// MatchListen reports whether the local address a downstream connected to matches any of patterns
+// patterns are host:port, :port or host, all addresses match if patterns is empty
+func MatchListen(patterns []string, local net.Addr) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	if local == nil {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+
+		h, p, err := net.SplitHostPort(pattern)
+		if err != nil {
+			// host only
+			h, p = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]"), ""
+		}
+
+		if p != "" && p != port {
+			continue
+		}
+
+		if h != "" && !sameHost(h, host) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func sameHost(a, b string) bool {
+	if ipa, ipb := net.ParseIP(a), net.ParseIP(b); ipa != nil && ipb != nil {
+		return ipa.Equal(ipb)
+	}
+
+	return strings.EqualFold(a, b)
+}
@@ -0,0 +1,35 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchListen(t *testing.T) {
+	addr := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+
+	for _, tc := range []struct {
+		patterns []string
+		addr     net.Addr
+		matched  bool
+	}{
+		{nil, addr("10.0.0.1", 2222), true},
+		{nil, nil, true},
+		{[]string{":2201"}, addr("10.0.0.1", 2201), true},
+		{[]string{":2201"}, addr("10.0.0.1", 2222), false},
+		{[]string{"10.0.0.1:2201"}, addr("10.0.0.1", 2201), true},
+		{[]string{"10.0.0.1:2201"}, addr("10.0.0.2", 2201), false},
+		{[]string{"10.0.0.1"}, addr("10.0.0.1", 2222), true},
+		{[]string{"10.0.0.2", ":2222"}, addr("10.0.0.1", 2222), true},
+		{[]string{"[::1]:2201"}, addr("::1", 2201), true},
+		{[]string{"::1"}, addr("::1", 2201), true},
+		{[]string{"[0:0::1]"}, addr("::1", 2201), true},
+		{[]string{":2201"}, nil, false},
+	} {
+		if MatchListen(tc.patterns, tc.addr) != tc.matched {
+			t.Errorf("%v matched by %v should be %v", tc.addr, tc.patterns, tc.matched)
+		}
+	}
+}
@@ -22,6 +22,15 @@ type CreatePipeOption struct {
 	UpstreamUsername string
 	Host             string
 	Port             int
+
+	// HostKey is the upstream host key in authorized_keys format, ignored by drivers not verifying host keys
+	HostKey string
+
+	// IgnoreHostKey skips upstream host key verification if HostKey is empty
+	IgnoreHostKey bool
+
+	// Source is the driver to create the pipe in, used by drivers combining others
+	Source string
 }
 
 // Pipe is a connection which linked downstream and upstream
@@ -31,6 +40,9 @@ type Pipe struct {
 	UpstreamUsername string
 	Host             string
 	Port             int
+
+	// Source is the driver where the pipe is from, set by drivers combining others
+	Source string
 }
 
 // PipeManager manages pipe inside upstream
@@ -54,6 +66,14 @@ type Provider interface {
 	GetHandler() Handler
 }
 
+// HealthChecker is an optional interface of Provider
+// to tell whether the provider is usable, e.g. its database is reachable
+type HealthChecker interface {
+
+	// HealthCheck returns nil if the provider is ready to serve
+	HealthCheck() error
+}
+
 var (
 	drivers = registry.NewRegistry()
 )
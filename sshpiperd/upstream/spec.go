@@ -0,0 +1,315 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// LookupRequest is what drivers resolving upstream from an external service (http, exec)
+// send to the service to describe the downstream connection
+type LookupRequest struct {
+	User          string            `json:"user"`
+	RemoteAddr    string            `json:"remote_addr,omitempty"`
+	RemoteIP      string            `json:"remote_ip,omitempty"`
+	LocalAddr     string            `json:"local_addr,omitempty"`
+	ClientVersion string            `json:"client_version,omitempty"`
+	Challenger    *ChallengerResult `json:"challenger,omitempty"`
+}
+
+// ChallengerResult is the additional challenge context in LookupRequest
+type ChallengerResult struct {
+	Name     string      `json:"name"`
+	Username string      `json:"username"`
+	Meta     interface{} `json:"meta,omitempty"`
+}
+
+// NewLookupRequest describes the downstream connection and its challenge context
+func NewLookupRequest(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) *LookupRequest {
+	r := &LookupRequest{
+		User:          conn.User(),
+		ClientVersion: string(conn.ClientVersion()),
+	}
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		r.RemoteAddr = addr.String()
+
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			r.RemoteIP = host
+		}
+	}
+
+	if addr := conn.LocalAddr(); addr != nil {
+		r.LocalAddr = addr.String()
+	}
+
+	if challengeContext != nil {
+		r.Challenger = &ChallengerResult{
+			Name:     challengeContext.ChallengerName(),
+			Username: challengeContext.ChallengedUsername(),
+			Meta:     challengeContext.Meta(),
+		}
+	}
+
+	return r
+}
+
+// Marshal encodes the request to json, challenger meta is dropped if it is not json friendly
+func (r *LookupRequest) Marshal() ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil && r.Challenger != nil && r.Challenger.Meta != nil {
+		c := *r.Challenger
+		c.Meta = nil
+
+		req := *r
+		req.Challenger = &c
+
+		return json.Marshal(req)
+	}
+
+	return body, err
+}
+
+// CacheKey is the json of request without source port which changes for every connection
+func (r *LookupRequest) CacheKey() (string, error) {
+	req := *r
+	req.RemoteAddr = ""
+
+	key, err := req.Marshal()
+	return string(key), err
+}
+
+// GetSpec is Get of lookups returning PipeSpec
+func (c *Cache) GetSpec(req *LookupRequest, load func() (*PipeSpec, error)) (*PipeSpec, error) {
+	key, err := req.CacheKey()
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := c.Get(req.User, key, func() (interface{}, error) {
+		return load()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return spec.(*PipeSpec), nil
+}
+
+// auth mapping types of PipeSpec
+const (
+	AuthTypePassThrough = "passthrough"
+	AuthTypeNone        = "none"
+	AuthTypePassword    = "password"
+	AuthTypePrivateKey  = "private_key"
+)
+
+// PipeSpec is the upstream of a downstream user returned by external services
+type PipeSpec struct {
+	// host:port of upstream, port 22 if omitted
+	Address string `json:"address"`
+
+	// user to login upstream, downstream user if empty
+	User string `json:"user,omitempty"`
+
+	// upstream host key in authorized_keys format, or lines of known_hosts
+	HostKey       string `json:"host_key,omitempty"`
+	KnownHosts    string `json:"known_hosts,omitempty"`
+	IgnoreHostKey bool   `json:"ignore_host_key,omitempty"`
+
+	Auth AuthSpec `json:"auth"`
+}
+
+// AuthSpec maps downstream auth to upstream auth
+//
+// downstream public keys in AuthorizedKeys and DownstreamPassword are mapped to
+// upstream auth of Type, public keys in KeyMap are mapped to their own private keys,
+// other auth attempts are passed through unless NoPassthrough
+type AuthSpec struct {
+	Type       string `json:"type,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+
+	AuthorizedKeys     string       `json:"authorized_keys,omitempty"`
+	DownstreamPassword string       `json:"downstream_password,omitempty"`
+	KeyMap             []KeyMapSpec `json:"key_map,omitempty"`
+
+	NoPassthrough bool `json:"no_passthrough,omitempty"`
+}
+
+// KeyMapSpec maps downstream public keys to an upstream private key
+type KeyMapSpec struct {
+	AuthorizedKeys string `json:"authorized_keys"`
+	PrivateKey     string `json:"private_key"`
+}
+
+func parseAuthorizedKeys(data string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+
+	rest := []byte(data)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, r, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		rest = r
+	}
+
+	return keys, nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	keydata := key.Marshal()
+
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), keydata) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HostKeyCallback verifies upstream host key with HostKey or KnownHosts
+func (s *PipeSpec) HostKeyCallback() (ssh.HostKeyCallback, error) {
+	if s.IgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if s.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("bad host key: %v", err)
+		}
+
+		return ssh.FixedHostKey(key), nil
+	}
+
+	if s.KnownHosts != "" {
+		return knownhosts.NewFromReader(strings.NewReader(s.KnownHosts))
+	}
+
+	return nil, fmt.Errorf("no host key specified")
+}
+
+// AuthPipe converts the spec to auth pipe, downstream user is used when User is empty
+func (s *PipeSpec) AuthPipe(downstreamUser string) (*ssh.AuthPipe, error) {
+	hostKeyCallback, err := s.HostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := s.Auth
+
+	var method ssh.AuthMethod
+	authType := ssh.AuthPipeTypePassThrough
+
+	switch auth.Type {
+	case "", AuthTypePassThrough:
+	case AuthTypeNone:
+		authType = ssh.AuthPipeTypeNone
+	case AuthTypePassword:
+		if auth.Password == "" {
+			return nil, fmt.Errorf("no password for auth type %v", auth.Type)
+		}
+
+		authType = ssh.AuthPipeTypeMap
+		method = ssh.Password(auth.Password)
+	case AuthTypePrivateKey:
+		signer, err := ssh.ParsePrivateKey([]byte(auth.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("bad private key: %v", err)
+		}
+
+		authType = ssh.AuthPipeTypeMap
+		method = ssh.PublicKeys(signer)
+	default:
+		return nil, fmt.Errorf("unsupported auth type %v", auth.Type)
+	}
+
+	authorizedKeys, err := parseAuthorizedKeys(auth.AuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("bad authorized keys: %v", err)
+	}
+
+	type keyMapping struct {
+		keys   []ssh.PublicKey
+		signer ssh.Signer
+	}
+
+	var keyMap []keyMapping
+	for _, m := range auth.KeyMap {
+		keys, err := parseAuthorizedKeys(m.AuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("bad authorized keys in key map: %v", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey([]byte(m.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("bad private key in key map: %v", err)
+		}
+
+		keyMap = append(keyMap, keyMapping{keys, signer})
+	}
+
+	unmatched := func() (ssh.AuthPipeType, ssh.AuthMethod, error) {
+		if auth.NoPassthrough {
+			return ssh.AuthPipeTypeDiscard, nil, nil
+		}
+
+		return ssh.AuthPipeTypePassThrough, nil, nil
+	}
+
+	user := s.User
+	if user == "" {
+		user = downstreamUser
+	}
+
+	a := &ssh.AuthPipe{
+		User: user,
+
+		UpstreamHostKeyCallback: hostKeyCallback,
+	}
+
+	if auth.NoPassthrough {
+		a.NoneAuthCallback = func(conn ssh.ConnMetadata) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			return unmatched()
+		}
+	}
+
+	if auth.DownstreamPassword != "" || auth.NoPassthrough {
+		a.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			if auth.DownstreamPassword != "" && subtle.ConstantTimeCompare(password, []byte(auth.DownstreamPassword)) == 1 {
+				return authType, method, nil
+			}
+
+			return unmatched()
+		}
+	}
+
+	if len(authorizedKeys) > 0 || len(keyMap) > 0 || auth.NoPassthrough {
+		a.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.AuthPipeType, ssh.AuthMethod, error) {
+			for _, m := range keyMap {
+				if containsKey(m.keys, key) {
+					return ssh.AuthPipeTypeMap, ssh.PublicKeys(m.signer), nil
+				}
+			}
+
+			if containsKey(authorizedKeys, key) {
+				return authType, method, nil
+			}
+
+			return unmatched()
+		}
+	}
+
+	return a, nil
+}
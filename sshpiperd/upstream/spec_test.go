@@ -0,0 +1,169 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+type specConn struct {
+	ssh.ConnMetadata
+}
+
+func (specConn) User() string {
+	return "alice"
+}
+
+func (specConn) ClientVersion() []byte {
+	return []byte("SSH-2.0-test")
+}
+
+func (specConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+}
+
+func (specConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func authorizedKey(t *testing.T, name string) (string, ssh.PublicKey) {
+	signer, err := ssh.ParsePrivateKey(testdata.PEMBytes[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), signer.PublicKey()
+}
+
+func TestNewLookupRequest(t *testing.T) {
+	r := NewLookupRequest(specConn{}, nil)
+
+	if r.User != "alice" || r.RemoteAddr != "10.0.0.1:2222" || r.RemoteIP != "10.0.0.1" || r.LocalAddr != "" || r.ClientVersion != "SSH-2.0-test" || r.Challenger != nil {
+		t.Errorf("unexpected request %+v", r)
+	}
+}
+
+func TestPipeSpecHostKey(t *testing.T) {
+	hostKey, pub := authorizedKey(t, "rsa")
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	if _, err := (&PipeSpec{}).HostKeyCallback(); err == nil {
+		t.Errorf("should fail without host key")
+	}
+
+	cb, err := (&PipeSpec{HostKey: hostKey}).HostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cb("127.0.0.1:22", addr, pub); err != nil {
+		t.Errorf("should accept host key %v", err)
+	}
+
+	_, other := authorizedKey(t, "ed25519")
+	if err := cb("127.0.0.1:22", addr, other); err == nil {
+		t.Errorf("should reject other host key")
+	}
+
+	cb, err = (&PipeSpec{KnownHosts: "127.0.0.1 " + hostKey}).HostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cb("127.0.0.1:22", addr, pub); err != nil {
+		t.Errorf("should accept known host %v", err)
+	}
+}
+
+func TestPipeSpecAuthPipe(t *testing.T) {
+	mappedKey, mapped := authorizedKey(t, "ecdsa")
+	allowedKey, allowed := authorizedKey(t, "rsa")
+	_, other := authorizedKey(t, "ed25519")
+
+	spec := &PipeSpec{
+		Address:       "127.0.0.1:22",
+		IgnoreHostKey: true,
+		Auth: AuthSpec{
+			Type:               AuthTypePassword,
+			Password:           "upstream",
+			AuthorizedKeys:     allowedKey,
+			DownstreamPassword: "downstream",
+			KeyMap: []KeyMapSpec{
+				{AuthorizedKeys: mappedKey, PrivateKey: string(testdata.PEMBytes["ed25519"])},
+			},
+		},
+	}
+
+	a, err := spec.AuthPipe("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.User != "alice" || a.NoneAuthCallback != nil {
+		t.Errorf("unexpected auth pipe %+v", a)
+	}
+
+	for _, c := range []struct {
+		name   string
+		call   func() (ssh.AuthPipeType, ssh.AuthMethod, error)
+		expect ssh.AuthPipeType
+	}{
+		{"password", func() (ssh.AuthPipeType, ssh.AuthMethod, error) { return a.PasswordCallback(nil, []byte("downstream")) }, ssh.AuthPipeTypeMap},
+		{"wrong password", func() (ssh.AuthPipeType, ssh.AuthMethod, error) { return a.PasswordCallback(nil, []byte("x")) }, ssh.AuthPipeTypePassThrough},
+		{"key map", func() (ssh.AuthPipeType, ssh.AuthMethod, error) { return a.PublicKeyCallback(nil, mapped) }, ssh.AuthPipeTypeMap},
+		{"authorized key", func() (ssh.AuthPipeType, ssh.AuthMethod, error) { return a.PublicKeyCallback(nil, allowed) }, ssh.AuthPipeTypeMap},
+		{"other key", func() (ssh.AuthPipeType, ssh.AuthMethod, error) { return a.PublicKeyCallback(nil, other) }, ssh.AuthPipeTypePassThrough},
+	} {
+		typ, method, err := c.call()
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+
+		if typ != c.expect {
+			t.Errorf("%v: expect %v got %v", c.name, c.expect, typ)
+		}
+
+		if (typ == ssh.AuthPipeTypeMap) != (method != nil) {
+			t.Errorf("%v: method should be returned only for map", c.name)
+		}
+	}
+
+	spec.User = "bob"
+	spec.Auth.NoPassthrough = true
+
+	a, err = spec.AuthPipe("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.User != "bob" {
+		t.Errorf("unexpected user %v", a.User)
+	}
+
+	if typ, _, _ := a.NoneAuthCallback(nil); typ != ssh.AuthPipeTypeDiscard {
+		t.Errorf("none should be discarded")
+	}
+
+	if typ, _, _ := a.PublicKeyCallback(nil, other); typ != ssh.AuthPipeTypeDiscard {
+		t.Errorf("other key should be discarded")
+	}
+}
+
+func TestPipeSpecBadAuth(t *testing.T) {
+	for _, auth := range []AuthSpec{
+		{Type: "unknown"},
+		{Type: AuthTypePassword},
+		{Type: AuthTypePrivateKey, PrivateKey: "bad"},
+		{AuthorizedKeys: "bad"},
+		{KeyMap: []KeyMapSpec{{AuthorizedKeys: "bad"}}},
+	} {
+		spec := &PipeSpec{IgnoreHostKey: true, Auth: auth}
+
+		if _, err := spec.AuthPipe("alice"); err == nil {
+			t.Errorf("%+v should fail", auth)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package target
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// auth modes
+const (
+	authPassThrough = "passthrough"
+	authSharedKey   = "shared-key"
+	authUserKey     = "user-key"
+)
+
+type plugin struct {
+	Config struct {
+		Separator     string        `long:"upstream-target-separator" description:"Characters separating username and target, the first one found in username is used" default:"+@" env:"SSHPIPERD_UPSTREAM_TARGET_SEPARATOR" ini-name:"upstream-target-separator"`
+		Allow         []string      `long:"upstream-target-allow" description:"Allowed targets, host patterns like *.internal or networks like 10.0.0.0/8, can be repeated" env:"SSHPIPERD_UPSTREAM_TARGET_ALLOW" env-delim:"," ini-name:"upstream-target-allow"`
+		AllowPorts    []int         `long:"upstream-target-allow-port" description:"Allowed target ports, all ports if empty, can be repeated" env:"SSHPIPERD_UPSTREAM_TARGET_ALLOW_PORT" env-delim:"," ini-name:"upstream-target-allow-port"`
+		DefaultPort   int           `long:"upstream-target-default-port" description:"Port of targets without port" default:"22" env:"SSHPIPERD_UPSTREAM_TARGET_DEFAULT_PORT" ini-name:"upstream-target-default-port"`
+		Timeout       time.Duration `long:"upstream-target-timeout" description:"Timeout of resolving target hostnames" default:"5s" env:"SSHPIPERD_UPSTREAM_TARGET_TIMEOUT" ini-name:"upstream-target-timeout"`
+		KnownHosts    string        `long:"upstream-target-known-hosts" description:"Known hosts file to verify targets" env:"SSHPIPERD_UPSTREAM_TARGET_KNOWN_HOSTS" ini-name:"upstream-target-known-hosts"`
+		IgnoreHostKey bool          `long:"upstream-target-ignore-host-key" description:"Do not verify host keys of targets" env:"SSHPIPERD_UPSTREAM_TARGET_IGNORE_HOST_KEY" ini-name:"upstream-target-ignore-host-key"`
+
+		Auth           string `long:"upstream-target-auth" description:"Upstream auth, passthrough, shared-key or user-key" default:"passthrough" choice:"passthrough" choice:"shared-key" choice:"user-key" env:"SSHPIPERD_UPSTREAM_TARGET_AUTH" ini-name:"upstream-target-auth"`
+		PrivateKey     string `long:"upstream-target-private-key" description:"Private key to login targets with shared-key auth" env:"SSHPIPERD_UPSTREAM_TARGET_PRIVATE_KEY" ini-name:"upstream-target-private-key"`
+		AuthorizedKeys string `long:"upstream-target-authorized-keys" description:"Downstream public keys mapped to the shared private key" env:"SSHPIPERD_UPSTREAM_TARGET_AUTHORIZED_KEYS" ini-name:"upstream-target-authorized-keys"`
+		UserKeyDir     string `long:"upstream-target-user-key-dir" description:"Directory of <user>/id_rsa and <user>/authorized_keys with user-key auth" env:"SSHPIPERD_UPSTREAM_TARGET_USER_KEY_DIR" ini-name:"upstream-target-user-key-dir"`
+	}
+
+	logger logging.Logger
+
+	// parsed allow list
+	networks []*net.IPNet
+	patterns []string
+
+	resolver *net.Resolver
+}
+
+// The name of the Plugin
+func (p *plugin) GetName() string {
+	return "target"
+}
+
+// A ref to a struct which holds the options for the plugins
+// will be populated by cmd or other plugin runners
+func (p *plugin) GetOpts() interface{} {
+	return &p.Config
+}
+
+func (p *plugin) parseAllow() error {
+	p.networks = nil
+	p.patterns = nil
+
+	for _, a := range p.Config.Allow {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == "" {
+			continue
+		}
+
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			p.networks = append(p.networks, n)
+			continue
+		}
+
+		if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			p.networks = append(p.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		if _, err := path.Match(a, ""); err != nil || strings.Contains(a, "/") {
+			return fmt.Errorf("bad allowed target %v", a)
+		}
+
+		p.patterns = append(p.patterns, a)
+	}
+
+	if len(p.networks) == 0 && len(p.patterns) == 0 {
+		return fmt.Errorf("upstream-target-allow is required")
+	}
+
+	return nil
+}
+
+// Will be called before the Plugin is used to ensure the Plugin is ready
+func (p *plugin) Init(logger logging.Logger) error {
+	p.logger = logger
+
+	if p.Config.Separator == "" {
+		return fmt.Errorf("upstream-target-separator is required")
+	}
+
+	if err := p.parseAllow(); err != nil {
+		return err
+	}
+
+	if p.Config.KnownHosts == "" && !p.Config.IgnoreHostKey {
+		return fmt.Errorf("upstream-target-known-hosts is required unless upstream-target-ignore-host-key")
+	}
+
+	switch p.Config.Auth {
+	case "", authPassThrough:
+	case authSharedKey:
+		if p.Config.PrivateKey == "" || p.Config.AuthorizedKeys == "" {
+			return fmt.Errorf("upstream-target-private-key and upstream-target-authorized-keys are required by %v auth", authSharedKey)
+		}
+	case authUserKey:
+		if p.Config.UserKeyDir == "" {
+			return fmt.Errorf("upstream-target-user-key-dir is required by %v auth", authUserKey)
+		}
+	default:
+		return fmt.Errorf("unsupported upstream-target-auth %v", p.Config.Auth)
+	}
+
+	p.resolver = net.DefaultResolver
+
+	logger.Printf("upstream provider: target allowing %v initializing", strings.Join(p.Config.Allow, ", "))
+
+	return nil
+}
+
+// Files in use must be readable
+func (p *plugin) HealthCheck() error {
+	for _, f := range []string{p.Config.KnownHosts, p.Config.PrivateKey, p.Config.AuthorizedKeys} {
+		if f == "" {
+			continue
+		}
+
+		if _, err := ioutil.ReadFile(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *plugin) GetHandler() upstream.Handler {
+	return p.findUpstream
+}
+
+// Pipes are embedded in usernames
+
+func (p *plugin) ListPipe() ([]upstream.Pipe, error) {
+	return nil, fmt.Errorf("targets are embedded in usernames, not supported by target driver")
+}
+
+func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
+	return fmt.Errorf("targets are embedded in usernames, not supported by target driver")
+}
+
+func (p *plugin) RemovePipe(name string) error {
+	return fmt.Errorf("targets are embedded in usernames, not supported by target driver")
+}
+
+func init() {
+	upstream.Register("target", &plugin{})
+}
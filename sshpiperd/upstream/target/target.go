@@ -0,0 +1,225 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// usernames used as directory names in user key dir
+var usernameRule = regexp.MustCompile("^[a-z_][-a-z0-9_]{0,31}$")
+
+// target is where a downstream username points to
+type target struct {
+	user string
+	host string
+	port int
+}
+
+func (t *target) String() string {
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+// parseUsername splits alice+host:port into alice and the target
+func (p *plugin) parseUsername(username string) (*target, error) {
+	i := strings.IndexAny(username, p.Config.Separator)
+	if i <= 0 || i == len(username)-1 {
+		return nil, &upstream.NotFoundError{User: username}
+	}
+
+	t := &target{user: username[:i], port: p.Config.DefaultPort}
+	addr := username[i+1:]
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		t.host = host
+		t.port, err = strconv.Atoi(port)
+		if err != nil || t.port <= 0 || t.port > 65535 {
+			return nil, fmt.Errorf("bad port in target %v", addr)
+		}
+	} else {
+		t.host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+
+	t.host = strings.TrimSuffix(strings.ToLower(t.host), ".")
+
+	if t.host == "" || strings.ContainsAny(t.host, "/@+ ") {
+		return nil, fmt.Errorf("bad host in target %v", addr)
+	}
+
+	return t, nil
+}
+
+func (p *plugin) allowedIP(ip net.IP) bool {
+	for _, n := range p.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *plugin) allowedPort(port int) bool {
+	if len(p.Config.AllowPorts) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.Config.AllowPorts {
+		if port == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve checks target against allow list and returns the address to dial
+// hostnames not matching any pattern are resolved and pinned to an allowed ip
+// only if all of their ips are in allowed networks
+func (p *plugin) resolve(t *target) (string, error) {
+	if !p.allowedPort(t.port) {
+		return "", fmt.Errorf("port of target %v is not allowed", t)
+	}
+
+	for _, pattern := range p.patterns {
+		if ok, _ := path.Match(pattern, t.host); ok {
+			return t.String(), nil
+		}
+	}
+
+	if ip := net.ParseIP(t.host); ip != nil {
+		if !p.allowedIP(ip) {
+			return "", fmt.Errorf("target %v is not allowed", t)
+		}
+
+		return t.String(), nil
+	}
+
+	if len(p.networks) == 0 {
+		return "", fmt.Errorf("target %v is not allowed", t)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Config.Timeout)
+	defer cancel()
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, t.host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("target %v has no address", t)
+	}
+
+	for _, a := range addrs {
+		if !p.allowedIP(a.IP) {
+			return "", fmt.Errorf("target %v resolves to %v which is not allowed", t, a.IP)
+		}
+	}
+
+	return net.JoinHostPort(addrs[0].IP.String(), strconv.Itoa(t.port)), nil
+}
+
+func readFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	return string(data), err
+}
+
+// pipeSpec builds spec of target with host key and auth in config
+func (p *plugin) pipeSpec(t *target, addr string) (*upstream.PipeSpec, error) {
+	spec := &upstream.PipeSpec{
+		Address:       addr,
+		User:          t.user,
+		IgnoreHostKey: p.Config.IgnoreHostKey,
+	}
+
+	var err error
+
+	if !spec.IgnoreHostKey {
+		if spec.KnownHosts, err = readFile(p.Config.KnownHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	switch p.Config.Auth {
+	case authSharedKey:
+		spec.Auth.Type = upstream.AuthTypePrivateKey
+
+		if spec.Auth.PrivateKey, err = readFile(p.Config.PrivateKey); err != nil {
+			return nil, err
+		}
+
+		if spec.Auth.AuthorizedKeys, err = readFile(p.Config.AuthorizedKeys); err != nil {
+			return nil, err
+		}
+
+	case authUserKey:
+		if !usernameRule.MatchString(t.user) {
+			return nil, fmt.Errorf("username [%v] is not allowed with %v auth", t.user, authUserKey)
+		}
+
+		dir := path.Join(p.Config.UserKeyDir, t.user)
+
+		spec.Auth.Type = upstream.AuthTypePrivateKey
+
+		if spec.Auth.PrivateKey, err = readFile(path.Join(dir, "id_rsa")); err != nil {
+			return nil, err
+		}
+
+		if spec.Auth.AuthorizedKeys, err = readFile(path.Join(dir, "authorized_keys")); err != nil {
+			return nil, err
+		}
+	}
+
+	return spec, nil
+}
+
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	t, err := p.parseUsername(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, err := p.resolve(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec, err := p.pipeSpec(t, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := spec.AuthPipe(t.user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// known hosts are matched by target hostname rather than the pinned ip
+	hostKeyCallback := a.UpstreamHostKeyCallback
+	a.UpstreamHostKeyCallback = func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeyCallback(t.String(), remote, key)
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": addr, "mapped_user": a.User}).Infof("mapping [%v] to [%v@%v]", user, a.User, t)
+
+	c, err := upstream.DialForSSH(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, a, nil
+}
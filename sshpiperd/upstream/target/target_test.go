@@ -0,0 +1,228 @@
+package target
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+func writeFile(t *testing.T, file string, data []byte) string {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func newTestPlugin(t *testing.T, allow ...string) *plugin {
+	p := &plugin{}
+	p.Config.Separator = "+@"
+	p.Config.Allow = allow
+	p.Config.DefaultPort = 22
+	p.Config.Timeout = 5 * time.Second
+	p.Config.Auth = authPassThrough
+	p.Config.IgnoreHostKey = true
+
+	upstreamtest.Init(t, p)
+
+	return p
+}
+
+func TestParseUsername(t *testing.T) {
+	p := newTestPlugin(t, "*")
+
+	for in, expected := range map[string]target{
+		"alice+db01.internal:2200": {"alice", "db01.internal", 2200},
+		"alice@db01":               {"alice", "db01", 22},
+		"alice@DB01.Internal.":     {"alice", "db01.internal", 22},
+		"alice+[::1]:2222":         {"alice", "::1", 2222},
+		"alice+[::1]":              {"alice", "::1", 22},
+		"alice+bob@db01":           {"alice", "bob@db01", 0},
+	} {
+		out, err := p.parseUsername(in)
+		if expected.port == 0 {
+			if err == nil {
+				t.Errorf("%v should be rejected, got %v", in, out)
+			}
+			continue
+		}
+
+		if err != nil || *out != expected {
+			t.Errorf("parse %v expect %v got %v %v", in, expected, out, err)
+		}
+	}
+
+	for _, in := range []string{"alice", "+db01", "alice+"} {
+		if _, err := p.parseUsername(in); !upstream.IsNotFound(err) {
+			t.Errorf("%v should not be found %v", in, err)
+		}
+	}
+
+	if _, err := p.parseUsername("alice+db01:99999"); err == nil || upstream.IsNotFound(err) {
+		t.Errorf("bad port should be rejected %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	p := newTestPlugin(t, "*.internal", "10.0.0.0/8", "127.0.0.0/8", "::1", "192.168.1.1")
+	p.Config.AllowPorts = []int{22, 2200}
+
+	for _, c := range []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"db01.internal", 22, true},
+		{"a.b.internal", 2200, true},
+		{"db01.internal", 2222, false},
+		{"internal", 22, false},
+		{"10.1.2.3", 22, true},
+		{"192.168.1.1", 22, true},
+		{"192.168.1.2", 22, false},
+		{"::1", 22, true},
+		{"localhost", 22, true},
+		{"example.invalid", 22, false},
+	} {
+		addr, err := p.resolve(&target{"alice", c.host, c.port})
+		if c.allowed != (err == nil) {
+			t.Errorf("%v:%v allowed expect %v got %v %v", c.host, c.port, c.allowed, addr, err)
+		}
+	}
+
+	if addr, _ := p.resolve(&target{"alice", "localhost", 22}); addr == "localhost:22" {
+		t.Errorf("resolved hostname should be pinned to ip")
+	}
+
+	if err := (&plugin{}).parseAllow(); err == nil {
+		t.Errorf("empty allow list should fail")
+	}
+
+	bad := &plugin{}
+	bad.Config.Allow = []string{"10.0.0.0/33x", "[a-"}
+	if err := bad.parseAllow(); err == nil {
+		t.Errorf("bad allow list should fail")
+	}
+}
+
+func TestFindUpstream(t *testing.T) {
+	up := upstreamtest.Listen(t)
+	defer up.Close()
+
+	port := up.Addr().(*net.TCPAddr).Port
+
+	dir, err := ioutil.TempDir("", "sshpiperd_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin(t, "127.0.0.0/8", "::1", "localhost")
+	p.Config.IgnoreHostKey = false
+	p.Config.KnownHosts = writeFile(t, path.Join(dir, "known_hosts"), []byte(fmt.Sprintf("[localhost]:%v %s", port, ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "ecdsa")))))
+	p.Config.Auth = authSharedKey
+	p.Config.PrivateKey = writeFile(t, path.Join(dir, "id_rsa"), testdata.PEMBytes["ed25519"])
+	p.Config.AuthorizedKeys = writeFile(t, path.Join(dir, "authorized_keys"), ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "rsa")))
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("should be healthy %v", err)
+	}
+
+	h := p.GetHandler()
+
+	c, pipe, err := h(upstreamtest.Conn{Username: "alice+localhost:" + strconv.Itoa(port)}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+
+	if pipe.User != "alice" {
+		t.Errorf("unexpected mapped user %v", pipe.User)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+
+	if err := pipe.UpstreamHostKeyCallback(remote.String(), remote, upstreamtest.PublicKey(t, "ecdsa")); err != nil {
+		t.Errorf("host key should be matched by target hostname %v", err)
+	}
+
+	if err := pipe.UpstreamHostKeyCallback(remote.String(), remote, upstreamtest.PublicKey(t, "rsa")); err == nil {
+		t.Errorf("other host key should be rejected")
+	}
+
+	if typ, method, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "alice"}, upstreamtest.PublicKey(t, "rsa")); typ != ssh.AuthPipeTypeMap || method == nil {
+		t.Errorf("authorized key should be mapped to shared key")
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "alice+10.0.0.2"}, nil); err == nil {
+		t.Errorf("not allowed target should fail")
+	}
+
+	if _, _, err := h(upstreamtest.Conn{Username: "alice"}, nil); !upstream.IsNotFound(err) {
+		t.Errorf("username without target should not be found %v", err)
+	}
+
+	// user key
+	p.Config.Auth = authUserKey
+	p.Config.IgnoreHostKey = true
+	p.Config.UserKeyDir = path.Join(dir, "users")
+
+	writeFile(t, path.Join(dir, "users", "bob", "id_rsa"), testdata.PEMBytes["ed25519"])
+	writeFile(t, path.Join(dir, "users", "bob", "authorized_keys"), ssh.MarshalAuthorizedKey(upstreamtest.PublicKey(t, "dsa")))
+
+	c, pipe, err = h(upstreamtest.Conn{Username: "bob@127.0.0.1:" + strconv.Itoa(port)}, nil)
+	if err != nil {
+		t.Fatalf("find upstream failed %v", err)
+	}
+	c.Close()
+
+	if typ, _, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "bob"}, upstreamtest.PublicKey(t, "dsa")); typ != ssh.AuthPipeTypeMap {
+		t.Errorf("authorized key should be mapped to user key")
+	}
+
+	if typ, _, _ := pipe.PublicKeyCallback(upstreamtest.Conn{Username: "bob"}, upstreamtest.PublicKey(t, "rsa")); typ == ssh.AuthPipeTypeMap {
+		t.Errorf("key of others should not be mapped")
+	}
+
+	for _, user := range []string{"carol", "../bob"} {
+		if _, _, err := h(upstreamtest.Conn{Username: user + "@127.0.0.1:" + strconv.Itoa(port)}, nil); err == nil {
+			t.Errorf("%v without user key should fail", user)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	for _, setup := range []func(p *plugin){
+		func(p *plugin) { p.Config.Separator = "" },
+		func(p *plugin) { p.Config.IgnoreHostKey = false },
+		func(p *plugin) { p.Config.Auth = authSharedKey },
+		func(p *plugin) { p.Config.Auth = authUserKey },
+		func(p *plugin) { p.Config.Auth = "password" },
+	} {
+		p := &plugin{}
+		p.Config.Separator = "+"
+		p.Config.Allow = []string{"*.internal"}
+		p.Config.IgnoreHostKey = true
+
+		setup(p)
+
+		if err := p.Init(logging.Discard()); err == nil {
+			t.Errorf("init should fail with %+v", p.Config)
+		}
+	}
+}
@@ -49,6 +49,7 @@ func (p *plugin) CreatePipe(opt upstream.CreatePipeOption) error {
 
 	path := userUpstreamFile.realPath(opt.Username)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
+		defer cache.Purge()
 
 		upuser := opt.UpstreamUsername
 
@@ -71,5 +72,6 @@ func (p *plugin) RemovePipe(name string) error {
 		return nil
 	}
 
+	defer cache.Purge()
 	return os.Remove(path)
 }
@@ -1,11 +1,18 @@
 package workingdir
 
 import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
-	"log"
 )
 
-var logger *log.Logger
+var (
+	logger logging.Logger
+	cache  *upstream.Cache
+)
 
 type plugin struct {
 }
@@ -22,7 +29,41 @@ func (p *plugin) GetHandler() upstream.Handler {
 	return findUpstreamFromUserfile
 }
 
-func (p *plugin) Init(glogger *log.Logger) error {
+// The working dir must be a readable directory
+func (p *plugin) HealthCheck() error {
+	f, err := os.Open(config.WorkingDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%v is not a directory", config.WorkingDir)
+	}
+
+	_, err = f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// Parsed sshpiper_upstream files are cached until they change
+func (p *plugin) UseCache(c *upstream.Cache) {
+	cache = c
+}
+
+func (p *plugin) Fingerprint() (string, error) {
+	return upstreamFilesFingerprint()
+}
+
+func (p *plugin) Init(glogger logging.Logger) error {
 
 	logger = glogger
 
@@ -8,7 +8,10 @@ package workingdir
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 	"golang.org/x/crypto/ssh/knownhosts"
 	"io/ioutil"
@@ -28,6 +31,7 @@ var (
 	userKeyFile            userFile = "id_rsa"
 	userUpstreamFile       userFile = "sshpiper_upstream"
 	userKnownHosts         userFile = "known_hosts"
+	userAllowedNetworks    userFile = "allowed_networks"
 
 	usernameRule *regexp.Regexp
 )
@@ -112,33 +116,123 @@ func parseUpstreamFile(data string) (host string, port int, user string, err err
 	return
 }
 
-func findUpstreamFromUserfile(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
-	user := conn.User()
+// parse allowed_networks, one CIDR or ip per line, lines start with ! are denied
+func parseAllowedNetworksFile(data string) upstream.SourceACL {
+	var acl upstream.SourceACL
 
-	if !checkUsername(user) {
-		return nil, nil, fmt.Errorf("downstream is not using a valid username")
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '!' {
+			acl.Denied = append(acl.Denied, strings.TrimSpace(line[1:]))
+			continue
+		}
+
+		acl.Allowed = append(acl.Allowed, line)
+	}
+
+	return acl
+}
+
+// check source address against allowed_networks of user, no file means no limit
+func checkAllowedNetworks(conn ssh.ConnMetadata, user string) error {
+	err := userAllowedNetworks.checkPerm(user)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
+	data, err := userAllowedNetworks.read(user)
+	if err != nil {
+		return err
+	}
+
+	return parseAllowedNetworksFile(string(data)).Check(conn.RemoteAddr())
+}
+
+// userUpstream is the parsed sshpiper_upstream of user
+type userUpstream struct {
+	// user whose directory is used, may be the fallback user
+	user       string
+	addr       string
+	mappedUser string
+}
+
+func lookupUpstreamFile(user string) (*userUpstream, error) {
 	err := userUpstreamFile.checkPerm(user)
 
 	if os.IsNotExist(err) && len(config.FallbackUsername) > 0 {
 		user = config.FallbackUsername
+	} else if os.IsNotExist(err) {
+		return nil, &upstream.NotFoundError{User: user}
 	} else if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	data, err := userUpstreamFile.read(user)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	host, port, mappedUser, err := parseUpstreamFile(string(data))
 	if err != nil {
+		return nil, err
+	}
+
+	return &userUpstream{user, fmt.Sprintf("%v:%v", host, port), mappedUser}, nil
+}
+
+// fingerprint of sshpiper_upstream files in working dir
+func upstreamFilesFingerprint() (string, error) {
+	dirs, err := ioutil.ReadDir(config.WorkingDir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+
+	for _, d := range dirs {
+		fi, err := os.Stat(userUpstreamFile.realPath(d.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%v %v %v\n", d.Name(), fi.ModTime().UnixNano(), fi.Size())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func findUpstreamFromUserfile(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
+
+	if !checkUsername(user) {
+		return nil, nil, fmt.Errorf("downstream is not using a valid username")
+	}
+
+	v, err := cache.Get(user, "", func() (interface{}, error) {
+		return lookupUpstreamFile(user)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u := v.(*userUpstream)
+	user, addr, mappedUser := u.user, u.addr, u.mappedUser
+
+	if err := checkAllowedNetworks(conn, user); err != nil {
+		logger.WithConn(conn).With(logging.Fields{"event": "acl_denied", "reason": err}).Warnf("pipe [%v] refused from [%v]: %v", user, conn.RemoteAddr(), err)
 		return nil, nil, err
 	}
-	addr := fmt.Sprintf("%v:%v", host, port)
 
-	logger.Printf("mapping user [%v] to [%v@%v]", user, mappedUser, addr)
+	logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": addr, "mapped_user": mappedUser}).Infof("mapping user [%v] to [%v@%v]", user, mappedUser, addr)
 
 	c, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -182,7 +276,7 @@ func mapPublicKeyFromUserfile(conn ssh.ConnMetadata, key ssh.PublicKey) (signer
 
 	defer func() { // print error when func exit
 		if err != nil {
-			logger.Printf("mapping private key error: %v, public key auth denied for [%v] from [%v]", err, user, conn.RemoteAddr())
+			logger.WithConn(conn).Errorf("mapping private key error: %v, public key auth denied for [%v] from [%v]", err, user, conn.RemoteAddr())
 		}
 	}()
 
@@ -231,12 +325,12 @@ func mapPublicKeyFromUserfile(conn ssh.ConnMetadata, key ssh.PublicKey) (signer
 			}
 
 			// in log may see this twice, one is for query the other is real sign again
-			logger.Printf("auth succ, using mapped private key [%v] for user [%v] from [%v]", userKeyFile.realPath(user), user, conn.RemoteAddr())
+			logger.WithConn(conn).Infof("auth succ, using mapped private key [%v] for user [%v] from [%v]", userKeyFile.realPath(user), user, conn.RemoteAddr())
 			return private, nil
 		}
 	}
 
-	logger.Printf("public key auth failed user [%v] from [%v]", conn.User(), conn.RemoteAddr())
+	logger.WithConn(conn).Warnf("public key auth failed user [%v] from [%v]", conn.User(), conn.RemoteAddr())
 
 	return nil, nil
 }
@@ -7,21 +7,28 @@ package workingdir
 
 import (
 	"bytes"
+	"flag"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
+	"path"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/testdata"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 )
 
-func init() {
+func TestMain(m *testing.M) {
+	flag.Parse()
+
 	if !testing.Verbose() {
-		logger = log.New(ioutil.Discard, "", 0)
+		logger = logging.Discard()
 	}
+
+	os.Exit(m.Run())
 }
 
 func buildWorkingDir(users []string, t *testing.T) {
@@ -376,3 +383,67 @@ func TestMapPublicKeyFromUserfile(t *testing.T) {
 		t.Fatalf("should not map private key when public key not in UserAuthorizedKeysFile")
 	}
 }
+
+type addrConnMetadata struct {
+	stubConnMetadata
+	addr net.Addr
+}
+
+func (s addrConnMetadata) RemoteAddr() net.Addr { return s.addr }
+
+func TestCheckAllowedNetworks(t *testing.T) {
+	user := "testuser"
+	buildWorkingDir([]string{user}, t)
+	defer cleanupWorkdir(t)
+
+	conn := func(ip string) ssh.ConnMetadata {
+		return addrConnMetadata{stubConnMetadata{user}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 2222}}
+	}
+
+	if err := checkAllowedNetworks(conn("10.0.0.1"), user); err != nil {
+		t.Fatalf("should allow all when no allowed_networks %v", err)
+	}
+
+	data := "# office\n10.0.0.0/8\n\n!10.0.0.1\n192.168.1.1\n"
+
+	err := ioutil.WriteFile(userAllowedNetworks.realPath(user), []byte(data), 0400)
+	if err != nil {
+		t.Fatalf("cant create file: %v", err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"10.0.0.2":    true,
+		"192.168.1.1": true,
+		"10.0.0.1":    false,
+		"192.168.1.2": false,
+	} {
+		err := checkAllowedNetworks(conn(ip), user)
+
+		if allowed && err != nil {
+			t.Errorf("%v should be allowed %v", ip, err)
+		}
+
+		if !allowed && err == nil {
+			t.Errorf("%v should be denied", ip)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	buildWorkingDir(nil, t)
+	defer cleanupWorkdir(t)
+
+	p := &plugin{}
+
+	if err := p.HealthCheck(); err != nil {
+		t.Errorf("working dir should be healthy %v", err)
+	}
+
+	dir := config.WorkingDir
+	config.WorkingDir = path.Join(dir, "not_exists")
+	defer func() { config.WorkingDir = dir }()
+
+	if err := p.HealthCheck(); err == nil {
+		t.Errorf("missing working dir should be unhealthy")
+	}
+}
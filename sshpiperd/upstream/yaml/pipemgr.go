@@ -115,6 +115,7 @@ func (p *plugin) loadConfigRaw() ([]byte, *yaml.Node, error) {
 }
 
 func (p *plugin) writeConfig(config []byte) error {
+	defer p.cache.Purge()
 	return ioutil.WriteFile(p.Config.File, config, 0600)
 }
 
@@ -1,8 +1,10 @@
 package yaml
 
 import (
-	"log"
+	"fmt"
+	"os"
 
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 )
 
@@ -12,7 +14,8 @@ type plugin struct {
 		NoCheckPerm bool   `long:"upstream-yaml-nocheckperm" description:"Disable 0400 checking when using config file" env:"SSHPIPERD_UPSTREAM_YAML_NOCHECKPERM" ini-name:"upstream-yaml-nocheckperm"`
 	}
 
-	logger *log.Logger
+	logger logging.Logger
+	cache  *upstream.Cache
 }
 
 // The name of the Plugin
@@ -26,12 +29,33 @@ func (p *plugin) GetOpts() interface{} {
 	return &p.Config
 }
 
+// Matched pipes are cached until the config file changes
+func (p *plugin) UseCache(cache *upstream.Cache) {
+	p.cache = cache
+}
+
+// Changes when the config file is modified
+func (p *plugin) Fingerprint() (string, error) {
+	fi, err := os.Stat(p.Config.File)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v %v", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
 // Will be called before the Plugin is used to ensure the Plugin is ready
-func (p *plugin) Init(logger *log.Logger) error {
+func (p *plugin) Init(logger logging.Logger) error {
 	p.logger = logger
 	return nil
 }
 
+// The config file must be readable and parseable
+func (p *plugin) HealthCheck() error {
+	_, err := p.loadConfig()
+	return err
+}
+
 func (p *plugin) GetHandler() upstream.Handler {
 	return p.findUpstream
 }
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"regexp"
 
+	"github.com/tg123/sshpiper/sshpiperd/logging"
 	"github.com/tg123/sshpiper/sshpiperd/upstream"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
@@ -17,9 +18,12 @@ import (
 )
 
 type pipeConfig struct {
-	Username           string `yaml:"username"`
-	UsernameRegexMatch bool   `yaml:"username_regex_match,omitempty"`
-	UpstreamHost       string `yaml:"upstream_host"`
+	Username           string   `yaml:"username"`
+	UsernameRegexMatch bool     `yaml:"username_regex_match,omitempty"`
+	UpstreamHost       string   `yaml:"upstream_host"`
+	Listen             []string `yaml:"listen,omitempty,flow"`
+	AllowedNetworks    []string `yaml:"allowed_networks,omitempty,flow"`
+	DeniedNetworks     []string `yaml:"denied_networks,omitempty,flow"`
 	Authmap            struct {
 		MappedUsername string `yaml:"mapped_username,omitempty"`
 		From           []struct {
@@ -341,39 +345,70 @@ func (p *plugin) createAuthPipe(pipe pipeConfig, conn ssh.ConnMetadata, challeng
 	return a, nil
 }
 
-func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
-	user := conn.User()
-
+// matchPipe finds the first pipe of user connected to local address in config file
+// pipes with listen but without username match all users connected to the listen addresses
+func (p *plugin) matchPipe(user string, local net.Addr) (*pipeConfig, error) {
 	config, err := p.loadConfig()
 
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	for _, pipe := range config.Pipes {
-		matched := pipe.Username == user
+		if !upstream.MatchListen(pipe.Listen, local) {
+			continue
+		}
+
+		matched := pipe.Username == user || (pipe.Username == "" && len(pipe.Listen) > 0)
 
 		if pipe.UsernameRegexMatch {
 			matched, _ = regexp.MatchString(pipe.Username, user)
 		}
 
 		if matched {
+			pipe := pipe
+			return &pipe, nil
+		}
+	}
 
-			p.logger.Printf("mapping [%v] to [%v@%v]", user, pipe.Authmap.MappedUsername, pipe.UpstreamHost)
+	return nil, &upstream.NotFoundError{User: user}
+}
 
-			c, err := upstream.DialForSSH(pipe.UpstreamHost)
-			if err != nil {
-				return nil, nil, err
-			}
+func (p *plugin) findUpstream(conn ssh.ConnMetadata, challengeContext ssh.AdditionalChallengeContext) (net.Conn, *ssh.AuthPipe, error) {
+	user := conn.User()
 
-			a, err := p.createAuthPipe(pipe, conn, challengeContext)
-			if err != nil {
-				return nil, nil, err
-			}
+	var listen string
+	if local := conn.LocalAddr(); local != nil {
+		listen = local.String()
+	}
 
-			return c, a, nil
-		}
+	v, err := p.cache.Get(user, listen, func() (interface{}, error) {
+		return p.matchPipe(user, conn.LocalAddr())
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pipe := *v.(*pipeConfig)
+
+	acl := upstream.SourceACL{Allowed: pipe.AllowedNetworks, Denied: pipe.DeniedNetworks}
+	if err := acl.Check(conn.RemoteAddr()); err != nil {
+		p.logger.WithConn(conn).With(logging.Fields{"event": "acl_denied", "reason": err}).Warnf("pipe [%v] refused from [%v]: %v", pipe.Username, conn.RemoteAddr(), err)
+		return nil, nil, err
+	}
+
+	p.logger.WithConn(conn).With(logging.Fields{"event": "upstream_mapped", "upstream": pipe.UpstreamHost, "mapped_user": pipe.Authmap.MappedUsername}).Infof("mapping [%v] to [%v@%v]", user, pipe.Authmap.MappedUsername, pipe.UpstreamHost)
+
+	c, err := upstream.DialForSSH(pipe.UpstreamHost)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := p.createAuthPipe(pipe, conn, challengeContext)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, nil, fmt.Errorf("username not [%v] found", user)
+	return c, a, nil
 }
@@ -0,0 +1,149 @@
+package yaml
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/sshpiperd/logging"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"github.com/tg123/sshpiper/sshpiperd/upstream/internal/upstreamtest"
+)
+
+func newTestPlugin(t *testing.T, config string) (*plugin, func()) {
+	dir, err := ioutil.TempDir("", "sshpiperd_yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &plugin{}
+	p.Config.File = path.Join(dir, "sshpiperd.yaml")
+	p.logger = logging.Discard()
+
+	if err := ioutil.WriteFile(p.Config.File, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return p, func() { os.RemoveAll(dir) }
+}
+
+type localConn struct {
+	upstreamtest.Conn
+	local net.Addr
+}
+
+func (c localConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func local(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestMatchPipeListen(t *testing.T) {
+	p, cleanup := newTestPlugin(t, `
+version: 1
+pipes:
+- username: alice
+  upstream_host: alice-2201
+  listen: [":2201"]
+- username: alice
+  upstream_host: alice-any
+- username: bob
+  upstream_host: bob-2202
+  listen: ["10.0.0.1:2202"]
+- upstream_host: staging
+  listen: ["10.0.0.1:2202", "[::1]:2203"]
+`)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		user  string
+		local net.Addr
+		host  string
+	}{
+		{"alice", local("10.0.0.1", 2201), "alice-2201"},
+		{"alice", local("10.0.0.2", 2222), "alice-any"},
+		{"alice", nil, "alice-any"},
+		{"bob", local("10.0.0.1", 2202), "bob-2202"},
+		{"carol", local("10.0.0.1", 2202), "staging"},
+		{"carol", local("::1", 2203), "staging"},
+		{"carol", local("10.0.0.2", 2202), ""},
+		{"bob", local("10.0.0.1", 2222), ""},
+		{"carol", nil, ""},
+	} {
+		pipe, err := p.matchPipe(tc.user, tc.local)
+
+		if tc.host == "" {
+			if !upstream.IsNotFound(err) {
+				t.Errorf("%v on %v should not be found %v", tc.user, tc.local, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v on %v should be found %v", tc.user, tc.local, err)
+			continue
+		}
+
+		if pipe.UpstreamHost != tc.host {
+			t.Errorf("%v on %v should be routed to %v, got %v", tc.user, tc.local, tc.host, pipe.UpstreamHost)
+		}
+	}
+}
+
+func TestFindUpstreamCacheListen(t *testing.T) {
+	up1 := upstreamtest.Listen(t)
+	defer up1.Close()
+
+	up2 := upstreamtest.Listen(t)
+	defer up2.Close()
+
+	p, cleanup := newTestPlugin(t, fmt.Sprintf(`
+version: 1
+pipes:
+- username: alice
+  upstream_host: %v
+  listen: [":2201"]
+  ignore_hostkey: true
+- username: alice
+  upstream_host: %v
+  ignore_hostkey: true
+`, up1.Addr(), up2.Addr()))
+	defer cleanup()
+
+	cache := upstream.NewCache(upstream.CacheOptions{TTL: time.Hour})
+	defer cache.Close()
+	p.UseCache(cache)
+
+	h := p.GetHandler()
+
+	dial := func(port int) string {
+		c, _, err := h(localConn{upstreamtest.Conn{Username: "alice"}, local("10.0.0.1", port)}, nil)
+		if err != nil {
+			t.Fatalf("alice on %v should be found %v", port, err)
+		}
+		defer c.Close()
+
+		return c.RemoteAddr().String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if addr := dial(2201); addr != up1.Addr().String() {
+			t.Errorf("alice on 2201 should be routed to %v, got %v", up1.Addr(), addr)
+		}
+
+		if addr := dial(2222); addr != up2.Addr().String() {
+			t.Errorf("alice on 2222 should be routed to %v, got %v", up2.Addr(), addr)
+		}
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("lookups on different listen addresses should be cached separately, got %v", cache.Len())
+	}
+}